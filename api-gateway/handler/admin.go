@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+// exportColumns is the header row of CSV order exports
+var exportColumns = []string{
+	"id", "user_id", "status", "currency", "total", "payment_status", "payment_method",
+	"shipping_country", "created_at", "updated_at", "version",
+}
+
+// AdminListOrders lists the orders of every user, or of ?user_id, with the
+// filters and paging of ListOrders
+func (g *Gateway) AdminListOrders(c *gin.Context) {
+	if !hasRole(c, RoleAdmin) {
+		g.respondError(c, status.Error(codes.PermissionDenied, "not allowed to list all orders"))
+		return
+	}
+
+	req := &orderv1.AdminListOrdersRequest{
+		UserId:    c.Query("user_id"),
+		PageToken: c.Query("page_token"),
+	}
+
+	var err error
+	if req.Filter, req.OrderBy, err = parseOrderFilter(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+	if req.SortOrder, err = parseSortOrder(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+	if req.PageSize, err = parsePageSize(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	resp, err := g.orderClient.AdminListOrders(c.Request.Context(), req)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	g.respondProto(c, http.StatusOK, resp)
+}
+
+// ExportOrders downloads every order matching the AdminListOrders filters as
+// CSV or, with ?format=ndjson, as one JSON order per line. Each batch from
+// order-service is written and flushed before the next one is read.
+func (g *Gateway) ExportOrders(c *gin.Context) {
+	if !hasRole(c, RoleAdmin) {
+		g.respondError(c, status.Error(codes.PermissionDenied, "not allowed to export orders"))
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	var contentType string
+	switch format {
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	case "ndjson":
+		contentType = "application/x-ndjson"
+	default:
+		g.respondError(c, status.Error(codes.InvalidArgument, "format must be csv or ndjson"))
+		return
+	}
+
+	req := &orderv1.ExportOrdersRequest{UserId: c.Query("user_id")}
+	var err error
+	if req.Filter, req.OrderBy, err = parseOrderFilter(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+	if req.SortOrder, err = parseSortOrder(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	// Stop the backend stream as soon as the client goes away
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	stream, err := g.orderClient.ExportOrders(ctx, req)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	// Invalid filters fail the first read, which can still get an ordinary
+	// error response
+	first, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		g.respondError(c, err)
+		return
+	}
+
+	// The server write timeout is meant for ordinary requests
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		g.logger.Debug("Order export keeps the server write timeout", zap.Error(err))
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="orders.`+format+`"`)
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	write := func(orders []*orderv1.Order) error {
+		return writeOrdersNDJSON(c.Writer, orders)
+	}
+	if format == "csv" {
+		w := csv.NewWriter(c.Writer)
+		// Sent with the first batch, or alone if nothing matched
+		w.Write(exportColumns)
+		write = func(orders []*orderv1.Order) error {
+			return writeOrdersCSV(w, orders)
+		}
+	}
+
+	resp := first
+	for {
+		if err := write(resp.GetOrders()); err != nil {
+			// The client went away
+			return
+		}
+		c.Writer.Flush()
+		if resp == nil {
+			return
+		}
+
+		resp, err = stream.Recv()
+		if err != nil && err != io.EOF {
+			g.abortExport(c, err)
+			return
+		}
+	}
+}
+
+func writeOrdersNDJSON(w io.Writer, orders []*orderv1.Order) error {
+	for _, order := range orders {
+		data, err := protoMarshaler.Marshal(order)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeOrdersCSV(w *csv.Writer, orders []*orderv1.Order) error {
+	for _, order := range orders {
+		// Totals from order-service are always valid
+		total, _ := money.FromProto(order.GetTotal())
+		err := w.Write([]string{
+			order.GetId(),
+			order.GetUserId(),
+			order.GetStatus().String(),
+			total.Currency,
+			total.String(),
+			order.GetPaymentInfo().GetStatus().String(),
+			order.GetPaymentInfo().GetMethod().String(),
+			order.GetShippingInfo().GetCountry(),
+			formatExportTime(order.GetCreatedAt()),
+			formatExportTime(order.GetUpdatedAt()),
+			strconv.FormatInt(order.GetVersion(), 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatExportTime(ts *timestamppb.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+	return ts.AsTime().UTC().Format(time.RFC3339Nano)
+}
+
+// abortExport ends an export that failed after its first rows were sent. The
+// status line is gone by then, so the connection is closed without ending
+// the response body, which clients report as a failed download rather than a
+// complete but short file.
+func (g *Gateway) abortExport(c *gin.Context, err error) {
+	if c.Request.Context().Err() != nil {
+		return
+	}
+	g.logger.Error("Order export failed", zap.String("path", c.Request.URL.Path), zap.Error(err))
+
+	conn, _, herr := http.NewResponseController(c.Writer).Hijack()
+	if herr != nil {
+		g.logger.Debug("Failed order export cannot be aborted", zap.Error(herr))
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,400 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/zabilal/microservices/monitoring/logger"
+)
+
+// Keys used to store validated claims on the gin context
+const (
+	ContextKeySubject = "auth.subject"
+	ContextKeyRoles   = "auth.roles"
+)
+
+// RoleAdmin grants access to data owned by other users
+const RoleAdmin = "admin"
+
+// Metadata keys used to forward the caller identity to the gRPC backends
+const (
+	MetadataUserID    = "x-user-id"
+	MetadataUserRoles = "x-user-roles"
+)
+
+// MinHMACSecretLength is the shortest accepted HS256 secret. RFC 7518 requires
+// a key at least as long as the hash output, and it keeps short placeholder
+// values out of production.
+const MinHMACSecretLength = 32
+
+// DefaultJWKSMinReload is used when AuthConfig.JWKSMinReload is unset
+const DefaultJWKSMinReload = 5 * time.Second
+
+var (
+	ErrMissingToken  = errors.New("missing bearer token")
+	ErrUnknownKey    = errors.New("unknown signing key")
+	ErrInvalidClaims = errors.New("invalid token claims")
+)
+
+// AuthConfig holds the token verification settings
+type AuthConfig struct {
+	Issuer      string
+	Audience    string
+	Leeway      time.Duration
+	HMACSecret  string            `mapstructure:"hmac_secret"`
+	HMACKeyID   string            `mapstructure:"hmac_key_id"`
+	PublicKeys  []PublicKeyConfig `mapstructure:"public_keys"`
+	JWKSFile    string            `mapstructure:"jwks_file"`
+	JWKSRefresh time.Duration     `mapstructure:"jwks_refresh"`
+	// JWKSMinReload is the shortest time between the reloads an unknown kid
+	// triggers, so unknown kids cannot make every request read the file.
+	// Defaults to DefaultJWKSMinReload.
+	JWKSMinReload time.Duration `mapstructure:"jwks_min_reload"`
+	// Now is the clock tokens and reloads are checked against, time.Now
+	// when unset
+	Now func() time.Time `mapstructure:"-"`
+}
+
+// PublicKeyConfig points at a PEM encoded RSA or ECDSA public key
+type PublicKeyConfig struct {
+	KeyID string `mapstructure:"kid"`
+	File  string
+}
+
+// Claims are the access token claims issued by user-service
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// TokenVerifier validates bearer tokens against a set of keys indexed by kid
+type TokenVerifier struct {
+	config *AuthConfig
+
+	mu         sync.RWMutex
+	staticKeys map[string]interface{}
+	jwksKeys   map[string]interface{}
+	jwksMod    time.Time
+	lastReload time.Time
+}
+
+func NewTokenVerifier(config *AuthConfig) (*TokenVerifier, error) {
+	v := &TokenVerifier{
+		config:     config,
+		staticKeys: make(map[string]interface{}),
+		jwksKeys:   make(map[string]interface{}),
+	}
+
+	if config.HMACSecret != "" {
+		if len(config.HMACSecret) < MinHMACSecretLength {
+			return nil, fmt.Errorf("hmac_secret must be at least %d bytes", MinHMACSecretLength)
+		}
+		v.staticKeys[config.HMACKeyID] = []byte(config.HMACSecret)
+	}
+
+	for _, pk := range config.PublicKeys {
+		key, err := loadPEMPublicKey(pk.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public key %q: %w", pk.KeyID, err)
+		}
+		v.staticKeys[pk.KeyID] = key
+	}
+
+	if config.JWKSFile != "" {
+		if err := v.reloadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(v.staticKeys) == 0 && len(v.jwksKeys) == 0 {
+		return nil, errors.New("no token verification keys configured")
+	}
+
+	return v, nil
+}
+
+// Verify parses the token, checks its signature and validates exp, nbf, iss and aud
+func (v *TokenVerifier) Verify(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		jwt.WithoutClaimsValidation(),
+	)
+
+	if _, err := parser.ParseWithClaims(tokenString, claims, v.keyFunc); err != nil {
+		return nil, err
+	}
+
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *TokenVerifier) now() time.Time {
+	if v.config.Now != nil {
+		return v.config.Now()
+	}
+	return time.Now()
+}
+
+func (v *TokenVerifier) validateClaims(claims *Claims) error {
+	now := v.now()
+	leeway := v.config.Leeway
+
+	if claims.ExpiresAt == nil || now.After(claims.ExpiresAt.Add(leeway)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidClaims)
+	}
+	if claims.NotBefore != nil && now.Add(leeway).Before(claims.NotBefore.Time) {
+		return fmt.Errorf("%w: token not yet valid", ErrInvalidClaims)
+	}
+	if v.config.Issuer != "" && !claims.VerifyIssuer(v.config.Issuer, true) {
+		return fmt.Errorf("%w: unexpected issuer", ErrInvalidClaims)
+	}
+	if v.config.Audience != "" && !claims.VerifyAudience(v.config.Audience, true) {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidClaims)
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: missing subject", ErrInvalidClaims)
+	}
+
+	return nil
+}
+
+func (v *TokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := v.lookup(kid)
+	if !ok && v.config.JWKSFile != "" {
+		// The key may have been rotated in since the last reload
+		if err := v.maybeReloadJWKS(); err != nil {
+			return nil, err
+		}
+		key, ok = v.lookup(kid)
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if _, ok := key.([]byte); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("key %q does not match algorithm %s", kid, token.Method.Alg())
+}
+
+func (v *TokenVerifier) lookup(kid string) (interface{}, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if key, ok := v.jwksKeys[kid]; ok {
+		return key, true
+	}
+	key, ok := v.staticKeys[kid]
+	return key, ok
+}
+
+// Watch periodically reloads the JWKS file so rotated keys are picked up
+func (v *TokenVerifier) Watch(ctx context.Context, log *logger.Logger) {
+	if v.config.JWKSFile == "" || v.config.JWKSRefresh <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(v.config.JWKSRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := v.reloadJWKS(); err != nil {
+				log.Error("Failed to reload JWKS", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (v *TokenVerifier) maybeReloadJWKS() error {
+	minReload := v.config.JWKSMinReload
+	if minReload <= 0 {
+		minReload = DefaultJWKSMinReload
+	}
+
+	v.mu.RLock()
+	recent := v.now().Sub(v.lastReload) < minReload
+	v.mu.RUnlock()
+	if recent {
+		return nil
+	}
+	return v.reloadJWKS()
+}
+
+func (v *TokenVerifier) reloadJWKS() error {
+	info, err := os.Stat(v.config.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat JWKS file: %w", err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.lastReload = v.now()
+	if !info.ModTime().After(v.jwksMod) {
+		return nil
+	}
+
+	data, err := os.ReadFile(v.config.JWKSFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.jwksKeys = keys
+	v.jwksMod = info.ModTime()
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func loadPEMPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return jwt.ParseECPublicKeyFromPEM(data)
+}
+
+func bearerToken(header string) (string, error) {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", ErrMissingToken
+	}
+	return strings.TrimSpace(header[len(prefix):]), nil
+}
+
+// withCaller attaches the authenticated caller to the outgoing gRPC metadata
+func withCaller(ctx context.Context, claims *Claims) context.Context {
+	return metadata.AppendToOutgoingContext(ctx,
+		MetadataUserID, claims.Subject,
+		MetadataUserRoles, strings.Join(claims.Roles, ","),
+	)
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Orders and users carry a version that is bumped on every change. The
+// gateway exposes it as a strong ETag and turns If-Match into the
+// expected_version of update requests.
+
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+func setETag(c *gin.Context, version int64) {
+	if version > 0 {
+		c.Header("ETag", etag(version))
+	}
+}
+
+// ifMatchVersion returns the version required by the If-Match header, or zero
+// when the request is unconditional. It responds with 412 and returns false
+// for a header that cannot match any version.
+func (g *Gateway) ifMatchVersion(c *gin.Context) (int64, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	// Weak tags never match under If-Match
+	if unquoted, err := strconv.Unquote(header); err == nil {
+		if version, err := strconv.ParseInt(unquoted, 10, 64); err == nil && version > 0 {
+			return version, true
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusPreconditionFailed, errorResponse{
+		Error: errorBody{
+			Code:    "FailedPrecondition",
+			Message: "If-Match must be a single ETag returned by this API",
+		},
+	})
+	return 0, false
+}
+
+// httpStatus maps a gRPC status to the HTTP status of the response. A version
+// conflict on a conditional request is a failed precondition rather than a
+// plain conflict.
+func httpStatus(st *status.Status, r *http.Request) int {
+	if st.Code() == codes.Aborted && r.Header.Get("If-Match") != "" {
+		return http.StatusPreconditionFailed
+	}
+	return runtime.HTTPStatusFromCode(st.Code())
+}
@@ -3,26 +3,35 @@ package handler
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/cors"
 	"go.uber.org/zap"
-	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/zabilal/microservices/monitoring/logger"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/servicetoken"
 )
 
 type Gateway struct {
-	config     *Config
-	logger     *logger.Logger
-	limiter    *rate.Limiter
-	userConn   *grpc.ClientConn
-	orderConn  *grpc.ClientConn
+	config      *Config
+	logger      *logger.Logger
+	rateStore   RateLimitStore
+	userConn    *grpc.ClientConn
+	orderConn   *grpc.ClientConn
+	userClient  userv1.UserServiceClient
+	orderClient orderv1.OrderServiceClient
+	verifier    *TokenVerifier
+	webhooks    *WebhookVerifier
 }
 
 type Config struct {
@@ -44,40 +53,109 @@ type Config struct {
 	CORS struct {
 		AllowedOrigins []string
 	}
-	RateLimit struct {
-		Burst int
-	}
+	RateLimit      RateLimitConfig `mapstructure:"rate_limit"`
+	Auth           AuthConfig
+	Webhooks       WebhookConfig
+	ForwardHeaders []string `mapstructure:"forward_headers"`
+	// TrustedProxies lists the addresses or CIDRs of the load balancers whose
+	// X-Forwarded-For header is believed. By default none is, and clients
+	// are identified by the address they connect from.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// ServiceToken is sent with every backend call so that the backends can
+	// trust the caller identity the gateway forwards
+	ServiceToken string `mapstructure:"service_token"`
 }
 
 func NewGateway(config *Config, logger *logger.Logger) (*Gateway, error) {
+	verifier, err := NewTokenVerifier(&config.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, err := NewWebhookVerifier(&config.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceToken, err := servicetoken.New(config.ServiceToken)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize gRPC connections
-	userConn, err := grpc.Dial(config.Services.UserService.Endpoint, grpc.WithInsecure())
+	userConn, err := grpc.Dial(config.Services.UserService.Endpoint, grpc.WithInsecure(), serviceToken.DialOption())
 	if err != nil {
 		return nil, err
 	}
 
-	orderConn, err := grpc.Dial(config.Services.OrderService.Endpoint, grpc.WithInsecure())
+	orderConn, err := grpc.Dial(config.Services.OrderService.Endpoint, grpc.WithInsecure(), serviceToken.DialOption())
 	if err != nil {
 		return nil, err
 	}
 
 	return &Gateway{
-		config:     config,
-		logger:     logger,
-		limiter:    rate.NewLimiter(rate.Every(time.Second), config.RateLimit.Burst),
-		userConn:   userConn,
-		orderConn:  orderConn,
+		config:      config,
+		logger:      logger,
+		rateStore:   NewMemoryRateLimitStore(config.RateLimit.IdleTimeout),
+		userConn:    userConn,
+		orderConn:   orderConn,
+		userClient:  userv1.NewUserServiceClient(userConn),
+		orderClient: orderv1.NewOrderServiceClient(orderConn),
+		verifier:    verifier,
+		webhooks:    webhooks,
 	}, nil
 }
 
 func (g *Gateway) Run(ctx context.Context) error {
+	router, err := g.Handler(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Evict idle rate limit buckets
+	if store, ok := g.rateStore.(*MemoryRateLimitStore); ok {
+		go store.Watch(ctx)
+	}
+
+	// Pick up rotated signing keys
+	go g.verifier.Watch(ctx, g.logger)
+
+	// Start server
+	srv := &http.Server{
+		Addr:         g.config.Listen.Address,
+		Handler:      router,
+		ReadTimeout:  g.config.Server.ReadTimeout,
+		WriteTimeout: g.config.Server.WriteTimeout,
+	}
+
+	// Graceful shutdown
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			g.logger.Error("Server forced to shutdown", zap.Error(err))
+		}
+	}()
+
+	g.logger.Info("Starting gateway server", zap.String("address", g.config.Listen.Address))
+	return srv.ListenAndServe()
+}
+
+// Handler builds the router serving every gateway route, without starting
+// the background work Run does
+func (g *Gateway) Handler(ctx context.Context) (http.Handler, error) {
 	// Initialize Gin router
 	router := gin.Default()
+	if err := router.SetTrustedProxies(g.config.TrustedProxies); err != nil {
+		return nil, err
+	}
 
 	// Add middleware
 	router.Use(g.corsMiddleware())
-	router.Use(g.rateLimitMiddleware())
+	router.Use(g.ipRateLimitMiddleware())
 	router.Use(g.authMiddleware())
+	router.Use(g.rateLimitMiddleware())
 	router.Use(g.loggingMiddleware())
 
 	// Register routes
@@ -86,38 +164,52 @@ func (g *Gateway) Run(ctx context.Context) error {
 		// User routes
 		users := v1.Group("/users")
 		{
+			users.POST("/register", g.Register)
+			users.POST("/login", g.Login)
+			users.POST("/refresh", g.RefreshToken)
+			users.POST("/logout", g.Logout)
 			users.POST("/", g.CreateUser)
 			users.GET("/:id", g.GetUser)
+			users.PUT("/:id", g.UpdateUser)
 		}
 
 		// Order routes
 		orders := v1.Group("/orders")
 		{
 			orders.POST("/", g.CreateOrder)
+			orders.GET("/", g.ListOrders)
 			orders.GET("/:id", g.GetOrder)
+			orders.GET("/:id/history", g.GetOrderHistory)
+			orders.PATCH("/:id/status", g.UpdateOrderStatus)
+			orders.POST("/:id/cancel", g.CancelOrder)
+			orders.GET("/:id/watch", g.WatchOrder)
+		}
+
+		// Operator routes across all users
+		admin := v1.Group("/admin")
+		{
+			admin.GET("/orders", g.AdminListOrders)
+			admin.GET("/orders/export", g.ExportOrders)
 		}
+
+		// Payment provider callbacks, authenticated by their signature
+		v1.POST("/webhooks/payments", g.PaymentWebhook)
 	}
 
-	// Start server
-	srv := &http.Server{
-		Addr:         g.config.Listen.Address,
-		Handler:      router,
-		ReadTimeout:  g.config.Server.ReadTimeout,
-		WriteTimeout: g.config.Server.WriteTimeout,
+	// Routes generated from the google.api.http bindings in the proto contracts
+	protoMux, err := g.newProtoMux(ctx)
+	if err != nil {
+		return nil, err
 	}
+	router.Any("/v1/*path", gin.WrapH(protoMux))
 
-	// Graceful shutdown
-	go func() {
-		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			g.logger.Error("Server forced to shutdown", zap.Error(err))
-		}
-	}()
+	return router, nil
+}
 
-	g.logger.Info("Starting gateway server", zap.String("address", g.config.Listen.Address))
-	return srv.ListenAndServe()
+// UseRateLimitStore replaces the in-memory rate limit store, e.g. with one
+// shared between gateway replicas
+func (g *Gateway) UseRateLimitStore(store RateLimitStore) {
+	g.rateStore = store
 }
 
 func (g *Gateway) Close() error {
@@ -132,8 +224,9 @@ func (g *Gateway) corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		cors.New(cors.Options{
 			AllowedOrigins:   g.config.CORS.AllowedOrigins,
-			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowedHeaders:   []string{"Authorization", "Content-Type"},
+			AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "If-Match", "Idempotency-Key"},
+			ExposedHeaders:   []string{"ETag"},
 			AllowCredentials: true,
 			MaxAge:           300,
 		}).Handler(c.Writer)
@@ -141,16 +234,6 @@ func (g *Gateway) corsMiddleware() gin.HandlerFunc {
 	}
 }
 
-func (g *Gateway) rateLimitMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if !g.limiter.Allow() {
-			c.AbortWithStatus(http.StatusTooManyRequests)
-			return
-		}
-		c.Next()
-	}
-}
-
 func (g *Gateway) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if isPublicEndpoint(c.Request.URL.Path) {
@@ -158,20 +241,25 @@ func (g *Gateway) authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		token, err := bearerToken(c.GetHeader("Authorization"))
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
-		// Token validation logic here
-		// This is a simplified version, you should implement proper JWT validation
-		token := authHeader[7:] // Remove "Bearer " prefix
-		if token == "" {
+		claims, err := g.verifier.Verify(token)
+		if err != nil {
+			g.logger.Debug("Rejected bearer token", zap.Error(err))
+			c.Header("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
+		c.Set(ContextKeySubject, claims.Subject)
+		c.Set(ContextKeyRoles, claims.Roles)
+		c.Request = c.Request.WithContext(withCaller(c.Request.Context(), claims))
+
 		c.Next()
 	}
 }
@@ -201,6 +289,11 @@ func isPublicEndpoint(path string) bool {
 	publicPaths := []string{
 		"/api/v1/users/login",
 		"/api/v1/users/register",
+		"/api/v1/users/refresh",
+		"/v1/users/login",
+		"/v1/users/register",
+		"/v1/users/refresh",
+		"/api/v1/webhooks/payments",
 		"/health",
 		"/metrics",
 	}
@@ -213,19 +306,299 @@ func isPublicEndpoint(path string) bool {
 	return false
 }
 
+// errorResponse is the JSON envelope returned for failed requests
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Details []errorDetail `json:"details,omitempty"`
+}
+
+// errorDetail is a precondition violation reported by a backend, such as the
+// order statuses allowed next
+type errorDetail struct {
+	Type        string `json:"type"`
+	Subject     string `json:"subject"`
+	Description string `json:"description"`
+}
+
+func errorDetails(st *status.Status) []errorDetail {
+	var details []errorDetail
+	for _, d := range st.Details() {
+		failure, ok := d.(*errdetails.PreconditionFailure)
+		if !ok {
+			continue
+		}
+		for _, v := range failure.GetViolations() {
+			details = append(details, errorDetail{
+				Type:        v.GetType(),
+				Subject:     v.GetSubject(),
+				Description: v.GetDescription(),
+			})
+		}
+	}
+	return details
+}
+
+// respondError translates a gRPC status into an HTTP error response
+func (g *Gateway) respondError(c *gin.Context, err error) {
+	st := status.Convert(err)
+	code := httpStatus(st, c.Request)
+	if code >= http.StatusInternalServerError {
+		g.logger.Error("Backend request failed", zap.String("path", c.Request.URL.Path), zap.Error(err))
+	}
+
+	c.AbortWithStatusJSON(code, errorResponse{
+		Error: errorBody{
+			Code:    st.Code().String(),
+			Message: st.Message(),
+			Details: errorDetails(st),
+		},
+	})
+}
+
+// protoMarshaler renders gRPC responses with the field names from the proto
+// contract and enums as their string names
+var protoMarshaler = protojson.MarshalOptions{
+	UseProtoNames:   true,
+	EmitUnpopulated: true,
+}
+
+func (g *Gateway) respondProto(c *gin.Context, httpStatus int, msg proto.Message) {
+	data, err := protoMarshaler.Marshal(msg)
+	if err != nil {
+		g.respondError(c, status.Error(codes.Internal, "failed to encode response"))
+		return
+	}
+	c.Data(httpStatus, "application/json", data)
+}
+
+// bindJSON binds and validates the request body, responding with 400 on failure
+func (g *Gateway) bindJSON(c *gin.Context, obj interface{}) bool {
+	if err := c.ShouldBindJSON(obj); err != nil {
+		g.respondError(c, status.Error(codes.InvalidArgument, err.Error()))
+		return false
+	}
+	return true
+}
+
+func hasRole(c *gin.Context, role string) bool {
+	for _, r := range c.GetStringSlice(ContextKeyRoles) {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessUser reports whether the caller may read data owned by userID
+func canAccessUser(c *gin.Context, userID string) bool {
+	return c.GetString(ContextKeySubject) == userID || hasRole(c, RoleAdmin)
+}
+
+// parseEnum accepts either the full proto enum name or the name without
+// its prefix, case insensitively, and rejects the UNSPECIFIED value
+func parseEnum(value, prefix string, values map[string]int32) (int32, bool) {
+	name := strings.ToUpper(value)
+	if !strings.HasPrefix(name, prefix) {
+		name = prefix + name
+	}
+	n, ok := values[name]
+	return n, ok && n != 0
+}
+
 // Route handlers
+type registerRequest struct {
+	Email     string `json:"email" binding:"required,email"`
+	Password  string `json:"password" binding:"required"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type loginRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	UserID       string `json:"user_id,omitempty"`
+}
+
+func (g *Gateway) Register(c *gin.Context) {
+	var req registerRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	resp, err := g.userClient.CreateUser(c.Request.Context(), &userv1.CreateUserRequest{
+		Email:     req.Email,
+		Password:  req.Password,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": resp.GetId()})
+}
+
+func (g *Gateway) Login(c *gin.Context) {
+	var req loginRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	resp, err := g.userClient.Login(c.Request.Context(), &userv1.LoginRequest{
+		Email:    req.Email,
+		Password: req.Password,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse{
+		AccessToken:  resp.GetAccessToken(),
+		RefreshToken: resp.GetRefreshToken(),
+		TokenType:    resp.GetTokenType(),
+		ExpiresIn:    resp.GetExpiresIn(),
+		UserID:       resp.GetUser().GetId(),
+	})
+}
+
+func (g *Gateway) RefreshToken(c *gin.Context) {
+	var req refreshTokenRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	resp, err := g.userClient.RefreshToken(c.Request.Context(), &userv1.RefreshTokenRequest{
+		RefreshToken: req.RefreshToken,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokenResponse{
+		AccessToken:  resp.GetAccessToken(),
+		RefreshToken: resp.GetRefreshToken(),
+		TokenType:    resp.GetTokenType(),
+		ExpiresIn:    resp.GetExpiresIn(),
+	})
+}
+
+func (g *Gateway) Logout(c *gin.Context) {
+	var req refreshTokenRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	if _, err := g.userClient.Logout(c.Request.Context(), &userv1.LogoutRequest{
+		RefreshToken: req.RefreshToken,
+	}); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type createUserRequest struct {
+	Email     string `json:"email" binding:"required,email"`
+	Password  string `json:"password" binding:"required"`
+	FirstName string `json:"first_name" binding:"max=255"`
+	LastName  string `json:"last_name" binding:"max=255"`
+}
+
+type updateUserRequest struct {
+	Email     string `json:"email" binding:"required,email"`
+	FirstName string `json:"first_name" binding:"max=255"`
+	LastName  string `json:"last_name" binding:"max=255"`
+}
+
 func (g *Gateway) CreateUser(c *gin.Context) {
-	// Implementation
+	var req createUserRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	resp, err := g.userClient.CreateUser(c.Request.Context(), &userv1.CreateUserRequest{
+		Email:     req.Email,
+		Password:  req.Password,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Header("Location", c.Request.URL.Path+resp.GetId())
+	c.JSON(http.StatusCreated, gin.H{"id": resp.GetId()})
 }
 
 func (g *Gateway) GetUser(c *gin.Context) {
-	// Implementation
-}
+	userID := c.Param("id")
+	if !canAccessUser(c, userID) {
+		g.respondError(c, status.Error(codes.NotFound, "user not found"))
+		return
+	}
 
-func (g *Gateway) CreateOrder(c *gin.Context) {
-	// Implementation
+	resp, err := g.userClient.GetUser(c.Request.Context(), &userv1.GetUserRequest{Id: userID})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	setETag(c, resp.GetUser().GetVersion())
+	g.respondProto(c, http.StatusOK, resp.GetUser())
 }
 
-func (g *Gateway) GetOrder(c *gin.Context) {
-	// Implementation
+// UpdateUser replaces the profile fields of a user. Send the ETag from GetUser
+// in If-Match to avoid overwriting a concurrent change.
+func (g *Gateway) UpdateUser(c *gin.Context) {
+	userID := c.Param("id")
+	if !canAccessUser(c, userID) {
+		g.respondError(c, status.Error(codes.NotFound, "user not found"))
+		return
+	}
+
+	var req updateUserRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	version, ok := g.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	resp, err := g.userClient.UpdateUser(c.Request.Context(), &userv1.UpdateUserRequest{
+		Id:              userID,
+		Email:           req.Email,
+		FirstName:       req.FirstName,
+		LastName:        req.LastName,
+		ExpectedVersion: version,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	setETag(c, resp.GetUser().GetVersion())
+	g.respondProto(c, http.StatusOK, resp.GetUser())
 }
@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+const defaultPageSize = 20
+
+// UnitPrice is optional; when set, the order is only placed at that price.
+// It is decoded as json.Number so "12.34" and 12.34 both keep their exact
+// decimal digits.
+type orderItemRequest struct {
+	ProductID string      `json:"product_id" binding:"required,max=36"`
+	Quantity  int32       `json:"quantity" binding:"required,gt=0,lte=100"`
+	UnitPrice json.Number `json:"unit_price"`
+}
+
+type shippingInfoRequest struct {
+	AddressLine1 string `json:"address_line1" binding:"required,max=255"`
+	AddressLine2 string `json:"address_line2" binding:"max=255"`
+	City         string `json:"city" binding:"required,max=255"`
+	State        string `json:"state" binding:"max=255"`
+	Country      string `json:"country" binding:"required,max=255"`
+	PostalCode   string `json:"postal_code" binding:"required,max=32"`
+}
+
+type createOrderRequest struct {
+	Currency      string              `json:"currency" binding:"omitempty,len=3"`
+	Items         []orderItemRequest  `json:"items" binding:"required,min=1,max=100,dive"`
+	ShippingInfo  shippingInfoRequest `json:"shipping_info" binding:"required"`
+	PaymentMethod string              `json:"payment_method" binding:"required"`
+}
+
+type updateOrderStatusRequest struct {
+	Status string `json:"status" binding:"required"`
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+type cancelOrderRequest struct {
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+func (g *Gateway) CreateOrder(c *gin.Context) {
+	var req createOrderRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	method, ok := parseEnum(req.PaymentMethod, "PAYMENT_METHOD_", orderv1.PaymentMethod_value)
+	if !ok {
+		g.respondError(c, status.Error(codes.InvalidArgument, "unknown payment_method"))
+		return
+	}
+
+	items := make([]*orderv1.OrderItem, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = &orderv1.OrderItem{
+			ProductId: item.ProductID,
+			Quantity:  item.Quantity,
+		}
+		if item.UnitPrice == "" {
+			continue
+		}
+
+		if req.Currency == "" {
+			g.respondError(c, status.Error(codes.InvalidArgument, "currency is required with unit_price"))
+			return
+		}
+		price, err := money.Parse(strings.ToUpper(req.Currency), item.UnitPrice.String())
+		if err != nil {
+			g.respondError(c, status.Errorf(codes.InvalidArgument, "items[%d].unit_price: %v", i, err))
+			return
+		}
+		items[i].Price = money.ToProto(price)
+	}
+
+	// Orders are always placed on behalf of the authenticated caller
+	resp, err := g.orderClient.CreateOrder(c.Request.Context(), &orderv1.CreateOrderRequest{
+		UserId: c.GetString(ContextKeySubject),
+		Items:  items,
+		ShippingInfo: &orderv1.ShippingInfo{
+			AddressLine1: req.ShippingInfo.AddressLine1,
+			AddressLine2: req.ShippingInfo.AddressLine2,
+			City:         req.ShippingInfo.City,
+			State:        req.ShippingInfo.State,
+			Country:      req.ShippingInfo.Country,
+			PostalCode:   req.ShippingInfo.PostalCode,
+		},
+		PaymentMethod:  orderv1.PaymentMethod(method),
+		IdempotencyKey: c.GetHeader("Idempotency-Key"),
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	c.Header("Location", c.Request.URL.Path+resp.GetOrder().GetId())
+	g.respondProto(c, http.StatusCreated, resp.GetOrder())
+}
+
+// GetOrder returns the order; ?fields=history also returns its status history
+func (g *Gateway) GetOrder(c *gin.Context) {
+	req := &orderv1.GetOrderRequest{
+		OrderId: c.Param("id"),
+	}
+	if v := c.Query("fields"); v != "" {
+		req.ReadMask = &fieldmaskpb.FieldMask{Paths: strings.Split(v, ",")}
+	}
+
+	resp, err := g.orderClient.GetOrder(c.Request.Context(), req)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	// Do not reveal that orders owned by someone else exist
+	if !canAccessUser(c, resp.GetOrder().GetUserId()) {
+		g.respondError(c, status.Error(codes.NotFound, "order not found"))
+		return
+	}
+
+	setETag(c, resp.GetOrder().GetVersion())
+	if req.ReadMask != nil {
+		g.respondProto(c, http.StatusOK, resp)
+		return
+	}
+	g.respondProto(c, http.StatusOK, resp.GetOrder())
+}
+
+func (g *Gateway) GetOrderHistory(c *gin.Context) {
+	// Ownership is checked by order-service
+	resp, err := g.orderClient.GetOrderHistory(c.Request.Context(), &orderv1.GetOrderHistoryRequest{
+		OrderId: c.Param("id"),
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	g.respondProto(c, http.StatusOK, resp)
+}
+
+func (g *Gateway) ListOrders(c *gin.Context) {
+	req := &orderv1.ListOrdersRequest{
+		UserId:    c.GetString(ContextKeySubject),
+		PageToken: c.Query("page_token"),
+	}
+
+	var err error
+	if req.Filter, req.OrderBy, err = parseOrderFilter(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	if req.SortOrder, err = parseSortOrder(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+	if req.PageSize, err = parsePageSize(c); err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	resp, err := g.orderClient.ListOrders(c.Request.Context(), req)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	g.respondProto(c, http.StatusOK, resp)
+}
+
+// parseSortOrder reads sort=asc|desc, newest first by default
+func parseSortOrder(c *gin.Context) (orderv1.SortOrder, error) {
+	switch c.Query("sort") {
+	case "", "desc":
+		return orderv1.SortOrder_SORT_ORDER_DESC, nil
+	case "asc":
+		return orderv1.SortOrder_SORT_ORDER_ASC, nil
+	default:
+		return 0, status.Error(codes.InvalidArgument, "sort must be asc or desc")
+	}
+}
+
+// parsePageSize reads page_size, defaulting to defaultPageSize
+func parsePageSize(c *gin.Context) (int32, error) {
+	v := c.Query("page_size")
+	if v == "" {
+		return defaultPageSize, nil
+	}
+	pageSize, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || pageSize <= 0 || pageSize > 100 {
+		return 0, status.Error(codes.InvalidArgument, "page_size must be between 1 and 100")
+	}
+	return int32(pageSize), nil
+}
+
+// parseOrderFilter reads the order listing filters from the query string:
+// status (comma separated), created_after, created_before, updated_after and
+// updated_before (RFC 3339), min_total and max_total (decimal amounts in
+// currency), payment_status, payment_method, shipping_country, product_id and
+// order_by (created_at or total_amount)
+func parseOrderFilter(c *gin.Context) (*orderv1.OrderFilter, orderv1.OrderBy, error) {
+	filter := &orderv1.OrderFilter{
+		ShippingCountry: c.Query("shipping_country"),
+		ProductId:       c.Query("product_id"),
+	}
+
+	if v := c.Query("status"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			orderStatus, ok := parseEnum(strings.TrimSpace(name), "ORDER_STATUS_", orderv1.OrderStatus_value)
+			if !ok {
+				return nil, 0, status.Error(codes.InvalidArgument, "unknown status")
+			}
+			filter.Statuses = append(filter.Statuses, orderv1.OrderStatus(orderStatus))
+		}
+	}
+
+	times := []struct {
+		param string
+		dst   **timestamppb.Timestamp
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"updated_after", &filter.UpdatedAfter},
+		{"updated_before", &filter.UpdatedBefore},
+	}
+	for _, t := range times {
+		v := c.Query(t.param)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "%s must be an RFC 3339 time", t.param)
+		}
+		*t.dst = timestamppb.New(parsed)
+	}
+
+	amounts := []struct {
+		param string
+		dst   **moneypb.Money
+	}{
+		{"min_total", &filter.MinTotal},
+		{"max_total", &filter.MaxTotal},
+	}
+	for _, a := range amounts {
+		v := c.Query(a.param)
+		if v == "" {
+			continue
+		}
+		currency := strings.ToUpper(c.Query("currency"))
+		if currency == "" {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "currency is required with %s", a.param)
+		}
+		amount, err := money.Parse(currency, v)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "%s: %v", a.param, err)
+		}
+		*a.dst = money.ToProto(amount)
+	}
+
+	if v := c.Query("payment_status"); v != "" {
+		paymentStatus, ok := parseEnum(v, "PAYMENT_STATUS_", orderv1.PaymentStatus_value)
+		if !ok {
+			return nil, 0, status.Error(codes.InvalidArgument, "unknown payment_status")
+		}
+		filter.PaymentStatus = orderv1.PaymentStatus(paymentStatus)
+	}
+	if v := c.Query("payment_method"); v != "" {
+		method, ok := parseEnum(v, "PAYMENT_METHOD_", orderv1.PaymentMethod_value)
+		if !ok {
+			return nil, 0, status.Error(codes.InvalidArgument, "unknown payment_method")
+		}
+		filter.PaymentMethod = orderv1.PaymentMethod(method)
+	}
+
+	var orderBy orderv1.OrderBy
+	switch c.Query("order_by") {
+	case "", "created_at":
+		orderBy = orderv1.OrderBy_ORDER_BY_CREATED_AT
+	case "total_amount":
+		orderBy = orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT
+	default:
+		return nil, 0, status.Error(codes.InvalidArgument, "order_by must be created_at or total_amount")
+	}
+
+	return filter, orderBy, nil
+}
+
+func (g *Gateway) UpdateOrderStatus(c *gin.Context) {
+	var req updateOrderStatusRequest
+	if !g.bindJSON(c, &req) {
+		return
+	}
+
+	orderStatus, ok := parseEnum(req.Status, "ORDER_STATUS_", orderv1.OrderStatus_value)
+	if !ok {
+		g.respondError(c, status.Error(codes.InvalidArgument, "unknown status"))
+		return
+	}
+
+	// Status changes are an operator action
+	if !hasRole(c, RoleAdmin) {
+		g.respondError(c, status.Error(codes.PermissionDenied, "not allowed to update order status"))
+		return
+	}
+
+	version, ok := g.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	resp, err := g.orderClient.UpdateOrderStatus(c.Request.Context(), &orderv1.UpdateOrderStatusRequest{
+		OrderId:         c.Param("id"),
+		Status:          orderv1.OrderStatus(orderStatus),
+		Reason:          req.Reason,
+		ExpectedVersion: version,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	setETag(c, resp.GetOrder().GetVersion())
+	g.respondProto(c, http.StatusOK, resp.GetOrder())
+}
+
+func (g *Gateway) CancelOrder(c *gin.Context) {
+	var req cancelOrderRequest
+	if c.Request.ContentLength != 0 && !g.bindJSON(c, &req) {
+		return
+	}
+
+	version, ok := g.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+
+	// Ownership is checked by order-service
+	resp, err := g.orderClient.CancelOrder(c.Request.Context(), &orderv1.CancelOrderRequest{
+		OrderId:         c.Param("id"),
+		Reason:          req.Reason,
+		ExpectedVersion: version,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	setETag(c, resp.GetOrder().GetVersion())
+	g.respondProto(c, http.StatusOK, resp.GetOrder())
+}
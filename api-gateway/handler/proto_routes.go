@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+// defaultForwardHeaders are copied from the HTTP request into gRPC metadata
+// when Config.ForwardHeaders is empty
+var defaultForwardHeaders = []string{
+	"X-Request-Id",
+	"X-Correlation-Id",
+	"Accept-Language",
+}
+
+// newProtoMux builds a grpc-gateway mux serving the google.api.http bindings
+// declared in order.proto and user.proto
+func (g *Gateway) newProtoMux(ctx context.Context) (*runtime.ServeMux, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions: protoMarshaler,
+			UnmarshalOptions: protojson.UnmarshalOptions{
+				DiscardUnknown: true,
+			},
+		}),
+		runtime.WithIncomingHeaderMatcher(g.headerMatcher()),
+		runtime.WithMetadata(callerMetadata),
+		runtime.WithErrorHandler(protoErrorHandler),
+	)
+
+	if err := orderv1.RegisterOrderServiceHandler(ctx, mux, g.orderConn); err != nil {
+		return nil, err
+	}
+	if err := userv1.RegisterUserServiceHandler(ctx, mux, g.userConn); err != nil {
+		return nil, err
+	}
+
+	return mux, nil
+}
+
+// headerMatcher forwards only the configured headers. Identity headers are
+// never taken from the client; they are set from the verified token instead.
+func (g *Gateway) headerMatcher() runtime.HeaderMatcherFunc {
+	headers := g.config.ForwardHeaders
+	if len(headers) == 0 {
+		headers = defaultForwardHeaders
+	}
+
+	allowed := make(map[string]bool, len(headers))
+	for _, h := range headers {
+		allowed[textproto.CanonicalMIMEHeaderKey(h)] = true
+	}
+	delete(allowed, textproto.CanonicalMIMEHeaderKey(MetadataUserID))
+	delete(allowed, textproto.CanonicalMIMEHeaderKey(MetadataUserRoles))
+
+	return func(key string) (string, bool) {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		if allowed[key] {
+			return key, true
+		}
+		return "", false
+	}
+}
+
+// callerMetadata carries the identity attached by authMiddleware over to the
+// context grpc-gateway builds for the backend call
+func callerMetadata(_ context.Context, r *http.Request) metadata.MD {
+	md, _ := metadata.FromOutgoingContext(r.Context())
+	return md
+}
+
+// protoErrorHandler renders errors with the same envelope as the gin routes
+func protoErrorHandler(_ context.Context, _ *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+
+	body, merr := marshaler.Marshal(errorResponse{
+		Error: errorBody{
+			Code:    st.Code().String(),
+			Message: st.Message(),
+			Details: errorDetails(st),
+		},
+	})
+	if merr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st, r))
+	w.Write(body)
+}
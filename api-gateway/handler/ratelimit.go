@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// RateLimitConfig configures token buckets per client. Routes overrides the
+// default rule for a route group such as "users" or "orders". IP limits every
+// request per client address before its bearer token is checked, so that
+// token guessing is throttled too; it should leave room for several users
+// behind one address.
+type RateLimitConfig struct {
+	Rate        float64
+	Burst       int
+	IdleTimeout time.Duration            `mapstructure:"idle_timeout"`
+	Routes      map[string]RateLimitRule `mapstructure:"routes"`
+	IP          RateLimitRule            `mapstructure:"ip"`
+}
+
+// RateLimitRule is a token bucket refilled at Rate tokens per second
+type RateLimitRule struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitResult describes the bucket state after a request was counted
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request would be allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the buckets. The in-memory store is per replica; a
+// shared implementation can be plugged in with Gateway.UseRateLimitStore when
+// the gateway runs with several replicas.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error)
+}
+
+func (c *RateLimitConfig) ruleFor(group string) RateLimitRule {
+	if rule, ok := c.Routes[group]; ok {
+		return rule
+	}
+	return RateLimitRule{Rate: c.Rate, Burst: c.Burst}
+}
+
+// rateLimitKey identifies the client by the subject of its verified token, or
+// by its IP on public endpoints. Unverified headers, such as an API key the
+// gateway has no way to check, are never used, since a client could change
+// them on every request to get a fresh bucket. The IP comes from
+// X-Forwarded-For only when the request came through Config.TrustedProxies.
+func rateLimitKey(c *gin.Context) string {
+	if subject := c.GetString(ContextKeySubject); subject != "" {
+		return "sub:" + subject
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// routeGroup maps a request path to the rate limit group it belongs to
+func routeGroup(path string) string {
+	path = strings.TrimPrefix(path, "/api")
+	for _, group := range []string{"users", "orders"} {
+		prefix := "/v1/" + group
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return group
+		}
+	}
+	return "default"
+}
+
+// ipRateLimitMiddleware runs before authMiddleware and limits every request
+// by client IP
+func (g *Gateway) ipRateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g.takeToken(c, "ip|ip:"+c.ClientIP(), g.config.RateLimit.IP) {
+			c.Next()
+		}
+	}
+}
+
+// rateLimitMiddleware runs after authMiddleware and limits requests per
+// client and route group
+func (g *Gateway) rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group := routeGroup(c.Request.URL.Path)
+		if g.takeToken(c, group+"|"+rateLimitKey(c), g.config.RateLimit.ruleFor(group)) {
+			c.Next()
+		}
+	}
+}
+
+// takeToken counts the request against the bucket key and sets the rate
+// limit headers. It aborts the request with 429 and returns false when the
+// bucket is empty.
+func (g *Gateway) takeToken(c *gin.Context, key string, rule RateLimitRule) bool {
+	if rule.Rate <= 0 || rule.Burst <= 0 {
+		return true
+	}
+
+	result, err := g.rateStore.Take(c.Request.Context(), key, rule)
+	if err != nil {
+		// Fail open rather than turning a store outage into a gateway outage
+		g.logger.Error("Rate limit store failed", zap.Error(err))
+		return true
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, errorResponse{
+			Error: errorBody{
+				Code:    "ResourceExhausted",
+				Message: "rate limit exceeded",
+			},
+		})
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitStore is a process local RateLimitStore
+type MemoryRateLimitStore struct {
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+func NewMemoryRateLimitStore(idleTimeout time.Duration) *MemoryRateLimitStore {
+	if idleTimeout <= 0 {
+		idleTimeout = 10 * time.Minute
+	}
+	return &MemoryRateLimitStore{
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+		buckets:     make(map[string]*tokenBucket),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	burst := float64(rule.Burst)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, lastSeen: now}
+		s.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.tokens = math.Min(burst, b.tokens+elapsed*rule.Rate)
+	b.lastSeen = now
+
+	result := RateLimitResult{Limit: rule.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rule.Rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((burst - b.tokens) / rule.Rate)
+	return result, nil
+}
+
+// Len returns the number of tracked buckets
+func (s *MemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// Evict drops buckets that have not been used for the idle timeout. As long
+// as the timeout exceeds the refill time an evicted bucket was already full.
+func (s *MemoryRateLimitStore) Evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.now().Add(-s.idleTimeout)
+	for key, b := range s.buckets {
+		if b.lastSeen.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// Watch evicts idle buckets until ctx is cancelled
+func (s *MemoryRateLimitStore) Watch(ctx context.Context) {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Evict()
+		}
+	}
+}
+
+// SetClock replaces the time source, for tests
+func (s *MemoryRateLimitStore) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// watchHeartbeat keeps idle event streams open through proxies and notices
+// clients that went away
+const watchHeartbeat = 15 * time.Second
+
+// WatchOrder streams the order as server-sent events: an "order" event with
+// the order as JSON whenever it changes, with the order version as the event
+// id. Browsers reconnect with Last-Event-ID and resume after that version;
+// other clients may pass ?since_version.
+func (g *Gateway) WatchOrder(c *gin.Context) {
+	since, ok := g.watchSinceVersion(c)
+	if !ok {
+		return
+	}
+
+	// Stop the backend stream as soon as the client goes away
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// Ownership is checked by order-service
+	stream, err := g.orderClient.WatchOrder(ctx, &orderv1.WatchOrderRequest{
+		OrderId:      c.Param("id"),
+		SinceVersion: since,
+	})
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	// order-service sends headers once the caller may watch the order, so a
+	// missing order still gets an ordinary error response
+	md, err := stream.Header()
+	if err == nil && md == nil {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	// The server write timeout is meant for ordinary requests
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		g.logger.Debug("Event stream keeps the server write timeout", zap.Error(err))
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	orders := make(chan *orderv1.Order)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				done <- err
+				return
+			}
+			select {
+			case orders <- resp.GetOrder():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case order := <-orders:
+			data, err := protoMarshaler.Marshal(order)
+			if err != nil {
+				g.writeEventError(c, status.Error(codes.Internal, "failed to encode order"))
+				return
+			}
+			fmt.Fprintf(c.Writer, "id: %d\nevent: order\ndata: %s\n\n", order.GetVersion(), data)
+			c.Writer.Flush()
+		case err := <-done:
+			if err != io.EOF && ctx.Err() == nil {
+				g.writeEventError(c, err)
+			}
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": keepalive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// watchSinceVersion returns the version to resume after, responding with 400
+// and returning false if it is not a version
+func (g *Gateway) watchSinceVersion(c *gin.Context) (int64, bool) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("since_version")
+	}
+	if value == "" {
+		return 0, true
+	}
+
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 0 {
+		g.respondError(c, status.Error(codes.InvalidArgument, "since_version must be an order version"))
+		return 0, false
+	}
+	return version, true
+}
+
+// writeEventError ends an event stream with an "error" event carrying the
+// usual error envelope
+func (g *Gateway) writeEventError(c *gin.Context, err error) {
+	st := status.Convert(err)
+	if st.Code() != codes.Unavailable {
+		g.logger.Error("Order watch failed", zap.String("path", c.Request.URL.Path), zap.Error(err))
+	}
+
+	data, merr := json.Marshal(errorResponse{
+		Error: errorBody{
+			Code:    st.Code().String(),
+			Message: st.Message(),
+			Details: errorDetails(st),
+		},
+	})
+	if merr != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", data)
+	c.Writer.Flush()
+}
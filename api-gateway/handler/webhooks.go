@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// WebhookSignatureHeader carries the provider signature of a webhook, as
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of '<t>.<body>'>". Several v1 values
+// may be sent while the provider rotates its secret.
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+const (
+	defaultWebhookTolerance = 5 * time.Minute
+	maxWebhookBodyBytes     = 64 << 10
+)
+
+var (
+	ErrMissingSignature = errors.New("missing webhook signature")
+	ErrStaleSignature   = errors.New("webhook timestamp outside tolerance")
+	ErrBadSignature     = errors.New("webhook signature mismatch")
+)
+
+// WebhookConfig holds the secrets payment provider webhooks are signed with
+type WebhookConfig struct {
+	// Secrets are all accepted, so a new one can be added before the
+	// provider switches to it
+	Secrets []string
+	// Tolerance is how far the signed timestamp may be from now, which limits
+	// replaying a captured request
+	Tolerance time.Duration
+}
+
+// WebhookVerifier checks webhook signatures against the configured secrets
+type WebhookVerifier struct {
+	secrets   [][]byte
+	tolerance time.Duration
+}
+
+func NewWebhookVerifier(config *WebhookConfig) (*WebhookVerifier, error) {
+	v := &WebhookVerifier{tolerance: config.Tolerance}
+	if v.tolerance <= 0 {
+		v.tolerance = defaultWebhookTolerance
+	}
+
+	for i, secret := range config.Secrets {
+		if len(secret) < MinHMACSecretLength {
+			return nil, fmt.Errorf("webhooks.secrets[%d] must be at least %d bytes", i, MinHMACSecretLength)
+		}
+		v.secrets = append(v.secrets, []byte(secret))
+	}
+	return v, nil
+}
+
+// SignWebhook returns the signature header value for body at time t
+func SignWebhook(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + webhookMAC([]byte(secret), timestamp, body)
+}
+
+func webhookMAC(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that header signs body with one of the secrets at a time
+// within the tolerance of now
+func (v *WebhookVerifier) Verify(header string, body []byte, now time.Time) error {
+	var (
+		timestamp  string
+		signatures []string
+	)
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 || len(v.secrets) == 0 {
+		return ErrMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMissingSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > v.tolerance || age < -v.tolerance {
+		return ErrStaleSignature
+	}
+
+	for _, secret := range v.secrets {
+		expected := webhookMAC(secret, timestamp, body)
+		for _, signature := range signatures {
+			if hmac.Equal([]byte(expected), []byte(signature)) {
+				return nil
+			}
+		}
+	}
+	return ErrBadSignature
+}
+
+// paymentWebhookEvent is the body of a payment provider webhook
+type paymentWebhookEvent struct {
+	ID                string    `json:"id"`
+	Type              string    `json:"type"`
+	OrderID           string    `json:"order_id"`
+	ProviderReference string    `json:"provider_reference"`
+	OccurredAt        time.Time `json:"occurred_at"`
+	Reason            string    `json:"reason"`
+}
+
+// PaymentWebhook forwards a signed payment result to order-service, which
+// ignores events it has seen before. Providers retry on any non-2xx answer.
+func (g *Gateway) PaymentWebhook(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		g.respondError(c, status.Error(codes.InvalidArgument, "failed to read webhook body"))
+		return
+	}
+
+	// The signature covers the raw body, so it is checked before parsing
+	if err := g.webhooks.Verify(c.GetHeader(WebhookSignatureHeader), body, time.Now()); err != nil {
+		g.logger.Warn("Rejected payment webhook", zap.Error(err))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse{
+			Error: errorBody{
+				Code:    codes.Unauthenticated.String(),
+				Message: "invalid webhook signature",
+			},
+		})
+		return
+	}
+
+	var event paymentWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		g.respondError(c, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	eventType, ok := parseEnum(event.Type, "PAYMENT_EVENT_TYPE_", orderv1.PaymentEventType_value)
+	if !ok {
+		g.respondError(c, status.Error(codes.InvalidArgument, "unknown event type"))
+		return
+	}
+
+	req := &orderv1.ApplyPaymentEventRequest{
+		EventId:           event.ID,
+		Type:              orderv1.PaymentEventType(eventType),
+		OrderId:           event.OrderID,
+		ProviderReference: event.ProviderReference,
+		Reason:            event.Reason,
+	}
+	if !event.OccurredAt.IsZero() {
+		req.OccurredAt = timestamppb.New(event.OccurredAt)
+	}
+
+	resp, err := g.orderClient.ApplyPaymentEvent(c.Request.Context(), req)
+	if err != nil {
+		g.respondError(c, err)
+		return
+	}
+
+	g.respondProto(c, http.StatusOK, resp)
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// adminOrderService answers AdminListOrders and exports two batches of
+// orders, recording the requests it receives
+type adminOrderService struct {
+	orderv1.UnimplementedOrderServiceServer
+	lists   chan *orderv1.AdminListOrdersRequest
+	exports chan *orderv1.ExportOrdersRequest
+}
+
+func newAdminOrderService() *adminOrderService {
+	return &adminOrderService{
+		lists:   make(chan *orderv1.AdminListOrdersRequest, 1),
+		exports: make(chan *orderv1.ExportOrdersRequest, 1),
+	}
+}
+
+func (s *adminOrderService) AdminListOrders(ctx context.Context, req *orderv1.AdminListOrdersRequest) (*orderv1.ListOrdersResponse, error) {
+	s.lists <- req
+	return &orderv1.ListOrdersResponse{}, nil
+}
+
+func (s *adminOrderService) ExportOrders(req *orderv1.ExportOrdersRequest, stream orderv1.OrderService_ExportOrdersServer) error {
+	s.exports <- req
+	if req.Filter.GetProductId() == "none" {
+		return status.Error(codes.InvalidArgument, "no such filter")
+	}
+
+	for _, batch := range [][]string{{"o-1", "o-2"}, {"o-3"}} {
+		resp := &orderv1.ExportOrdersResponse{}
+		for _, id := range batch {
+			resp.Orders = append(resp.Orders, &orderv1.Order{
+				Id:      id,
+				UserId:  "user-1",
+				Status:  orderv1.OrderStatus_ORDER_STATUS_PENDING,
+				Total:   &money.Money{CurrencyCode: "USD", Units: 19, Nanos: 990_000_000},
+				Version: 1,
+			})
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAdminRouter(t *testing.T, backend *adminOrderService) http.Handler {
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	return newTestRouter(t, cfg)
+}
+
+func TestAdminListOrders(t *testing.T) {
+	backend := newAdminOrderService()
+	router := newAdminRouter(t, backend)
+
+	rec := serve(router, http.MethodGet, "/api/v1/admin/orders?user_id=user-2&status=pending&page_size=5&sort=asc", "", map[string]string{
+		"Authorization": bearer(t, "admin-1", "admin"),
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	req := <-backend.lists
+	require.Equal(t, "user-2", req.UserId)
+	require.Equal(t, int32(5), req.PageSize)
+	require.Equal(t, orderv1.SortOrder_SORT_ORDER_ASC, req.SortOrder)
+	require.Equal(t, []orderv1.OrderStatus{orderv1.OrderStatus_ORDER_STATUS_PENDING}, req.Filter.Statuses)
+}
+
+func TestAdminOrdersRequireAdmin(t *testing.T) {
+	backend := newAdminOrderService()
+	router := newAdminRouter(t, backend)
+	auth := map[string]string{"Authorization": bearer(t, "user-1")}
+
+	for _, path := range []string{"/api/v1/admin/orders", "/api/v1/admin/orders/export"} {
+		rec := serve(router, http.MethodGet, path, "", auth)
+		require.Equal(t, http.StatusForbidden, rec.Code, path)
+	}
+	require.Empty(t, backend.lists)
+	require.Empty(t, backend.exports)
+}
+
+func TestExportOrdersCSV(t *testing.T) {
+	backend := newAdminOrderService()
+	router := newAdminRouter(t, backend)
+
+	rec := serve(router, http.MethodGet, "/api/v1/admin/orders/export?status=pending&order_by=total_amount", "", map[string]string{
+		"Authorization": bearer(t, "admin-1", "admin"),
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	req := <-backend.exports
+	require.Equal(t, orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT, req.OrderBy)
+	require.Equal(t, []orderv1.OrderStatus{orderv1.OrderStatus_ORDER_STATUS_PENDING}, req.Filter.Statuses)
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, "id", records[0][0])
+	require.Equal(t, []string{"o-1", "user-1", "ORDER_STATUS_PENDING", "USD", "19.99"}, records[1][:5])
+	require.Equal(t, "o-3", records[3][0])
+}
+
+func TestExportOrdersNDJSON(t *testing.T) {
+	backend := newAdminOrderService()
+	router := newAdminRouter(t, backend)
+
+	rec := serve(router, http.MethodGet, "/api/v1/admin/orders/export?format=ndjson", "", map[string]string{
+		"Authorization": bearer(t, "admin-1", "admin"),
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	var order map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &order))
+	require.Equal(t, "o-3", order["id"])
+	require.Equal(t, "ORDER_STATUS_PENDING", order["status"])
+}
+
+func TestExportOrdersErrors(t *testing.T) {
+	backend := newAdminOrderService()
+	router := newAdminRouter(t, backend)
+	auth := map[string]string{"Authorization": bearer(t, "admin-1", "admin")}
+
+	rec := serve(router, http.MethodGet, "/api/v1/admin/orders/export?format=xml", "", auth)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Empty(t, backend.exports)
+
+	// An error before the first batch is an ordinary error response
+	rec = serve(router, http.MethodGet, "/api/v1/admin/orders/export?product_id=none", "", auth)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "no such filter")
+}
@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zabilal/microservices/api-gateway/handler"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func signHS256(t *testing.T, secret string, claims *handler.Claims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString([]byte(secret))
+	require.NoError(t, err)
+	return signed
+}
+
+func validClaims() *handler.Claims {
+	now := time.Now()
+	return &handler.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "user-1",
+			Issuer:    "user-service",
+			Audience:  jwt.ClaimStrings{"microservices"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+		Roles: []string{"customer"},
+	}
+}
+
+func TestVerifyHS256(t *testing.T) {
+	verifier, err := handler.NewTokenVerifier(&handler.AuthConfig{
+		Issuer:     "user-service",
+		Audience:   "microservices",
+		HMACSecret: testSecret,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		mutate      func(c *handler.Claims)
+		secret      string
+		expectError bool
+	}{
+		{
+			name:   "valid token",
+			mutate: func(c *handler.Claims) {},
+			secret: testSecret,
+		},
+		{
+			name:        "wrong secret",
+			mutate:      func(c *handler.Claims) {},
+			secret:      "other",
+			expectError: true,
+		},
+		{
+			name: "expired",
+			mutate: func(c *handler.Claims) {
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			},
+			secret:      testSecret,
+			expectError: true,
+		},
+		{
+			name: "missing expiry",
+			mutate: func(c *handler.Claims) {
+				c.ExpiresAt = nil
+			},
+			secret:      testSecret,
+			expectError: true,
+		},
+		{
+			name: "not yet valid",
+			mutate: func(c *handler.Claims) {
+				c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+			},
+			secret:      testSecret,
+			expectError: true,
+		},
+		{
+			name: "wrong issuer",
+			mutate: func(c *handler.Claims) {
+				c.Issuer = "someone-else"
+			},
+			secret:      testSecret,
+			expectError: true,
+		},
+		{
+			name: "wrong audience",
+			mutate: func(c *handler.Claims) {
+				c.Audience = jwt.ClaimStrings{"other"}
+			},
+			secret:      testSecret,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.mutate(claims)
+
+			got, err := verifier.Verify(signHS256(t, tt.secret, claims))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "user-1", got.Subject)
+			require.Equal(t, []string{"customer"}, got.Roles)
+		})
+	}
+}
+
+func TestRejectShortHMACSecret(t *testing.T) {
+	for _, secret := range []string{"change-me", testSecret[:handler.MinHMACSecretLength-1]} {
+		_, err := handler.NewTokenVerifier(&handler.AuthConfig{
+			Issuer:     "user-service",
+			Audience:   "microservices",
+			HMACSecret: secret,
+		})
+		require.Error(t, err, secret)
+	}
+}
+
+func TestVerifyRS256FromJWKS(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile, map[string]*rsa.PublicKey{"old": &oldKey.PublicKey})
+
+	now := time.Now()
+	verifier, err := handler.NewTokenVerifier(&handler.AuthConfig{
+		Issuer:        "user-service",
+		Audience:      "microservices",
+		JWKSFile:      jwksFile,
+		JWKSMinReload: 5 * time.Second,
+		// Covers the tokens signed with the real clock
+		Leeway: time.Minute,
+		Now:    func() time.Time { return now },
+	})
+	require.NoError(t, err)
+
+	sign := func(kid string, key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	_, err = verifier.Verify(sign("old", oldKey))
+	require.NoError(t, err)
+
+	_, err = verifier.Verify(sign("new", newKey))
+	require.ErrorIs(t, err, handler.ErrUnknownKey)
+
+	// Rotate the key set on disk
+	writeJWKS(t, jwksFile, map[string]*rsa.PublicKey{
+		"old": &oldKey.PublicKey,
+		"new": &newKey.PublicKey,
+	})
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(jwksFile, future, future))
+
+	// Unknown kids reload the file at most once per JWKSMinReload
+	_, err = verifier.Verify(sign("new", newKey))
+	require.ErrorIs(t, err, handler.ErrUnknownKey)
+
+	now = now.Add(5 * time.Second)
+	_, err = verifier.Verify(sign("new", newKey))
+	require.NoError(t, err)
+
+	// A token signed by the wrong key for its kid must be rejected
+	_, err = verifier.Verify(sign("old", newKey))
+	require.Error(t, err)
+}
+
+func writeJWKS(t *testing.T, path string, keys map[string]*rsa.PublicKey) {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   encode(key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/servicetoken"
+)
+
+// staleOrderService rejects every cancellation as a version conflict and
+// records the version it was asked for
+type staleOrderService struct {
+	orderv1.UnimplementedOrderServiceServer
+	versions chan int64
+}
+
+func (s *staleOrderService) CancelOrder(ctx context.Context, req *orderv1.CancelOrderRequest) (*orderv1.CancelOrderResponse, error) {
+	s.versions <- req.ExpectedVersion
+	return nil, status.Error(codes.Aborted, "order was modified, reload it and retry")
+}
+
+const testServiceToken = "00112233445566778899aabbccddeeff"
+
+// startOrderService serves srv on a loopback port and returns its address
+func startOrderService(t *testing.T, srv orderv1.OrderServiceServer) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Rejects calls without the service token, like the real order-service
+	token, err := servicetoken.New(testServiceToken)
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(token.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(token.StreamServerInterceptor()),
+	)
+	orderv1.RegisterOrderServiceServer(server, srv)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func TestVersionConflictStatus(t *testing.T) {
+	backend := &staleOrderService{versions: make(chan int64, 1)}
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	router := newTestRouter(t, cfg)
+	auth := bearer(t, "user-1")
+
+	tests := []struct {
+		name    string
+		path    string
+		ifMatch string
+		body    string
+		want    int
+		version int64
+	}{
+		{"rest conditional", "/api/v1/orders/o1/cancel", `"3"`, `{}`, http.StatusPreconditionFailed, 3},
+		{"rest unconditional", "/api/v1/orders/o1/cancel", "", `{}`, http.StatusConflict, 0},
+		{"proto conditional", "/v1/orders/o1/cancel", `"3"`, `{"expected_version": "3"}`, http.StatusPreconditionFailed, 3},
+		{"proto unconditional", "/v1/orders/o1/cancel", "", `{"expected_version": "3"}`, http.StatusConflict, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{"Authorization": auth}
+			if tt.ifMatch != "" {
+				headers["If-Match"] = tt.ifMatch
+			}
+
+			rec := serve(router, http.MethodPost, tt.path, tt.body, headers)
+			require.Equal(t, tt.want, rec.Code, rec.Body.String())
+			require.Contains(t, rec.Body.String(), "Aborted")
+			require.Equal(t, tt.version, <-backend.versions)
+		})
+	}
+}
+
+func TestMalformedIfMatch(t *testing.T) {
+	router := newTestRouter(t, testConfig())
+
+	for _, header := range []string{`W/"3"`, `"abc"`, `"0"`, `3`} {
+		rec := serve(router, http.MethodPost, "/api/v1/orders/o1/cancel", `{}`, map[string]string{
+			"Authorization": bearer(t, "user-1"),
+			"If-Match":      header,
+		})
+		require.Equal(t, http.StatusPreconditionFailed, rec.Code, header)
+	}
+}
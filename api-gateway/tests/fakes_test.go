@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zabilal/microservices/api-gateway/handler"
+	"github.com/zabilal/microservices/monitoring/logger"
+)
+
+// unreachableBackend refuses connections, so every backend call fails with
+// Unavailable
+const unreachableBackend = "127.0.0.1:1"
+
+func testConfig() *handler.Config {
+	cfg := &handler.Config{}
+	cfg.Auth = handler.AuthConfig{
+		Issuer:     "user-service",
+		Audience:   "microservices",
+		HMACSecret: testSecret,
+	}
+	cfg.Webhooks.Secrets = []string{testWebhookSecret}
+	cfg.ServiceToken = testServiceToken
+	cfg.Services.UserService.Endpoint = unreachableBackend
+	cfg.Services.OrderService.Endpoint = unreachableBackend
+	return cfg
+}
+
+// newTestRouter serves the gateway routes for cfg in process
+func newTestRouter(t *testing.T, cfg *handler.Config) http.Handler {
+	gin.SetMode(gin.TestMode)
+
+	gateway, err := handler.NewGateway(cfg, logger.NewLogger("error"))
+	require.NoError(t, err)
+	t.Cleanup(func() { gateway.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	router, err := gateway.Handler(ctx)
+	require.NoError(t, err)
+	return router
+}
+
+// bearer returns an Authorization header value for subject with roles
+func bearer(t *testing.T, subject string, roles ...string) string {
+	claims := validClaims()
+	claims.Subject = subject
+	claims.Roles = roles
+	return "Bearer " + signHS256(t, testSecret, claims)
+}
+
+func serve(router http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "203.0.113.7:1234"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// listOrderService records the ListOrders requests it receives
+type listOrderService struct {
+	orderv1.UnimplementedOrderServiceServer
+	requests chan *orderv1.ListOrdersRequest
+}
+
+func (s *listOrderService) ListOrders(ctx context.Context, req *orderv1.ListOrdersRequest) (*orderv1.ListOrdersResponse, error) {
+	s.requests <- req
+	return &orderv1.ListOrdersResponse{}, nil
+}
+
+func TestListOrdersFilters(t *testing.T) {
+	backend := &listOrderService{requests: make(chan *orderv1.ListOrdersRequest, 1)}
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	router := newTestRouter(t, cfg)
+
+	query := "status=pending,processing&created_after=2026-01-01T00:00:00Z&min_total=10&max_total=99.50&currency=usd" +
+		"&payment_status=authorized&payment_method=credit_card&shipping_country=US&product_id=p1&order_by=total_amount&sort=asc"
+	rec := serve(router, http.MethodGet, "/api/v1/orders/?"+query, "", map[string]string{
+		"Authorization": bearer(t, "user-1"),
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	req := <-backend.requests
+	require.Equal(t, "user-1", req.UserId)
+	require.Equal(t, orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT, req.OrderBy)
+	require.Equal(t, orderv1.SortOrder_SORT_ORDER_ASC, req.SortOrder)
+
+	filter := req.Filter
+	require.Equal(t, []orderv1.OrderStatus{
+		orderv1.OrderStatus_ORDER_STATUS_PENDING,
+		orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+	}, filter.Statuses)
+	require.Equal(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), filter.CreatedAfter.AsTime())
+	require.Nil(t, filter.CreatedBefore)
+	require.Equal(t, "USD", filter.MinTotal.CurrencyCode)
+	require.Equal(t, int64(10), filter.MinTotal.Units)
+	require.Equal(t, int64(99), filter.MaxTotal.Units)
+	require.Equal(t, int32(500_000_000), filter.MaxTotal.Nanos)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, filter.PaymentStatus)
+	require.Equal(t, orderv1.PaymentMethod_PAYMENT_METHOD_CREDIT_CARD, filter.PaymentMethod)
+	require.Equal(t, "US", filter.ShippingCountry)
+	require.Equal(t, "p1", filter.ProductId)
+}
+
+func TestListOrdersInvalidFilters(t *testing.T) {
+	backend := &listOrderService{requests: make(chan *orderv1.ListOrdersRequest, 1)}
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	router := newTestRouter(t, cfg)
+	auth := map[string]string{"Authorization": bearer(t, "user-1")}
+
+	for _, query := range []string{
+		"status=pending,shipped",
+		"created_before=yesterday",
+		"min_total=10",
+		"max_total=1.005&currency=USD",
+		"payment_method=cash",
+		"order_by=user_id",
+	} {
+		rec := serve(router, http.MethodGet, "/api/v1/orders/?"+query, "", auth)
+		require.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+	require.Empty(t, backend.requests)
+}
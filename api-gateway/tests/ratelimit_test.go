@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zabilal/microservices/api-gateway/handler"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	store := handler.NewMemoryRateLimitStore(time.Minute)
+	store.SetClock(func() time.Time { return now })
+
+	rule := handler.RateLimitRule{Rate: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		result, err := store.Take(ctx, "sub:alice", rule)
+		require.NoError(t, err)
+		require.True(t, result.Allowed)
+		require.Equal(t, 2, result.Limit)
+		require.Equal(t, 1-i, result.Remaining)
+	}
+
+	result, err := store.Take(ctx, "sub:alice", rule)
+	require.NoError(t, err)
+	require.False(t, result.Allowed)
+	require.Equal(t, time.Second, result.RetryAfter)
+	require.Equal(t, 2*time.Second, result.Reset)
+
+	// Other clients have their own bucket
+	result, err = store.Take(ctx, "sub:bob", rule)
+	require.NoError(t, err)
+	require.True(t, result.Allowed)
+
+	// Tokens refill over time
+	now = now.Add(time.Second)
+	result, err = store.Take(ctx, "sub:alice", rule)
+	require.NoError(t, err)
+	require.True(t, result.Allowed)
+}
+
+func TestMemoryRateLimitStoreEvictsIdleBuckets(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	store := handler.NewMemoryRateLimitStore(time.Minute)
+	store.SetClock(func() time.Time { return now })
+
+	rule := handler.RateLimitRule{Rate: 1, Burst: 1}
+	_, err := store.Take(ctx, "ip:10.0.0.1", rule)
+	require.NoError(t, err)
+
+	now = now.Add(30 * time.Second)
+	_, err = store.Take(ctx, "ip:10.0.0.2", rule)
+	require.NoError(t, err)
+
+	now = now.Add(45 * time.Second)
+	store.Evict()
+	require.Equal(t, 1, store.Len())
+}
+
+func TestRateLimitIgnoresUnverifiedKeys(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit = handler.RateLimitConfig{Rate: 0.001, Burst: 2}
+	router := newTestRouter(t, cfg)
+
+	login := func(apiKey string) int {
+		return serve(router, http.MethodPost, "/api/v1/users/login",
+			`{"email":"ada@example.com","password":"secret"}`,
+			map[string]string{"X-API-Key": apiKey},
+		).Code
+	}
+
+	require.NotEqual(t, http.StatusTooManyRequests, login("key-1"))
+	require.NotEqual(t, http.StatusTooManyRequests, login("key-2"))
+	// A fresh API key does not buy a fresh bucket
+	require.Equal(t, http.StatusTooManyRequests, login("key-3"))
+
+	// Authenticated callers are limited per subject instead of per IP
+	rec := serve(router, http.MethodGet, "/api/v1/users/user-1", "", map[string]string{
+		"Authorization": bearer(t, "user-1"),
+	})
+	require.NotEqual(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	login := func(router http.Handler, forwardedFor string) int {
+		return serve(router, http.MethodPost, "/api/v1/users/login",
+			`{"email":"ada@example.com","password":"secret"}`,
+			map[string]string{"X-Forwarded-For": forwardedFor},
+		).Code
+	}
+
+	cfg := testConfig()
+	cfg.RateLimit = handler.RateLimitConfig{Rate: 0.001, Burst: 2}
+	router := newTestRouter(t, cfg)
+
+	require.NotEqual(t, http.StatusTooManyRequests, login(router, "198.51.100.1"))
+	require.NotEqual(t, http.StatusTooManyRequests, login(router, "198.51.100.2"))
+	// A made up client address does not buy a fresh bucket
+	require.Equal(t, http.StatusTooManyRequests, login(router, "198.51.100.3"))
+
+	// Behind a trusted load balancer the forwarded address is the client
+	cfg.TrustedProxies = []string{"203.0.113.7/32"}
+	router = newTestRouter(t, cfg)
+	for i := 1; i <= 3; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, login(router, fmt.Sprintf("198.51.100.%d", i)))
+	}
+}
+
+func TestTokenGuessingIsRateLimited(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit = handler.RateLimitConfig{IP: handler.RateLimitRule{Rate: 0.001, Burst: 2}}
+	router := newTestRouter(t, cfg)
+
+	guess := func(token string) int {
+		return serve(router, http.MethodGet, "/api/v1/orders/", "", map[string]string{
+			"Authorization": "Bearer " + token,
+		}).Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, guess("guess-1"))
+	require.Equal(t, http.StatusUnauthorized, guess("guess-2"))
+	// Limited before the token is checked, so a right guess gets nowhere
+	require.Equal(t, http.StatusTooManyRequests, guess("guess-3"))
+	require.Equal(t, http.StatusTooManyRequests, serve(router, http.MethodGet, "/api/v1/orders/", "", map[string]string{
+		"Authorization": bearer(t, "user-1"),
+	}).Code)
+}
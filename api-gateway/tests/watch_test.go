@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// watchOrderService streams two versions of order o1 after the version it
+// is asked to resume from, and knows no other order
+type watchOrderService struct {
+	orderv1.UnimplementedOrderServiceServer
+	since chan int64
+}
+
+func (s *watchOrderService) WatchOrder(req *orderv1.WatchOrderRequest, stream orderv1.OrderService_WatchOrderServer) error {
+	s.since <- req.SinceVersion
+	if req.OrderId != "o1" {
+		return status.Error(codes.NotFound, "order not found")
+	}
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for version := req.SinceVersion + 1; version <= req.SinceVersion+2; version++ {
+		order := &orderv1.Order{Id: "o1", UserId: "user-1", Version: version, Status: orderv1.OrderStatus_ORDER_STATUS_PROCESSING}
+		if err := stream.Send(&orderv1.WatchOrderResponse{Order: order}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWatchOrderEvents(t *testing.T) {
+	backend := &watchOrderService{since: make(chan int64, 1)}
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	router := newTestRouter(t, cfg)
+
+	rec := serve(router, http.MethodGet, "/api/v1/orders/o1/watch", "", map[string]string{
+		"Authorization": bearer(t, "user-1"),
+		"Last-Event-ID": "3",
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	require.Equal(t, int64(3), <-backend.since)
+
+	events := strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n")
+	require.Len(t, events, 2)
+	for i, event := range events {
+		lines := strings.Split(event, "\n")
+		require.Len(t, lines, 3)
+		require.Equal(t, fmt.Sprintf("id: %d", 4+i), lines[0])
+		require.Equal(t, "event: order", lines[1])
+
+		var order map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &order))
+		require.Equal(t, "ORDER_STATUS_PROCESSING", order["status"])
+	}
+}
+
+func TestWatchOrderErrors(t *testing.T) {
+	backend := &watchOrderService{since: make(chan int64, 1)}
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	router := newTestRouter(t, cfg)
+	auth := map[string]string{"Authorization": bearer(t, "user-1")}
+
+	rec := serve(router, http.MethodGet, "/api/v1/orders/o2/watch", "", auth)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Contains(t, rec.Body.String(), `"code":"NotFound"`)
+	<-backend.since
+
+	rec = serve(router, http.MethodGet, "/api/v1/orders/o1/watch?since_version=latest", "", auth)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zabilal/microservices/api-gateway/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+const testWebhookSecret = "fedcba9876543210fedcba9876543210"
+
+// paymentEventService records the payment events it is sent
+type paymentEventService struct {
+	orderv1.UnimplementedOrderServiceServer
+	events chan *orderv1.ApplyPaymentEventRequest
+}
+
+func (s *paymentEventService) ApplyPaymentEvent(ctx context.Context, req *orderv1.ApplyPaymentEventRequest) (*orderv1.ApplyPaymentEventResponse, error) {
+	s.events <- req
+	return &orderv1.ApplyPaymentEventResponse{Applied: true}, nil
+}
+
+const testWebhookBody = `{"id": "evt-1", "type": "AUTHORIZED", "order_id": "o1", "provider_reference": "auth-1", "occurred_at": "2024-05-01T12:00:00Z"}`
+
+func TestPaymentWebhook(t *testing.T) {
+	backend := &paymentEventService{events: make(chan *orderv1.ApplyPaymentEventRequest, 1)}
+	cfg := testConfig()
+	cfg.Services.OrderService.Endpoint = startOrderService(t, backend)
+	router := newTestRouter(t, cfg)
+
+	// No bearer token: the signature is the authentication
+	signature := handler.SignWebhook(testWebhookSecret, time.Now(), []byte(testWebhookBody))
+	rec := serve(router, http.MethodPost, "/api/v1/webhooks/payments", testWebhookBody, map[string]string{
+		handler.WebhookSignatureHeader: signature,
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	event := <-backend.events
+	require.Equal(t, "evt-1", event.EventId)
+	require.Equal(t, orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_AUTHORIZED, event.Type)
+	require.Equal(t, "o1", event.OrderId)
+	require.Equal(t, "auth-1", event.ProviderReference)
+	require.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), event.OccurredAt.AsTime())
+}
+
+func TestPaymentWebhookSignature(t *testing.T) {
+	router := newTestRouter(t, testConfig())
+	body := []byte(testWebhookBody)
+
+	tests := []struct {
+		name      string
+		signature string
+	}{
+		{"missing", ""},
+		{"wrong secret", handler.SignWebhook("0000000000000000000000000000000000", time.Now(), body)},
+		{"other body", handler.SignWebhook(testWebhookSecret, time.Now(), []byte(`{"id": "evt-2"}`))},
+		{"stale", handler.SignWebhook(testWebhookSecret, time.Now().Add(-time.Hour), body)},
+		{"malformed", "v1=abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.signature != "" {
+				headers[handler.WebhookSignatureHeader] = tt.signature
+			}
+
+			// Rejected before order-service is called, which is unreachable
+			rec := serve(router, http.MethodPost, "/api/v1/webhooks/payments", testWebhookBody, headers)
+			require.Equal(t, http.StatusUnauthorized, rec.Code, rec.Body.String())
+			require.Contains(t, rec.Body.String(), "Unauthenticated")
+		})
+	}
+}
+
+func TestWebhookSecretRotation(t *testing.T) {
+	const previous = "0123456789abcdef0123456789abcdef-old"
+	verifier, err := handler.NewWebhookVerifier(&handler.WebhookConfig{Secrets: []string{testWebhookSecret, previous}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	body := []byte(testWebhookBody)
+	require.NoError(t, verifier.Verify(handler.SignWebhook(previous, now, body), body, now))
+	require.NoError(t, verifier.Verify(handler.SignWebhook(testWebhookSecret, now, body), body, now))
+	require.ErrorIs(t, verifier.Verify(handler.SignWebhook(testWebhookSecret, now.Add(-10*time.Minute), body), body, now), handler.ErrStaleSignature)
+}
+
+func TestRejectShortWebhookSecret(t *testing.T) {
+	_, err := handler.NewWebhookVerifier(&handler.WebhookConfig{Secrets: []string{"change-me"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    DROP COLUMN cancelled_at,
+    DROP COLUMN cancel_reason;
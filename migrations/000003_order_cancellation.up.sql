@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    ADD COLUMN cancel_reason VARCHAR(500) NULL,
+    ADD COLUMN cancelled_at TIMESTAMP NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE order_items MODIFY unit_price DECIMAL(10,2) NOT NULL;
+ALTER TABLE orders MODIFY total_amount DECIMAL(10,2) NOT NULL;
+ALTER TABLE orders DROP COLUMN currency;
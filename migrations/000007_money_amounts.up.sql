@@ -0,0 +1,3 @@
+ALTER TABLE orders ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' AFTER status;
+ALTER TABLE orders MODIFY total_amount DECIMAL(19,4) NOT NULL;
+ALTER TABLE order_items MODIFY unit_price DECIMAL(19,4) NOT NULL;
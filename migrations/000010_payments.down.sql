@@ -0,0 +1,3 @@
+-- payment_info is created by the up migration, so dropping it also undoes
+-- provider_ref and the nullable processed_at
+DROP TABLE IF EXISTS payment_info;
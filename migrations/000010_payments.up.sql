@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS payment_info (
+    id VARCHAR(36) PRIMARY KEY,
+    order_id VARCHAR(36) NOT NULL UNIQUE,
+    payment_id VARCHAR(36) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    method VARCHAR(50) NOT NULL,
+    processed_at TIMESTAMP NULL,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+ALTER TABLE payment_info
+    ADD COLUMN provider_ref VARCHAR(255) NULL,
+    MODIFY processed_at TIMESTAMP NULL;
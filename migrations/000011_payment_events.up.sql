@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS payment_events (
+    event_id VARCHAR(255) PRIMARY KEY,
+    order_id VARCHAR(36) NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    applied BOOLEAN NOT NULL,
+    occurred_at TIMESTAMP NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_payment_events_order (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,3 @@
+-- shipping_info is created by the up migration, so dropping it also undoes
+-- the tracking columns
+DROP TABLE IF EXISTS shipping_info;
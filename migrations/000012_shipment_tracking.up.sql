@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS shipping_info (
+    id VARCHAR(36) PRIMARY KEY,
+    order_id VARCHAR(36) NOT NULL UNIQUE,
+    address_line1 VARCHAR(255) NOT NULL DEFAULT '',
+    address_line2 VARCHAR(255) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL DEFAULT '',
+    state VARCHAR(255) NOT NULL DEFAULT '',
+    country VARCHAR(255) NOT NULL DEFAULT '',
+    postal_code VARCHAR(32) NOT NULL DEFAULT '',
+    status VARCHAR(50) NOT NULL,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+ALTER TABLE shipping_info
+    ADD COLUMN carrier VARCHAR(100) NULL,
+    ADD COLUMN tracking_number VARCHAR(255) NULL,
+    ADD COLUMN shipped_at TIMESTAMP NULL,
+    ADD COLUMN delivered_at TIMESTAMP NULL;
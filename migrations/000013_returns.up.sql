@@ -0,0 +1,27 @@
+ALTER TABLE payment_info ADD COLUMN refunded_amount DECIMAL(19,4) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS returns (
+    id VARCHAR(36) PRIMARY KEY,
+    order_id VARCHAR(36) NOT NULL,
+    user_id VARCHAR(36) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    reason VARCHAR(500) NOT NULL DEFAULT '',
+    currency CHAR(3) NOT NULL,
+    refund_amount DECIMAL(19,4) NOT NULL,
+    decision_reason VARCHAR(500) NOT NULL DEFAULT '',
+    decided_by VARCHAR(36) NULL,
+    created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    updated_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+    INDEX idx_returns_order (order_id, created_at, id),
+    INDEX idx_returns_user (user_id, created_at, id),
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS return_items (
+    return_id VARCHAR(36) NOT NULL,
+    product_id VARCHAR(36) NOT NULL,
+    quantity INT NOT NULL,
+    unit_price DECIMAL(19,4) NOT NULL,
+    PRIMARY KEY (return_id, product_id),
+    FOREIGN KEY (return_id) REFERENCES returns(id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
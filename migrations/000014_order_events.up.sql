@@ -0,0 +1,17 @@
+-- Transactional outbox of order domain events. seq orders the events of an
+-- order; unpublished events wait in it until next_attempt_at.
+CREATE TABLE IF NOT EXISTS order_events (
+    seq BIGINT AUTO_INCREMENT PRIMARY KEY,
+    id VARCHAR(36) NOT NULL,
+    order_id VARCHAR(36) NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    payload JSON NOT NULL,
+    created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    last_error VARCHAR(500) NULL,
+    published_at TIMESTAMP(6) NULL,
+    UNIQUE KEY uq_order_events_id (id),
+    INDEX idx_order_events_pending (published_at, seq),
+    INDEX idx_order_events_order (order_id, published_at, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
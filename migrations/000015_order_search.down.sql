@@ -0,0 +1,16 @@
+ALTER TABLE shipping_info DROP INDEX idx_shipping_info_country;
+
+ALTER TABLE payment_info DROP INDEX idx_payment_info_status;
+
+ALTER TABLE order_items DROP INDEX idx_order_items_product;
+
+-- The foreign key on orders.user_id needs an index of its own once the
+-- composite ones are gone
+ALTER TABLE orders
+    ADD INDEX idx_orders_user (user_id),
+    DROP INDEX idx_orders_user_created,
+    DROP INDEX idx_orders_user_total,
+    DROP INDEX idx_orders_status_created,
+    DROP INDEX idx_orders_created,
+    DROP INDEX idx_orders_updated,
+    DROP INDEX idx_orders_total;
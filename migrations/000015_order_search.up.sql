@@ -0,0 +1,16 @@
+-- Indexes for the ListOrders filters. Listings of one user, by status and
+-- across users are ordered by (created_at, id) or (total_amount, id); the
+-- child tables are reached from the filter value for EXISTS lookups.
+ALTER TABLE orders
+    ADD INDEX idx_orders_user_created (user_id, created_at, id),
+    ADD INDEX idx_orders_user_total (user_id, total_amount, id),
+    ADD INDEX idx_orders_status_created (status, created_at, id),
+    ADD INDEX idx_orders_created (created_at, id),
+    ADD INDEX idx_orders_updated (updated_at),
+    ADD INDEX idx_orders_total (currency, total_amount, id);
+
+ALTER TABLE order_items ADD INDEX idx_order_items_product (product_id, order_id);
+
+ALTER TABLE payment_info ADD INDEX idx_payment_info_status (status, method);
+
+ALTER TABLE shipping_info ADD INDEX idx_shipping_info_country (country);
@@ -0,0 +1 @@
+ALTER TABLE returns DROP INDEX idx_returns_status;
@@ -0,0 +1,2 @@
+-- Returns whose refund failed are found by status for the retry sweep
+ALTER TABLE returns ADD INDEX idx_returns_status (status, updated_at);
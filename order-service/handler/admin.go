@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+// exportBatchSize is the number of orders ExportOrders reads per query and
+// sends per message, which bounds its memory use whatever the export size
+const exportBatchSize = 500
+
+// AdminListOrders lists orders across users, with the filters and paging of
+// ListOrders
+func (h *OrderHandler) AdminListOrders(ctx context.Context, req *orderv1.AdminListOrdersRequest) (*orderv1.ListOrdersResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	filter, err := newOrderFilter(req.UserId, orderv1.OrderStatus_ORDER_STATUS_UNSPECIFIED, req.Filter, req.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.listOrders(ctx, filter, req.PageSize, req.PageToken, req.SortOrder)
+}
+
+// ExportOrders sends every matching order in keyset batches, so that no more
+// than one batch is held at a time. Orders changed during the export may be
+// sent with their new values or, if the change moves them past the cursor,
+// skipped or sent twice, as when paging through ListOrders.
+func (h *OrderHandler) ExportOrders(req *orderv1.ExportOrdersRequest, stream orderv1.OrderService_ExportOrdersServer) error {
+	ctx := stream.Context()
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	filter, err := newOrderFilter(req.UserId, orderv1.OrderStatus_ORDER_STATUS_UNSPECIFIED, req.Filter, req.OrderBy)
+	if err != nil {
+		return err
+	}
+
+	page := pagination.Page{
+		Size: exportBatchSize,
+		Desc: req.SortOrder != orderv1.SortOrder_SORT_ORDER_ASC,
+	}
+	for {
+		orders, hasMore, err := h.repo.ListOrders(ctx, filter, page)
+		switch {
+		case ctx.Err() != nil:
+			return status.FromContextError(ctx.Err()).Err()
+		case err != nil:
+			h.logger.Error("failed to export orders", zap.Error(err))
+			return status.Error(codes.Internal, "failed to export orders")
+		}
+		if len(orders) == 0 {
+			return nil
+		}
+
+		users, err := h.getUsers(ctx, orders)
+		if err != nil {
+			return err
+		}
+
+		resp := &orderv1.ExportOrdersResponse{Orders: make([]*orderv1.Order, len(orders))}
+		for i, order := range orders {
+			resp.Orders[i] = convertToProtoOrder(order, users[order.UserID])
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+
+		if !hasMore {
+			return nil
+		}
+		page.After = filter.after(page, orders[len(orders)-1])
+	}
+}
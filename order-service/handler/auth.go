@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys set by the api-gateway from a verified access token
+const (
+	metadataUserID    = "x-user-id"
+	metadataUserRoles = "x-user-roles"
+)
+
+const roleAdmin = "admin"
+
+// actorSystem is recorded as the actor of changes made by internal callers
+const actorSystem = "system"
+
+// Caller is the end user on whose behalf a request is made
+type Caller struct {
+	UserID string
+	Roles  []string
+}
+
+// callerFromContext returns the caller forwarded by the gateway. Every call
+// has passed the service token interceptor, so requests without identity
+// metadata come from other services inside the cluster.
+func callerFromContext(ctx context.Context) (*Caller, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	ids := md.Get(metadataUserID)
+	if len(ids) == 0 || ids[0] == "" {
+		return nil, false
+	}
+
+	caller := &Caller{UserID: ids[0]}
+	for _, v := range md.Get(metadataUserRoles) {
+		for _, role := range strings.Split(v, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				caller.Roles = append(caller.Roles, role)
+			}
+		}
+	}
+
+	return caller, true
+}
+
+// actorFromContext names who is making a change, for audit records
+func actorFromContext(ctx context.Context) string {
+	if caller, ok := callerFromContext(ctx); ok {
+		return caller.UserID
+	}
+	return actorSystem
+}
+
+func (c *Caller) IsAdmin() bool {
+	for _, role := range c.Roles {
+		if role == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessUser reports whether the caller may act on data owned by userID
+func canAccessUser(ctx context.Context, userID string) bool {
+	caller, ok := callerFromContext(ctx)
+	if !ok {
+		return true
+	}
+	return caller.UserID == userID || caller.IsAdmin()
+}
+
+// requireAdmin rejects end users that do not hold the admin role
+func requireAdmin(ctx context.Context) error {
+	caller, ok := callerFromContext(ctx)
+	if ok && !caller.IsAdmin() {
+		return status.Error(codes.PermissionDenied, "admin role required")
+	}
+	return nil
+}
+
+// requireInternal rejects calls made on behalf of an end user, leaving only
+// other services inside the cluster
+func requireInternal(ctx context.Context) error {
+	if _, ok := callerFromContext(ctx); ok {
+		return status.Error(codes.PermissionDenied, "internal callers only")
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+const (
+	// maxBatchSize caps the orders a batch call may name
+	maxBatchSize = 100
+	// maxBatchGetUsers is the most ids user-service accepts per BatchGetUsers
+	maxBatchGetUsers = 100
+)
+
+// ErrBatchAborted is the outcome of the updates of an all-or-nothing batch
+// that were rolled back because another update failed
+var ErrBatchAborted = errors.New("batch rolled back")
+
+// StatusUpdate is one status change of a batch
+type StatusUpdate struct {
+	OrderID string
+	Transition
+}
+
+func (h *OrderHandler) BatchGetOrders(ctx context.Context, req *orderv1.BatchGetOrdersRequest) (*orderv1.BatchGetOrdersResponse, error) {
+	if len(req.OrderIds) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "order_ids must not be empty")
+	}
+	if len(req.OrderIds) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d orders per batch", maxBatchSize)
+	}
+
+	orders, err := h.repo.GetOrders(ctx, uniqueIDs(req.OrderIds))
+	if err != nil {
+		h.logger.Error("failed to get orders", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get orders")
+	}
+
+	// Orders of other users are reported missing, as GetOrder does
+	byID := make(map[string]*Order, len(orders))
+	var visible []*Order
+	for _, order := range orders {
+		if canAccessUser(ctx, order.UserID) {
+			byID[order.ID] = order
+			visible = append(visible, order)
+		}
+	}
+
+	users, err := h.getUsers(ctx, visible)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &orderv1.BatchGetOrdersResponse{}
+	for _, id := range req.OrderIds {
+		if order, ok := byID[id]; ok {
+			resp.Orders = append(resp.Orders, convertToProtoOrder(order, users[order.UserID]))
+		} else {
+			resp.MissingOrderIds = append(resp.MissingOrderIds, id)
+		}
+	}
+	return resp, nil
+}
+
+func (h *OrderHandler) BatchUpdateOrderStatus(ctx context.Context, req *orderv1.BatchUpdateOrderStatusRequest) (*orderv1.BatchUpdateOrderStatusResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.Requests) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "requests must not be empty")
+	}
+	if len(req.Requests) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d orders per batch", maxBatchSize)
+	}
+
+	actor := actorFromContext(ctx)
+	updates := make([]StatusUpdate, len(req.Requests))
+	for i, item := range req.Requests {
+		if item.OrderId == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "requests[%d]: order_id must not be empty", i)
+		}
+		updates[i] = StatusUpdate{
+			OrderID: item.OrderId,
+			Transition: Transition{
+				To:              item.Status,
+				ExpectedVersion: item.ExpectedVersion,
+				Actor:           actor,
+				Reason:          item.Reason,
+			},
+		}
+	}
+
+	outcomes, err := h.repo.UpdateOrderStatuses(ctx, updates, req.AllOrNothing)
+	if err != nil {
+		h.logger.Error("failed to update order statuses", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to update order statuses")
+	}
+
+	var updated, cancelled []string
+	for i, u := range updates {
+		if outcomes[i] != nil {
+			continue
+		}
+		updated = append(updated, u.OrderID)
+		if u.To == orderv1.OrderStatus_ORDER_STATUS_CANCELLED {
+			cancelled = append(cancelled, u.OrderID)
+		}
+	}
+
+	// Cancelled orders have their payment returned, as UpdateOrderStatus does
+	if len(cancelled) > 0 {
+		orders, err := h.repo.GetOrders(ctx, cancelled)
+		if err != nil {
+			h.logger.Error("failed to get orders", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to get orders")
+		}
+		for _, order := range orders {
+			if err := h.returnPayment(ctx, order); err != nil {
+				h.logger.Warn("payment of cancelled order not returned yet", zap.String("order_id", order.ID), zap.Error(err))
+			}
+		}
+	}
+
+	orders, err := h.repo.GetOrders(ctx, uniqueIDs(updated))
+	if err != nil {
+		h.logger.Error("failed to get orders", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get orders")
+	}
+	byID := make(map[string]*Order, len(orders))
+	for _, order := range orders {
+		byID[order.ID] = order
+	}
+
+	users, err := h.getUsers(ctx, orders)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*orderv1.OrderStatusResult, len(updates))
+	for i, u := range updates {
+		result := &orderv1.OrderStatusResult{OrderId: u.OrderID}
+		if outcomes[i] != nil {
+			result.Error = status.Convert(h.statusChangeError(outcomes[i], "update order status")).Proto()
+		} else if order, ok := byID[u.OrderID]; ok {
+			result.Order = convertToProtoOrder(order, users[order.UserID])
+		}
+		results[i] = result
+	}
+
+	return &orderv1.BatchUpdateOrderStatusResponse{Results: results}, nil
+}
+
+// getUsers fetches the owners of the orders, keyed by id, with as few calls
+// as BatchGetUsers allows
+func (h *OrderHandler) getUsers(ctx context.Context, orders []*Order) (map[string]*userv1.User, error) {
+	if len(orders) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(orders))
+	for i, order := range orders {
+		ids[i] = order.UserID
+	}
+	ids = uniqueIDs(ids)
+
+	users := make(map[string]*userv1.User, len(ids))
+	for start := 0; start < len(ids); start += maxBatchGetUsers {
+		end := start + maxBatchGetUsers
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		resp, err := h.userClient.BatchGetUsers(ctx, &userv1.BatchGetUsersRequest{Ids: ids[start:end]})
+		if err != nil {
+			h.logger.Error("failed to get user details", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to get user details")
+		}
+		for _, user := range resp.Users {
+			users[user.Id] = user
+		}
+	}
+	return users, nil
+}
+
+// uniqueIDs returns ids without duplicates, keeping the first occurrence
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func (r *orderRepository) GetOrders(ctx context.Context, ids []string) ([]*Order, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	query := `
+		SELECT o.id, o.user_id, o.status, o.currency, o.total_amount, o.created_at, o.updated_at,
+			COALESCE(o.cancel_reason, ''), o.cancelled_at, o.version
+		FROM orders o
+		WHERE o.id IN (` + placeholders(len(ids)) + `)
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders, err := scanOrders(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadChildren(ctx, orders); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+// UpdateOrderStatuses locks every order of the batch with one query, in id
+// order so that overlapping batches cannot deadlock, and then applies the
+// updates. Without atomic each update runs under a savepoint, so a failed
+// one is rolled back on its own.
+func (r *orderRepository) UpdateOrderStatuses(ctx context.Context, updates []StatusUpdate, atomic bool) ([]error, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]string, len(updates))
+	for i, u := range updates {
+		ids[i] = u.OrderID
+	}
+	ids = uniqueIDs(ids)
+	sort.Strings(ids)
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	lockQuery := `
+		SELECT id FROM orders
+		WHERE id IN (` + placeholders(len(ids)) + `)
+		ORDER BY id
+		FOR UPDATE
+	`
+
+	rows, err := tx.QueryContext(ctx, lockQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	// Only the locks are needed
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	outcomes := make([]error, len(updates))
+	failed := false
+	for i, u := range updates {
+		if !atomic {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT status_update"); err != nil {
+				return nil, err
+			}
+		}
+
+		outcomes[i] = applyStatusUpdate(ctx, tx, u)
+		if outcomes[i] == nil {
+			continue
+		}
+
+		failed = true
+		if atomic {
+			break
+		}
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT status_update"); err != nil {
+			return nil, err
+		}
+	}
+
+	if atomic && failed {
+		for i := range outcomes {
+			if outcomes[i] == nil {
+				outcomes[i] = ErrBatchAborted
+			}
+		}
+		return outcomes, nil
+	}
+
+	return outcomes, tx.Commit()
+}
+
+// applyStatusUpdate makes one change of a batch within tx. Cancelling goes
+// through the same checks as CancelOrder.
+func applyStatusUpdate(ctx context.Context, tx *sql.Tx, u StatusUpdate) error {
+	if u.To == orderv1.OrderStatus_ORDER_STATUS_CANCELLED {
+		return markCancelled(ctx, tx, u.OrderID, u.Transition)
+	}
+	_, err := transitionStatus(ctx, tx, u.OrderID, u.Transition)
+	return err
+}
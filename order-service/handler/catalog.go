@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+// Product is the catalog entry an order item is priced from
+type Product struct {
+	ID     string
+	Name   string
+	Price  money.Money
+	Active bool
+}
+
+// ProductCatalog is the source of truth for product names, prices and
+// availability. CreateOrder never trusts prices sent by the client.
+type ProductCatalog interface {
+	// GetProducts returns the known products among ids, keyed by id. Unknown
+	// ids are left out of the map rather than reported as an error.
+	GetProducts(ctx context.Context, ids []string) (map[string]*Product, error)
+}
+
+type sqlCatalog struct {
+	db *sql.DB
+}
+
+// NewSQLCatalog reads products from the products table
+func NewSQLCatalog(db *sql.DB) ProductCatalog {
+	return &sqlCatalog{db: db}
+}
+
+func (c *sqlCatalog) GetProducts(ctx context.Context, ids []string) (map[string]*Product, error) {
+	products := make(map[string]*Product, len(ids))
+	if len(ids) == 0 {
+		return products, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	query := `
+		SELECT id, name, currency, price, active
+		FROM products
+		WHERE id IN (` + placeholders(len(args)) + `)
+	`
+
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := &Product{}
+		var price string
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price.Currency, &price, &p.Active); err != nil {
+			return nil, err
+		}
+		if p.Price, err = money.Parse(p.Price.Currency, price); err != nil {
+			return nil, fmt.Errorf("failed to parse price of product %s: %w", p.ID, err)
+		}
+		products[p.ID] = p
+	}
+
+	return products, rows.Err()
+}
+
+// MemoryCatalog is a ProductCatalog held in memory, for tests and local
+// development
+type MemoryCatalog struct {
+	mu       sync.RWMutex
+	products map[string]Product
+}
+
+func NewMemoryCatalog(products ...Product) *MemoryCatalog {
+	c := &MemoryCatalog{products: make(map[string]Product, len(products))}
+	for _, p := range products {
+		c.products[p.ID] = p
+	}
+	return c
+}
+
+// Put adds or replaces a product
+func (c *MemoryCatalog) Put(p Product) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.products[p.ID] = p
+}
+
+func (c *MemoryCatalog) GetProducts(ctx context.Context, ids []string) (map[string]*Product, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	products := make(map[string]*Product, len(ids))
+	for _, id := range ids {
+		if p, ok := c.products[id]; ok {
+			products[id] = &p
+		}
+	}
+	return products, nil
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// historyField is the GetOrderRequest.read_mask path that includes the status
+// history in the response
+const historyField = "history"
+
+// StatusChange is one entry of an order's status audit trail
+type StatusChange struct {
+	ID         string
+	OrderID    string
+	FromStatus orderv1.OrderStatus
+	ToStatus   orderv1.OrderStatus
+	Actor      string
+	Reason     string
+	CreatedAt  time.Time
+}
+
+func (h *OrderHandler) GetOrderHistory(ctx context.Context, req *orderv1.GetOrderHistoryRequest) (*orderv1.GetOrderHistoryResponse, error) {
+	order, err := h.repo.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "order not found")
+		}
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	if !canAccessUser(ctx, order.UserID) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	}
+
+	history, err := h.repo.ListStatusHistory(ctx, req.OrderId)
+	if err != nil {
+		h.logger.Error("failed to get order history", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order history")
+	}
+
+	return &orderv1.GetOrderHistoryResponse{
+		History: convertToProtoHistory(history),
+	}, nil
+}
+
+func includesHistory(mask *fieldmaskpb.FieldMask) bool {
+	for _, path := range mask.GetPaths() {
+		if path == historyField {
+			return true
+		}
+	}
+	return false
+}
+
+func convertToProtoHistory(history []*StatusChange) []*orderv1.OrderStatusChange {
+	changes := make([]*orderv1.OrderStatusChange, len(history))
+	for i, change := range history {
+		changes[i] = &orderv1.OrderStatusChange{
+			FromStatus: change.FromStatus,
+			ToStatus:   change.ToStatus,
+			Actor:      change.Actor,
+			Reason:     change.Reason,
+			ChangedAt:  timestamppb.New(change.CreatedAt),
+		}
+	}
+	return changes
+}
+
+func (r *orderRepository) ListStatusHistory(ctx context.Context, orderID string) ([]*StatusChange, error) {
+	query := `
+		SELECT id, order_id, from_status, to_status, actor, reason, created_at
+		FROM order_status_history
+		WHERE order_id = ?
+		ORDER BY seq
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []*StatusChange
+	for rows.Next() {
+		change := &StatusChange{}
+		err := rows.Scan(
+			&change.ID,
+			&change.OrderID,
+			&change.FromStatus,
+			&change.ToStatus,
+			&change.Actor,
+			&change.Reason,
+			&change.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
+
+// insertStatusChange records a transition; it must run in the transaction
+// that changes orders.status
+func insertStatusChange(ctx context.Context, tx *sql.Tx, orderID string, from, to orderv1.OrderStatus, actor, reason string) error {
+	query := `
+		INSERT INTO order_status_history (id, order_id, from_status, to_status, actor, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW(6))
+	`
+
+	_, err := tx.ExecContext(ctx, query, uuid.New().String(), orderID, from, to, actor, reason)
+	return err
+}
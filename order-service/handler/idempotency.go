@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+const (
+	maxIdempotencyKeyLength = 128
+	idempotencySweepBatch   = 1000
+	mysqlDuplicateEntry     = 1062
+)
+
+// ErrIdempotencyKeyExists is returned by CreateOrder when another request
+// already claimed the idempotency key
+var ErrIdempotencyKeyExists = errors.New("idempotency key already used")
+
+// IdempotencyConfig controls how long CreateOrder responses are kept for
+// replay and how often expired keys are removed
+type IdempotencyConfig struct {
+	Retention     time.Duration
+	SweepInterval time.Duration
+}
+
+// IdempotencyKey stores the response of a CreateOrder call made with a key.
+// Keys are scoped to the user placing the order.
+type IdempotencyKey struct {
+	UserID string
+	Key    string
+	// Fingerprint is a hash of the request, used to reject a key reused for a
+	// different order
+	Fingerprint string
+	OrderID     string
+	Response    []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// requestFingerprint hashes the request without its idempotency key
+func requestFingerprint(req *orderv1.CreateOrderRequest) (string, error) {
+	clone := proto.Clone(req).(*orderv1.CreateOrderRequest)
+	clone.IdempotencyKey = ""
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(clone)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// replayCreateOrder returns the stored response for a key that was already
+// used with the same request
+func (h *OrderHandler) replayCreateOrder(ctx context.Context, userID, key, fingerprint string) (*orderv1.CreateOrderResponse, bool, error) {
+	record, err := h.repo.GetIdempotencyKey(ctx, userID, key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		h.logger.Error("failed to get idempotency key", zap.Error(err))
+		return nil, false, status.Error(codes.Internal, "failed to create order")
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return nil, false, nil
+	}
+	if record.Fingerprint != fingerprint {
+		return nil, false, status.Error(codes.AlreadyExists, "idempotency key was already used for a different request")
+	}
+
+	resp := &orderv1.CreateOrderResponse{}
+	if err := proto.Unmarshal(record.Response, resp); err != nil {
+		h.logger.Error("failed to decode stored response", zap.Error(err))
+		return nil, false, status.Error(codes.Internal, "failed to create order")
+	}
+
+	return resp, true, nil
+}
+
+// WatchIdempotencyKeys deletes expired idempotency keys until ctx is cancelled
+func (h *OrderHandler) WatchIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(h.idempotency.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.sweepIdempotencyKeys(ctx)
+		}
+	}
+}
+
+func (h *OrderHandler) sweepIdempotencyKeys(ctx context.Context) {
+	var total int64
+	for {
+		deleted, err := h.repo.DeleteExpiredIdempotencyKeys(ctx, time.Now(), idempotencySweepBatch)
+		if err != nil {
+			h.logger.Error("failed to delete expired idempotency keys", zap.Error(err))
+			return
+		}
+		total += deleted
+		// Small batches keep the delete from holding locks for long
+		if deleted < idempotencySweepBatch {
+			break
+		}
+	}
+
+	if total > 0 {
+		h.logger.Info("deleted expired idempotency keys", zap.Int64("count", total))
+	}
+}
+
+func (r *orderRepository) GetIdempotencyKey(ctx context.Context, userID, key string) (*IdempotencyKey, error) {
+	query := `
+		SELECT user_id, idem_key, fingerprint, order_id, response, created_at, expires_at
+		FROM idempotency_keys
+		WHERE user_id = ? AND idem_key = ?
+	`
+
+	record := &IdempotencyKey{}
+	err := r.db.QueryRowContext(ctx, query, userID, key).Scan(
+		&record.UserID,
+		&record.Key,
+		&record.Fingerprint,
+		&record.OrderID,
+		&record.Response,
+		&record.CreatedAt,
+		&record.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (r *orderRepository) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at < ?
+		LIMIT ?
+	`
+
+	result, err := r.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// insertIdempotencyKey claims the key inside the CreateOrder transaction. A
+// concurrent request with the same key blocks on the primary key until this
+// transaction finishes and then fails with ErrIdempotencyKeyExists.
+func insertIdempotencyKey(ctx context.Context, tx *sql.Tx, record *IdempotencyKey) error {
+	// An expired key that has not been swept yet may be reused
+	_, err := tx.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ? AND expires_at < ?",
+		record.UserID, record.Key, record.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete expired idempotency key: %w", err)
+	}
+
+	query := `
+		INSERT INTO idempotency_keys (user_id, idem_key, fingerprint, order_id, response, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err = tx.ExecContext(ctx, query,
+		record.UserID,
+		record.Key,
+		record.Fingerprint,
+		record.OrderID,
+		record.Response,
+		record.CreatedAt,
+		record.ExpiresAt,
+	)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			return ErrIdempotencyKeyExists
+		}
+		return fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+const inventorySweepBatch = 100
+
+// Reservation statuses. A reservation holds stock while the order is open and
+// ends either released back to stock or committed as sold.
+const (
+	reservationReserved  = "RESERVED"
+	reservationReleased  = "RELEASED"
+	reservationCommitted = "COMMITTED"
+)
+
+// reservationExpiredReason is recorded on orders failed by the sweeper
+const reservationExpiredReason = "stock reservation expired"
+
+// ErrInsufficientStock is returned when a reservation or adjustment would
+// leave less stock on hand than is reserved
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// InventoryConfig controls how long a PENDING order may hold its stock and how
+// often expired reservations are looked for
+type InventoryConfig struct {
+	ReservationTTL time.Duration
+	SweepInterval  time.Duration
+}
+
+// Stock is the inventory level of a product. Reserved units belong to open
+// orders and cannot be sold again.
+type Stock struct {
+	ProductID string
+	OnHand    int32
+	Reserved  int32
+	UpdatedAt time.Time
+}
+
+func (s *Stock) Available() int32 {
+	return s.OnHand - s.Reserved
+}
+
+// StockAdjustment is a back-office change to the stock on hand
+type StockAdjustment struct {
+	ProductID string
+	Delta     int32
+	Actor     string
+	Reason    string
+}
+
+func (h *OrderHandler) GetStock(ctx context.Context, req *orderv1.GetStockRequest) (*orderv1.GetStockResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	stock, err := h.repo.GetStock(ctx, req.ProductId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, status.Error(codes.NotFound, "no stock recorded for product")
+		}
+		h.logger.Error("failed to get stock", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get stock")
+	}
+
+	return &orderv1.GetStockResponse{
+		Stock: convertToProtoStock(stock),
+	}, nil
+}
+
+func (h *OrderHandler) AdjustStock(ctx context.Context, req *orderv1.AdjustStockRequest) (*orderv1.AdjustStockResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Delta == 0 {
+		return nil, status.Error(codes.InvalidArgument, "delta must not be zero")
+	}
+
+	products, err := h.catalog.GetProducts(ctx, []string{req.ProductId})
+	if err != nil {
+		h.logger.Error("failed to look up products", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to look up products")
+	}
+	if _, ok := products[req.ProductId]; !ok {
+		return nil, status.Error(codes.NotFound, "product not found")
+	}
+
+	stock, err := h.repo.AdjustStock(ctx, StockAdjustment{
+		ProductID: req.ProductId,
+		Delta:     req.Delta,
+		Actor:     actorFromContext(ctx),
+		Reason:    req.Reason,
+	})
+	if err != nil {
+		if errors.Is(err, ErrInsufficientStock) {
+			return nil, status.Error(codes.FailedPrecondition, "stock on hand cannot drop below the reserved quantity")
+		}
+		h.logger.Error("failed to adjust stock", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to adjust stock")
+	}
+
+	return &orderv1.AdjustStockResponse{
+		Stock: convertToProtoStock(stock),
+	}, nil
+}
+
+func convertToProtoStock(stock *Stock) *orderv1.Stock {
+	return &orderv1.Stock{
+		ProductId: stock.ProductID,
+		OnHand:    stock.OnHand,
+		Reserved:  stock.Reserved,
+		Available: stock.Available(),
+		UpdatedAt: timestamppb.New(stock.UpdatedAt),
+	}
+}
+
+// WatchReservations fails PENDING orders whose stock reservation expired,
+// which returns their stock, until ctx is cancelled
+func (h *OrderHandler) WatchReservations(ctx context.Context) {
+	ticker := time.NewTicker(h.inventory.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.sweepReservations(ctx)
+		}
+	}
+}
+
+func (h *OrderHandler) sweepReservations(ctx context.Context) {
+	var total int64
+	for {
+		expired, err := h.repo.ExpireReservations(ctx, time.Now(), inventorySweepBatch)
+		if err != nil {
+			h.logger.Error("failed to expire stock reservations", zap.Error(err))
+			return
+		}
+		total += expired
+		if expired < inventorySweepBatch {
+			break
+		}
+	}
+
+	if total > 0 {
+		h.logger.Info("failed orders with expired stock reservations", zap.Int64("count", total))
+	}
+}
+
+func (r *orderRepository) GetStock(ctx context.Context, productID string) (*Stock, error) {
+	stock := &Stock{}
+	err := r.db.QueryRowContext(ctx,
+		"SELECT product_id, on_hand, reserved, updated_at FROM stock WHERE product_id = ?",
+		productID,
+	).Scan(&stock.ProductID, &stock.OnHand, &stock.Reserved, &stock.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return stock, nil
+}
+
+// AdjustStock changes the stock on hand, creating the stock row on first use,
+// and records the adjustment. It returns ErrInsufficientStock if fewer units
+// than are reserved would remain.
+func (r *orderRepository) AdjustStock(ctx context.Context, adj StockAdjustment) (*Stock, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO stock (product_id, on_hand, reserved) VALUES (?, 0, 0) ON DUPLICATE KEY UPDATE product_id = product_id",
+		adj.ProductID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stock: %w", err)
+	}
+
+	query := `
+		UPDATE stock
+		SET on_hand = on_hand + ?
+		WHERE product_id = ? AND on_hand + ? >= reserved
+	`
+
+	result, err := tx.ExecContext(ctx, query, adj.Delta, adj.ProductID, adj.Delta)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if rows == 0 {
+		return nil, ErrInsufficientStock
+	}
+
+	adjustmentQuery := `
+		INSERT INTO stock_adjustments (product_id, delta, actor, reason, created_at)
+		VALUES (?, ?, ?, ?, NOW(6))
+	`
+
+	_, err = tx.ExecContext(ctx, adjustmentQuery, adj.ProductID, adj.Delta, adj.Actor, adj.Reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record stock adjustment: %w", err)
+	}
+
+	stock := &Stock{}
+	err = tx.QueryRowContext(ctx,
+		"SELECT product_id, on_hand, reserved, updated_at FROM stock WHERE product_id = ?",
+		adj.ProductID,
+	).Scan(&stock.ProductID, &stock.OnHand, &stock.Reserved, &stock.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return stock, tx.Commit()
+}
+
+// ExpireReservations fails up to limit PENDING orders whose reservations
+// expired before the given time and returns how many were failed. Orders
+// that changed status concurrently are skipped.
+func (r *orderRepository) ExpireReservations(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		SELECT DISTINCT r.order_id, o.version
+		FROM stock_reservations r
+		JOIN orders o ON o.id = r.order_id
+		WHERE r.status = ? AND r.expires_at < ? AND o.status = ?
+		LIMIT ?
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, reservationReserved, before, lifecycle.Initial, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	versions := make(map[string]int64)
+	for rows.Next() {
+		var (
+			id      string
+			version int64
+		)
+		if err := rows.Scan(&id, &version); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		versions[id] = version
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var expired int64
+	for id, version := range versions {
+		// The expected version keeps an order that left PENDING in the
+		// meantime from being failed
+		err := r.UpdateOrderStatus(ctx, id, Transition{
+			To:              orderv1.OrderStatus_ORDER_STATUS_FAILED,
+			ExpectedVersion: version,
+			Actor:           actorSystem,
+			Reason:          reservationExpiredReason,
+		})
+		var transitionErr *lifecycle.TransitionError
+		switch {
+		case err == nil:
+			expired++
+		case errors.Is(err, ErrVersionMismatch), errors.Is(err, ErrStatusConflict), errors.As(err, &transitionErr):
+			// The order moved on since it was selected
+		default:
+			return expired, fmt.Errorf("failed to expire order %s: %w", id, err)
+		}
+	}
+
+	return expired, nil
+}
+
+// reserveStock holds stock for every item of a new order inside the
+// CreateOrder transaction. Products are locked in id order so concurrent
+// orders cannot deadlock.
+func reserveStock(ctx context.Context, tx *sql.Tx, order *Order) error {
+	quantities := make(map[string]int32, len(order.Items))
+	for _, item := range order.Items {
+		quantities[item.ProductID] += item.Quantity
+	}
+
+	productIDs := make([]string, 0, len(quantities))
+	for id := range quantities {
+		productIDs = append(productIDs, id)
+	}
+	sort.Strings(productIDs)
+
+	stockQuery := `
+		UPDATE stock
+		SET reserved = reserved + ?
+		WHERE product_id = ? AND on_hand - reserved >= ?
+	`
+	reservationQuery := `
+		INSERT INTO stock_reservations (order_id, product_id, quantity, status, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	for _, id := range productIDs {
+		quantity := quantities[id]
+
+		result, err := tx.ExecContext(ctx, stockQuery, quantity, id, quantity)
+		if err != nil {
+			return fmt.Errorf("failed to reserve stock: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return fmt.Errorf("%w for product %s", ErrInsufficientStock, id)
+		}
+
+		_, err = tx.ExecContext(ctx, reservationQuery, order.ID, id, quantity, reservationReserved, order.ReservedUntil)
+		if err != nil {
+			return fmt.Errorf("failed to record stock reservation: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// settleReservations applies a status change to the order's open
+// reservations: cancelled and failed orders give their stock back, completed
+// orders take it off the shelf. It must run in the transaction that changes
+// orders.status.
+func settleReservations(ctx context.Context, tx *sql.Tx, orderID string, to orderv1.OrderStatus) error {
+	var query string
+	var settled string
+	switch to {
+	case orderv1.OrderStatus_ORDER_STATUS_CANCELLED, orderv1.OrderStatus_ORDER_STATUS_FAILED:
+		query = `
+			UPDATE stock s
+			JOIN stock_reservations r ON r.product_id = s.product_id
+			SET s.reserved = s.reserved - r.quantity, r.status = ?
+			WHERE r.order_id = ? AND r.status = ?
+		`
+		settled = reservationReleased
+	case orderv1.OrderStatus_ORDER_STATUS_COMPLETED:
+		query = `
+			UPDATE stock s
+			JOIN stock_reservations r ON r.product_id = s.product_id
+			SET s.reserved = s.reserved - r.quantity, s.on_hand = s.on_hand - r.quantity, r.status = ?
+			WHERE r.order_id = ? AND r.status = ?
+		`
+		settled = reservationCommitted
+	default:
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, query, settled, orderID, reservationReserved); err != nil {
+		return fmt.Errorf("failed to settle stock reservations: %w", err)
+	}
+	return nil
+}
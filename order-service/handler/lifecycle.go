@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+var (
+	ErrOrderShipped = errors.New("order has already shipped")
+	// ErrStatusConflict means the order status changed between reading it
+	// and the conditional update
+	ErrStatusConflict = errors.New("order status changed concurrently")
+	// ErrVersionMismatch means the caller's expected version is stale
+	ErrVersionMismatch = errors.New("order version mismatch")
+)
+
+// hasShipped reports whether the parcel has left the warehouse
+func hasShipped(status orderv1.ShippingStatus) bool {
+	switch status {
+	case orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED,
+		orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED,
+		orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED:
+		return true
+	}
+	return false
+}
+
+// Transition is a requested status change
+type Transition struct {
+	To orderv1.OrderStatus
+	// ExpectedVersion is the order version the caller last saw; zero skips
+	// the check
+	ExpectedVersion int64
+	Actor           string
+	Reason          string
+}
+
+// transitionStatus moves the order to t.To within tx, bumps its version,
+// records the change, adds an OrderStatusChanged event to the outbox and
+// settles the order's stock reservations. The UPDATE only matches the status
+// and version that were checked, so a concurrent change is detected instead
+// of overwritten.
+func transitionStatus(ctx context.Context, tx *sql.Tx, id string, t Transition) (orderv1.OrderStatus, error) {
+	var (
+		from    orderv1.OrderStatus
+		version int64
+	)
+	err := tx.QueryRowContext(ctx, "SELECT status, version FROM orders WHERE id = ?", id).Scan(&from, &version)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.ExpectedVersion != 0 && version != t.ExpectedVersion {
+		return from, ErrVersionMismatch
+	}
+	if err := lifecycle.Check(from, t.To); err != nil {
+		return from, err
+	}
+
+	query := `
+		UPDATE orders
+		SET status = ?, version = version + 1, updated_at = NOW()
+		WHERE id = ? AND status = ? AND version = ?
+	`
+
+	result, err := tx.ExecContext(ctx, query, t.To, id, from, version)
+	if err != nil {
+		return from, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return from, err
+	}
+
+	if rows == 0 {
+		// A locking read sees the row committed by the concurrent writer
+		err := tx.QueryRowContext(ctx, "SELECT status, version FROM orders WHERE id = ? FOR UPDATE", id).Scan(&from, &version)
+		if err != nil {
+			return from, err
+		}
+		if t.ExpectedVersion != 0 && version != t.ExpectedVersion {
+			return from, ErrVersionMismatch
+		}
+		if err := lifecycle.Check(from, t.To); err != nil {
+			return from, err
+		}
+		return from, ErrStatusConflict
+	}
+
+	if err := insertStatusChange(ctx, tx, id, from, t.To, t.Actor, t.Reason); err != nil {
+		return from, fmt.Errorf("failed to record status change: %w", err)
+	}
+
+	event, err := statusChangedEvent(id, from, version+1, t)
+	if err != nil {
+		return from, err
+	}
+	if err := insertEvent(ctx, tx, event); err != nil {
+		return from, err
+	}
+
+	if err := settleReservations(ctx, tx, id, t.To); err != nil {
+		return from, err
+	}
+
+	return from, nil
+}
+
+// statusChangeError maps errors from status changing repository calls to
+// gRPC statuses
+func (h *OrderHandler) statusChangeError(err error, action string) error {
+	var transitionErr *lifecycle.TransitionError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, "order not found")
+	case errors.As(err, &transitionErr):
+		return transitionErr.GRPCStatus().Err()
+	case errors.Is(err, ErrOrderShipped):
+		return status.Error(codes.FailedPrecondition, "order has already shipped")
+	case errors.Is(err, ErrStatusConflict):
+		return status.Error(codes.Aborted, "order status changed concurrently, retry")
+	case errors.Is(err, ErrVersionMismatch):
+		return status.Error(codes.Aborted, "order was modified, reload it and retry")
+	case errors.Is(err, ErrBatchAborted):
+		return status.Error(codes.Aborted, "rolled back because another change of the batch failed")
+	}
+
+	h.logger.Error("failed to "+action, zap.Error(err))
+	return status.Error(codes.Internal, "failed to "+action)
+}
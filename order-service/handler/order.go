@@ -3,7 +3,9 @@ package handler
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,43 +13,100 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
 	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	"github.com/zabilal/microservices/order-service/outbox"
+	"github.com/zabilal/microservices/order-service/payment"
+	"github.com/zabilal/microservices/pkg/money"
+	"github.com/zabilal/microservices/pkg/pagination"
 )
 
 type OrderRepository interface {
-	CreateOrder(ctx context.Context, order *Order) error
+	// CreateOrder stores the order and reserves its stock; a non-nil key is
+	// claimed in the same transaction
+	CreateOrder(ctx context.Context, order *Order, key *IdempotencyKey) error
 	GetOrder(ctx context.Context, id string) (*Order, error)
-	ListOrders(ctx context.Context, userID string, status orderv1.OrderStatus, pageSize int32, pageToken string) ([]*Order, string, error)
-	UpdateOrderStatus(ctx context.Context, id string, status orderv1.OrderStatus) error
+	ListOrders(ctx context.Context, filter OrderFilter, page pagination.Page) ([]*Order, bool, error)
+	// GetOrders returns the orders with the given ids that exist, in no
+	// particular order
+	GetOrders(ctx context.Context, ids []string) ([]*Order, error)
+	UpdateOrderStatus(ctx context.Context, id string, t Transition) error
+	// UpdateOrderStatuses applies the updates in order in one transaction
+	// and returns the outcome of each. With atomic set nothing is kept
+	// unless every update succeeds.
+	UpdateOrderStatuses(ctx context.Context, updates []StatusUpdate, atomic bool) ([]error, error)
+	CancelOrder(ctx context.Context, id string, t Transition) error
+	ListStatusHistory(ctx context.Context, orderID string) ([]*StatusChange, error)
+	GetIdempotencyKey(ctx context.Context, userID, key string) (*IdempotencyKey, error)
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error)
+	GetStock(ctx context.Context, productID string) (*Stock, error)
+	AdjustStock(ctx context.Context, adj StockAdjustment) (*Stock, error)
+	ExpireReservations(ctx context.Context, before time.Time, limit int) (int64, error)
+	UpdatePayment(ctx context.Context, orderID string, u PaymentUpdate) error
+	ListPendingPaymentReturns(ctx context.Context, limit int) ([]string, error)
+	// ApplyPaymentEvent records a provider event and, when u is not nil,
+	// applies it in the same transaction
+	ApplyPaymentEvent(ctx context.Context, event PaymentEvent, u *PaymentUpdate) error
+	UpdateShipping(ctx context.Context, orderID string, u ShippingUpdate) error
+	// CreateReturn stores a return and moves a COMPLETED order to
+	// RETURN_REQUESTED
+	CreateReturn(ctx context.Context, ret *Return, t Transition) error
+	GetReturn(ctx context.Context, id string) (*Return, error)
+	ListReturns(ctx context.Context, filter ReturnFilter, page pagination.Page) ([]*Return, bool, error)
+	// UpdateReturnStatus moves a return that is still in from to d.To,
+	// without touching the order
+	UpdateReturnStatus(ctx context.Context, id string, from orderv1.ReturnStatus, d ReturnDecision) error
+	// ResolveReturn rejects a REQUESTED return or records the refund of a
+	// REFUNDING one, and updates the order
+	ResolveReturn(ctx context.Context, ret *Return, d ReturnDecision) error
+	// ListRefundingReturns returns REFUNDING returns last updated before the
+	// given time
+	ListRefundingReturns(ctx context.Context, before time.Time, limit int) ([]string, error)
+	// The events written by the methods above are relayed from the outbox
+	outbox.Store
 }
 
 type Order struct {
 	ID            string
 	UserID        string
 	Items         []OrderItem
-	TotalAmount   float64
+	TotalAmount   money.Money
 	Status        orderv1.OrderStatus
 	PaymentInfo   PaymentInfo
 	ShippingInfo  ShippingInfo
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
+	CancelReason  string
+	CancelledAt   sql.NullTime
+	Version       int64
+	// ReservedUntil is when the stock reservations made on create expire if
+	// the order is still PENDING. It is only set on new orders.
+	ReservedUntil time.Time
 }
 
 type OrderItem struct {
+	ID          string
+	OrderID     string
 	ProductID   string
 	Quantity    int32
-	UnitPrice   float64
+	UnitPrice   money.Money
 	ProductName string
 }
 
 type PaymentInfo struct {
-	PaymentID   string
-	Status      orderv1.PaymentStatus
-	Method      orderv1.PaymentMethod
-	ProcessedAt time.Time
+	PaymentID string
+	Status    orderv1.PaymentStatus
+	Method    orderv1.PaymentMethod
+	// Reference identifies the payment at the provider once authorized
+	Reference string
+	// ProcessedAt is when the payment last changed status at the provider
+	ProcessedAt sql.NullTime
+	// Refunded is the part of the captured amount returned so far
+	Refunded money.Money
 }
 
 type ShippingInfo struct {
@@ -58,6 +117,11 @@ type ShippingInfo struct {
 	Country      string
 	PostalCode   string
 	Status       orderv1.ShippingStatus
+	// Carrier and TrackingNumber are set once the parcel ships
+	Carrier        string
+	TrackingNumber string
+	ShippedAt      sql.NullTime
+	DeliveredAt    sql.NullTime
 }
 
 type orderRepository struct {
@@ -65,20 +129,30 @@ type orderRepository struct {
 }
 
 func NewOrderRepository(config DatabaseConfig) OrderRepository {
-	// Initialize database connection
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+	db, err := OpenDatabase(config)
+	if err != nil {
+		panic(err)
+	}
+
+	return &orderRepository{db: db}
+}
+
+// OpenDatabase opens a connection pool that can be shared by the repository
+// and the product catalog. DATETIME and TIMESTAMP columns scan into time.Time.
+func OpenDatabase(config DatabaseConfig) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true",
 		config.Username,
 		config.Password,
 		config.Host,
 		config.Port,
 		config.DBName,
 	)
-	
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		panic(err)
-	}
 
+	return sql.Open("mysql", dsn)
+}
+
+// NewOrderRepositoryFromDB wraps an existing connection pool
+func NewOrderRepositoryFromDB(db *sql.DB) OrderRepository {
 	return &orderRepository{db: db}
 }
 
@@ -92,22 +166,95 @@ type DatabaseConfig struct {
 
 type OrderHandler struct {
 	UnimplementedOrderServiceServer
-	repo      OrderRepository
-	userConn  *grpc.ClientConn
-	userClient userv1.UserServiceClient
-	logger    *zap.Logger
+	repo        OrderRepository
+	catalog     ProductCatalog
+	payments    payment.Provider
+	userConn    *grpc.ClientConn
+	userClient  userv1.UserServiceClient
+	cursors     *pagination.Codec
+	idempotency IdempotencyConfig
+	inventory   InventoryConfig
+	paymentCfg  PaymentConfig
+	watch       WatchConfig
+	broker      *orderBroker
+	logger      *zap.Logger
 }
 
-func NewOrderHandler(repo OrderRepository, userConn *grpc.ClientConn, logger *zap.Logger) *OrderHandler {
+func NewOrderHandler(repo OrderRepository, catalog ProductCatalog, payments payment.Provider, userConn *grpc.ClientConn, cursors *pagination.Codec, idempotency IdempotencyConfig, inventory InventoryConfig, paymentCfg PaymentConfig, watch WatchConfig, logger *zap.Logger) *OrderHandler {
+	if idempotency.Retention <= 0 {
+		idempotency.Retention = 24 * time.Hour
+	}
+	if idempotency.SweepInterval <= 0 {
+		idempotency.SweepInterval = 10 * time.Minute
+	}
+	if inventory.ReservationTTL <= 0 {
+		inventory.ReservationTTL = 30 * time.Minute
+	}
+	if inventory.SweepInterval <= 0 {
+		inventory.SweepInterval = time.Minute
+	}
+	if paymentCfg.SweepInterval <= 0 {
+		paymentCfg.SweepInterval = time.Minute
+	}
+	if watch.ResyncInterval <= 0 {
+		watch.ResyncInterval = 30 * time.Second
+	}
+
+	// Changes made through the handler wake up the order's watchers
+	broker := newOrderBroker()
+
 	return &OrderHandler{
-		repo:       repo,
-		userConn:   userConn,
-		userClient: userv1.NewUserServiceClient(userConn),
-		logger:     logger,
+		repo:        &watchedRepository{OrderRepository: repo, broker: broker},
+		catalog:     catalog,
+		payments:    payments,
+		userConn:    userConn,
+		userClient:  userv1.NewUserServiceClient(userConn),
+		cursors:     cursors,
+		idempotency: idempotency,
+		inventory:   inventory,
+		paymentCfg:  paymentCfg,
+		watch:       watch,
+		broker:      broker,
+		logger:      logger,
 	}
 }
 
 func (h *OrderHandler) CreateOrder(ctx context.Context, req *orderv1.CreateOrderRequest) (*orderv1.CreateOrderResponse, error) {
+	if !canAccessUser(ctx, req.UserId) {
+		return nil, status.Error(codes.PermissionDenied, "cannot create orders for another user")
+	}
+	if req.GetShippingInfo() == nil {
+		return nil, status.Error(codes.InvalidArgument, "shipping_info is required")
+	}
+
+	// Retries with the same idempotency key get the original response
+	var idempotencyKey *IdempotencyKey
+	if req.IdempotencyKey != "" {
+		if len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+			return nil, status.Errorf(codes.InvalidArgument, "idempotency_key must be at most %d characters", maxIdempotencyKeyLength)
+		}
+
+		fingerprint, err := requestFingerprint(req)
+		if err != nil {
+			h.logger.Error("failed to fingerprint request", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to create order")
+		}
+
+		resp, ok, err := h.replayCreateOrder(ctx, req.UserId, req.IdempotencyKey, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return resp, nil
+		}
+
+		idempotencyKey = &IdempotencyKey{
+			UserID:      req.UserId,
+			Key:         req.IdempotencyKey,
+			Fingerprint: fingerprint,
+		}
+	}
+
 	// Validate user exists
 	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: req.UserId})
 	if err != nil {
@@ -122,15 +269,14 @@ func (h *OrderHandler) CreateOrder(ctx context.Context, req *orderv1.CreateOrder
 	order := &Order{
 		ID:     uuid.New().String(),
 		UserID: req.UserId,
-		Status: orderv1.OrderStatus_ORDER_STATUS_PENDING,
-		Items:  make([]OrderItem, len(req.Items)),
+		Status: lifecycle.Initial,
 		ShippingInfo: ShippingInfo{
-			AddressLine1: req.ShippingInfo.AddressLine1,
-			AddressLine2: req.ShippingInfo.AddressLine2,
-			City:         req.ShippingInfo.City,
-			State:        req.ShippingInfo.State,
-			Country:      req.ShippingInfo.Country,
-			PostalCode:   req.ShippingInfo.PostalCode,
+			AddressLine1: req.GetShippingInfo().GetAddressLine1(),
+			AddressLine2: req.GetShippingInfo().GetAddressLine2(),
+			City:         req.GetShippingInfo().GetCity(),
+			State:        req.GetShippingInfo().GetState(),
+			Country:      req.GetShippingInfo().GetCountry(),
+			PostalCode:   req.GetShippingInfo().GetPostalCode(),
 			Status:       orderv1.ShippingStatus_SHIPPING_STATUS_PENDING,
 		},
 		PaymentInfo: PaymentInfo{
@@ -140,28 +286,57 @@ func (h *OrderHandler) CreateOrder(ctx context.Context, req *orderv1.CreateOrder
 		},
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		Version:   1,
 	}
+	order.ReservedUntil = order.CreatedAt.Add(h.inventory.ReservationTTL)
 
-	var totalAmount float64
-	for i, item := range req.Items {
-		order.Items[i] = OrderItem{
-			ProductID:   item.ProductId,
-			Quantity:    item.Quantity,
-			UnitPrice:   item.UnitPrice,
-			ProductName: item.ProductName,
+	products, err := h.catalog.GetProducts(ctx, productIDs(req.Items))
+	if err != nil {
+		h.logger.Error("failed to look up products", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to look up products")
+	}
+
+	order.Items, order.TotalAmount, err = buildOrderItems(req.Items, products)
+	if err != nil {
+		return nil, err
+	}
+	order.PaymentInfo.Refunded = money.Zero(order.TotalAmount.Currency)
+
+	resp := &orderv1.CreateOrderResponse{
+		Order: convertToProtoOrder(order, user),
+	}
+
+	if idempotencyKey != nil {
+		idempotencyKey.OrderID = order.ID
+		idempotencyKey.CreatedAt = order.CreatedAt
+		idempotencyKey.ExpiresAt = order.CreatedAt.Add(h.idempotency.Retention)
+		idempotencyKey.Response, err = proto.Marshal(resp)
+		if err != nil {
+			h.logger.Error("failed to encode response", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to create order")
 		}
-		totalAmount += item.UnitPrice * float64(item.Quantity)
 	}
-	order.TotalAmount = totalAmount
 
-	if err := h.repo.CreateOrder(ctx, order); err != nil {
+	if err := h.repo.CreateOrder(ctx, order, idempotencyKey); err != nil {
+		if errors.Is(err, ErrIdempotencyKeyExists) {
+			// A concurrent request with the same key got there first
+			replayed, ok, err := h.replayCreateOrder(ctx, req.UserId, req.IdempotencyKey, idempotencyKey.Fingerprint)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return replayed, nil
+			}
+			return nil, status.Error(codes.Aborted, "concurrent request with the same idempotency key, retry")
+		}
+		if errors.Is(err, ErrInsufficientStock) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
 		h.logger.Error("failed to create order", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to create order")
 	}
 
-	return &orderv1.CreateOrderResponse{
-		Order: convertToProtoOrder(order, user),
-	}, nil
+	return resp, nil
 }
 
 func (h *OrderHandler) GetOrder(ctx context.Context, req *orderv1.GetOrderRequest) (*orderv1.GetOrderResponse, error) {
@@ -174,6 +349,10 @@ func (h *OrderHandler) GetOrder(ctx context.Context, req *orderv1.GetOrderReques
 		return nil, status.Error(codes.Internal, "failed to get order")
 	}
 
+	if !canAccessUser(ctx, order.UserID) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	}
+
 	// Get user details
 	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
 	if err != nil {
@@ -181,31 +360,72 @@ func (h *OrderHandler) GetOrder(ctx context.Context, req *orderv1.GetOrderReques
 		return nil, status.Error(codes.Internal, "failed to get user details")
 	}
 
-	return &orderv1.GetOrderResponse{
+	resp := &orderv1.GetOrderResponse{
 		Order: convertToProtoOrder(order, user),
-	}, nil
+	}
+
+	if includesHistory(req.ReadMask) {
+		history, err := h.repo.ListStatusHistory(ctx, req.OrderId)
+		if err != nil {
+			h.logger.Error("failed to get order history", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to get order history")
+		}
+		resp.History = convertToProtoHistory(history)
+	}
+
+	return resp, nil
 }
 
 func (h *OrderHandler) ListOrders(ctx context.Context, req *orderv1.ListOrdersRequest) (*orderv1.ListOrdersResponse, error) {
-	orders, nextPageToken, err := h.repo.ListOrders(ctx, req.UserId, req.Status, req.PageSize, req.PageToken)
+	if caller, ok := callerFromContext(ctx); ok && req.UserId == "" {
+		req.UserId = caller.UserID
+	}
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if !canAccessUser(ctx, req.UserId) {
+		return nil, status.Error(codes.PermissionDenied, "cannot list orders of another user")
+	}
+
+	filter, err := newOrderFilter(req.UserId, req.Status, req.Filter, req.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.listOrders(ctx, filter, req.PageSize, req.PageToken, req.SortOrder)
+}
+
+// listOrders returns one page of the orders matching filter
+func (h *OrderHandler) listOrders(ctx context.Context, filter OrderFilter, pageSize int32, pageToken string, sortOrder orderv1.SortOrder) (*orderv1.ListOrdersResponse, error) {
+	desc := sortOrder != orderv1.SortOrder_SORT_ORDER_ASC
+	page, err := h.cursors.Page(pageSize, pageToken, desc, filter.fingerprint())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	orders, hasMore, err := h.repo.ListOrders(ctx, filter, page)
 	if err != nil {
 		h.logger.Error("failed to list orders", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to list orders")
 	}
 
-	// Get user details if we have orders
-	var user *userv1.User
-	if len(orders) > 0 {
-		user, err = h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: orders[0].UserID})
+	var nextPageToken string
+	if hasMore {
+		nextPageToken, err = filter.nextToken(h.cursors, page, orders[len(orders)-1])
 		if err != nil {
-			h.logger.Error("failed to get user details", zap.Error(err))
-			return nil, status.Error(codes.Internal, "failed to get user details")
+			h.logger.Error("failed to encode page token", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to list orders")
 		}
 	}
 
+	users, err := h.getUsers(ctx, orders)
+	if err != nil {
+		return nil, err
+	}
+
 	protoOrders := make([]*orderv1.Order, len(orders))
 	for i, order := range orders {
-		protoOrders[i] = convertToProtoOrder(order, user)
+		protoOrders[i] = convertToProtoOrder(order, users[order.UserID])
 	}
 
 	return &orderv1.ListOrdersResponse{
@@ -215,6 +435,10 @@ func (h *OrderHandler) ListOrders(ctx context.Context, req *orderv1.ListOrdersRe
 }
 
 func (h *OrderHandler) UpdateOrderStatus(ctx context.Context, req *orderv1.UpdateOrderStatusRequest) (*orderv1.UpdateOrderStatusResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
 	order, err := h.repo.GetOrder(ctx, req.OrderId)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -224,13 +448,28 @@ func (h *OrderHandler) UpdateOrderStatus(ctx context.Context, req *orderv1.Updat
 		return nil, status.Error(codes.Internal, "failed to get order")
 	}
 
-	if err := h.repo.UpdateOrderStatus(ctx, req.OrderId, req.Status); err != nil {
-		h.logger.Error("failed to update order status", zap.Error(err))
-		return nil, status.Error(codes.Internal, "failed to update order status")
+	t := Transition{
+		To:              req.Status,
+		ExpectedVersion: req.ExpectedVersion,
+		Actor:           actorFromContext(ctx),
+		Reason:          req.Reason,
 	}
 
-	order.Status = req.Status
-	order.UpdatedAt = time.Now()
+	// Cancelling also has to compensate payment and shipping
+	if req.Status == orderv1.OrderStatus_ORDER_STATUS_CANCELLED {
+		err = h.cancelOrder(ctx, order, t)
+	} else {
+		err = h.repo.UpdateOrderStatus(ctx, req.OrderId, t)
+	}
+	if err != nil {
+		return nil, h.statusChangeError(err, "update order status")
+	}
+
+	order, err = h.repo.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
 
 	// Get user details
 	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
@@ -244,60 +483,225 @@ func (h *OrderHandler) UpdateOrderStatus(ctx context.Context, req *orderv1.Updat
 	}, nil
 }
 
+func (h *OrderHandler) CancelOrder(ctx context.Context, req *orderv1.CancelOrderRequest) (*orderv1.CancelOrderResponse, error) {
+	order, err := h.repo.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "order not found")
+		}
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	if !canAccessUser(ctx, order.UserID) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	}
+
+	t := Transition{
+		To:              orderv1.OrderStatus_ORDER_STATUS_CANCELLED,
+		ExpectedVersion: req.ExpectedVersion,
+		Actor:           actorFromContext(ctx),
+		Reason:          req.Reason,
+	}
+
+	if err := h.cancelOrder(ctx, order, t); err != nil {
+		return nil, h.statusChangeError(err, "cancel order")
+	}
+
+	order, err = h.repo.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.CancelOrderResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+// cancelOrder cancels the order, then returns its payment. The money is only
+// returned once the cancellation is committed; a provider failure leaves the
+// return pending for WatchPaymentReturns rather than failing the call.
+func (h *OrderHandler) cancelOrder(ctx context.Context, order *Order, t Transition) error {
+	if err := h.repo.CancelOrder(ctx, order.ID, t); err != nil {
+		return err
+	}
+
+	if err := h.returnPayment(ctx, order); err != nil {
+		h.logger.Warn("payment of cancelled order not returned yet", zap.String("order_id", order.ID), zap.Error(err))
+	}
+	return nil
+}
+
+// buildOrderItems prices the requested items from the catalog and sums the
+// order total exactly. A unit price sent by the client is only checked
+// against the catalog, so callers can refuse to pay a price that changed.
+func buildOrderItems(reqItems []*orderv1.OrderItem, products map[string]*Product) ([]OrderItem, money.Money, error) {
+	if len(reqItems) == 0 {
+		return nil, money.Money{}, status.Error(codes.InvalidArgument, "order must contain at least one item")
+	}
+
+	items := make([]OrderItem, len(reqItems))
+	var total money.Money
+	for i, item := range reqItems {
+		if item.Quantity <= 0 {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d].quantity must be positive", i)
+		}
+
+		product, ok := products[item.ProductId]
+		if !ok {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d]: unknown product %q", i, item.ProductId)
+		}
+		if !product.Active {
+			return nil, money.Money{}, status.Errorf(codes.FailedPrecondition, "items[%d]: product %q is not available", i, item.ProductId)
+		}
+
+		price := product.Price
+		if price.Minor <= 0 {
+			return nil, money.Money{}, status.Errorf(codes.FailedPrecondition, "items[%d]: product %q has no price", i, item.ProductId)
+		}
+		if item.Price != nil {
+			expected, err := money.FromProto(item.Price)
+			if err != nil {
+				return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d].price: %v", i, err)
+			}
+			if expected != price {
+				return nil, money.Money{}, status.Errorf(codes.FailedPrecondition,
+					"items[%d]: price of product %q is %s %s", i, item.ProductId, price, price.Currency)
+			}
+		}
+
+		if i == 0 {
+			total = money.Zero(price.Currency)
+		}
+		if price.Currency != total.Currency {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d]: all items must be priced in %s", i, total.Currency)
+		}
+
+		line, err := price.Mul(int64(item.Quantity))
+		if err != nil {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d]: %v", i, err)
+		}
+		if total, err = total.Add(line); err != nil {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "order total: %v", err)
+		}
+
+		// Snapshot the catalog entry so later price changes do not alter
+		// the order
+		items[i] = OrderItem{
+			ProductID:   product.ID,
+			Quantity:    item.Quantity,
+			UnitPrice:   price,
+			ProductName: product.Name,
+		}
+	}
+
+	return items, total, nil
+}
+
+// productIDs returns the distinct product ids of the requested items
+func productIDs(items []*orderv1.OrderItem) []string {
+	seen := make(map[string]bool, len(items))
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		if !seen[item.ProductId] {
+			seen[item.ProductId] = true
+			ids = append(ids, item.ProductId)
+		}
+	}
+	return ids
+}
+
 func convertToProtoOrder(order *Order, user *userv1.User) *orderv1.Order {
 	items := make([]*orderv1.OrderItem, len(order.Items))
 	for i, item := range order.Items {
 		items[i] = &orderv1.OrderItem{
 			ProductId:   item.ProductID,
 			Quantity:    item.Quantity,
-			UnitPrice:   item.UnitPrice,
+			Price:       money.ToProto(item.UnitPrice),
 			ProductName: item.ProductName,
 		}
 	}
 
-	return &orderv1.Order{
+	protoOrder := &orderv1.Order{
 		Id:          order.ID,
 		UserId:      order.UserID,
 		Items:       items,
-		TotalAmount: order.TotalAmount,
+		Total:       money.ToProto(order.TotalAmount),
 		Status:      order.Status,
 		User:        user,
 		CreatedAt:   timestamppb.New(order.CreatedAt),
 		UpdatedAt:   timestamppb.New(order.UpdatedAt),
 		PaymentInfo: &orderv1.PaymentInfo{
-			PaymentId:   order.PaymentInfo.PaymentID,
-			Status:      order.PaymentInfo.Status,
-			Method:      order.PaymentInfo.Method,
-			ProcessedAt: timestamppb.New(order.PaymentInfo.ProcessedAt),
+			PaymentId:         order.PaymentInfo.PaymentID,
+			Status:            order.PaymentInfo.Status,
+			Method:            order.PaymentInfo.Method,
+			ProviderReference: order.PaymentInfo.Reference,
+			Refunded:          money.ToProto(order.PaymentInfo.Refunded),
 		},
 		ShippingInfo: &orderv1.ShippingInfo{
-			AddressLine1: order.ShippingInfo.AddressLine1,
-			AddressLine2: order.ShippingInfo.AddressLine2,
-			City:         order.ShippingInfo.City,
-			State:        order.ShippingInfo.State,
-			Country:      order.ShippingInfo.Country,
-			PostalCode:   order.ShippingInfo.PostalCode,
+			AddressLine1:   order.ShippingInfo.AddressLine1,
+			AddressLine2:   order.ShippingInfo.AddressLine2,
+			City:           order.ShippingInfo.City,
+			State:          order.ShippingInfo.State,
+			Country:        order.ShippingInfo.Country,
+			PostalCode:     order.ShippingInfo.PostalCode,
+			Status:         order.ShippingInfo.Status,
+			Carrier:        order.ShippingInfo.Carrier,
+			TrackingNumber: order.ShippingInfo.TrackingNumber,
 		},
+		CancelReason: order.CancelReason,
+		Version:      order.Version,
+	}
+
+	if order.PaymentInfo.ProcessedAt.Valid {
+		protoOrder.PaymentInfo.ProcessedAt = timestamppb.New(order.PaymentInfo.ProcessedAt.Time)
+	}
+	if order.ShippingInfo.ShippedAt.Valid {
+		protoOrder.ShippingInfo.ShippedAt = timestamppb.New(order.ShippingInfo.ShippedAt.Time)
+	}
+	if order.ShippingInfo.DeliveredAt.Valid {
+		protoOrder.ShippingInfo.DeliveredAt = timestamppb.New(order.ShippingInfo.DeliveredAt.Time)
 	}
+	if order.CancelledAt.Valid {
+		protoOrder.CancelledAt = timestamppb.New(order.CancelledAt.Time)
+	}
+
+	return protoOrder
 }
 
-func (r *orderRepository) CreateOrder(ctx context.Context, order *Order) error {
+func (r *orderRepository) CreateOrder(ctx context.Context, order *Order, key *IdempotencyKey) error {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
+	if key != nil {
+		if err := insertIdempotencyKey(ctx, tx, key); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	// Insert order
 	query := `
-		INSERT INTO orders (id, user_id, status, total_amount, created_at, updated_at)
-		VALUES (?, ?, ?, ?, NOW(), NOW())
+		INSERT INTO orders (id, user_id, status, currency, total_amount, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NOW(), NOW())
 	`
 	
 	_, err = tx.ExecContext(ctx, query,
 		order.ID,
 		order.UserID,
 		order.Status,
-		order.TotalAmount,
+		order.TotalAmount.Currency,
+		order.TotalAmount.String(),
 	)
 	
 	if err != nil {
@@ -317,7 +721,7 @@ func (r *orderRepository) CreateOrder(ctx context.Context, order *Order) error {
 			order.ID,
 			item.ProductID,
 			item.Quantity,
-			item.UnitPrice,
+			item.UnitPrice.String(),
 			item.ProductName,
 		)
 		
@@ -327,10 +731,15 @@ func (r *orderRepository) CreateOrder(ctx context.Context, order *Order) error {
 		}
 	}
 
+	if err := reserveStock(ctx, tx, order); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	// Insert payment info
 	paymentQuery := `
-		INSERT INTO payment_info (id, order_id, payment_id, status, method, processed_at)
-		VALUES (?, ?, ?, ?, ?, NOW())
+		INSERT INTO payment_info (id, order_id, payment_id, status, method)
+		VALUES (?, ?, ?, ?, ?)
 	`
 	
 	_, err = tx.ExecContext(ctx, paymentQuery,
@@ -369,30 +778,50 @@ func (r *orderRepository) CreateOrder(ctx context.Context, order *Order) error {
 		return err
 	}
 
+	event, err := orderCreatedEvent(order)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := insertEvent(ctx, tx, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	return tx.Commit()
 }
 
 func (r *orderRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
 	query := `
-		SELECT o.id, o.user_id, o.status, o.total_amount, o.created_at, o.updated_at
+		SELECT o.id, o.user_id, o.status, o.currency, o.total_amount, o.created_at, o.updated_at,
+			COALESCE(o.cancel_reason, ''), o.cancelled_at, o.version
 		FROM orders o
 		WHERE o.id = ?
 	`
 	
 	order := &Order{}
+	var total string
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&order.ID,
 		&order.UserID,
 		&order.Status,
-		&order.TotalAmount,
+		&order.TotalAmount.Currency,
+		&total,
 		&order.CreatedAt,
 		&order.UpdatedAt,
+		&order.CancelReason,
+		&order.CancelledAt,
+		&order.Version,
 	)
 	
 	if err != nil {
 		return nil, err
 	}
 
+	if order.TotalAmount, err = money.Parse(order.TotalAmount.Currency, total); err != nil {
+		return nil, fmt.Errorf("failed to parse total of order %s: %w", order.ID, err)
+	}
+
 	// Get order items
 	itemsQuery := `
 		SELECT id, product_id, quantity, unit_price, product_name
@@ -408,22 +837,27 @@ func (r *orderRepository) GetOrder(ctx context.Context, id string) (*Order, erro
 
 	for rows.Next() {
 		item := OrderItem{OrderID: id}
+		var price string
 		err := rows.Scan(
 			&item.ID,
 			&item.ProductID,
 			&item.Quantity,
-			&item.UnitPrice,
+			&price,
 			&item.ProductName,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if item.UnitPrice, err = money.Parse(order.TotalAmount.Currency, price); err != nil {
+			return nil, fmt.Errorf("failed to parse price of item %s: %w", item.ID, err)
+		}
 		order.Items = append(order.Items, item)
 	}
 
 	// Get payment info
+	var refunded string
 	paymentQuery := `
-		SELECT payment_id, status, method, processed_at
+		SELECT payment_id, status, method, COALESCE(provider_ref, ''), processed_at, refunded_amount
 		FROM payment_info
 		WHERE order_id = ?
 	`
@@ -432,16 +866,23 @@ func (r *orderRepository) GetOrder(ctx context.Context, id string) (*Order, erro
 		&order.PaymentInfo.PaymentID,
 		&order.PaymentInfo.Status,
 		&order.PaymentInfo.Method,
+		&order.PaymentInfo.Reference,
 		&order.PaymentInfo.ProcessedAt,
+		&refunded,
 	)
 	
 	if err != nil {
 		return nil, err
 	}
 
+	if order.PaymentInfo.Refunded, err = money.Parse(order.TotalAmount.Currency, refunded); err != nil {
+		return nil, fmt.Errorf("failed to parse refunded amount of order %s: %w", order.ID, err)
+	}
+
 	// Get shipping info
 	shippingQuery := `
-		SELECT address_line1, address_line2, city, state, country, postal_code, status
+		SELECT address_line1, address_line2, city, state, country, postal_code, status,
+			COALESCE(carrier, ''), COALESCE(tracking_number, ''), shipped_at, delivered_at
 		FROM shipping_info
 		WHERE order_id = ?
 	`
@@ -454,6 +895,10 @@ func (r *orderRepository) GetOrder(ctx context.Context, id string) (*Order, erro
 		&order.ShippingInfo.Country,
 		&order.ShippingInfo.PostalCode,
 		&order.ShippingInfo.Status,
+		&order.ShippingInfo.Carrier,
+		&order.ShippingInfo.TrackingNumber,
+		&order.ShippingInfo.ShippedAt,
+		&order.ShippingInfo.DeliveredAt,
 	)
 	
 	if err != nil {
@@ -463,131 +908,316 @@ func (r *orderRepository) GetOrder(ctx context.Context, id string) (*Order, erro
 	return order, nil
 }
 
-func (r *orderRepository) ListOrders(ctx context.Context, userID string, status orderv1.OrderStatus, pageSize int32, pageToken string) ([]*Order, string, error) {
+// ListOrders returns a page of the orders matching filter. Every value is
+// passed as a bind parameter; only fixed column names go into the SQL.
+func (r *orderRepository) ListOrders(ctx context.Context, filter OrderFilter, page pagination.Page) ([]*Order, bool, error) {
 	query := `
-		SELECT o.id, o.user_id, o.status, o.total_amount, o.created_at, o.updated_at
+		SELECT o.id, o.user_id, o.status, o.currency, o.total_amount, o.created_at, o.updated_at,
+			COALESCE(o.cancel_reason, ''), o.cancelled_at, o.version
 		FROM orders o
-		WHERE o.user_id = ? AND o.status = ?
-		ORDER BY o.created_at DESC
-		LIMIT ? OFFSET ?
 	`
-	
-	rows, err := r.db.QueryContext(ctx, query, userID, status, pageSize, pageSize*int32(len(pageToken)))
+	conds, args := filter.where()
+
+	cond, condArgs, orderBy := filter.keyset(page)
+	if cond != "" {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY " + orderBy + " LIMIT ?"
+	args = append(args, page.Limit())
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, "", err
+		return nil, false, err
 	}
 	defer rows.Close()
 
+	orders, err := scanOrders(rows)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(orders) > int(page.Size)
+	if hasMore {
+		orders = orders[:page.Size]
+	}
+
+	if err := r.loadChildren(ctx, orders); err != nil {
+		return nil, false, err
+	}
+
+	return orders, hasMore, nil
+}
+
+// scanOrders reads the rows of a query selecting the orders columns in the
+// order GetOrder does
+func scanOrders(rows *sql.Rows) ([]*Order, error) {
 	var orders []*Order
 	for rows.Next() {
 		order := &Order{}
+		var total string
 		err := rows.Scan(
 			&order.ID,
 			&order.UserID,
 			&order.Status,
-			&order.TotalAmount,
+			&order.TotalAmount.Currency,
+			&total,
 			&order.CreatedAt,
 			&order.UpdatedAt,
+			&order.CancelReason,
+			&order.CancelledAt,
+			&order.Version,
 		)
 		if err != nil {
-			return nil, "", err
+			return nil, err
+		}
+		if order.TotalAmount, err = money.Parse(order.TotalAmount.Currency, total); err != nil {
+			return nil, fmt.Errorf("failed to parse total of order %s: %w", order.ID, err)
 		}
 		orders = append(orders, order)
 	}
 
-	// Get order items
-	itemsQuery := `
-		SELECT id, product_id, quantity, unit_price, product_name
+	return orders, rows.Err()
+}
+
+// loadChildren fills in items, payment and shipping info for a page of orders
+// with one query per table regardless of the page size
+func (r *orderRepository) loadChildren(ctx context.Context, orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*Order, len(orders))
+	ids := make([]interface{}, len(orders))
+	for i, order := range orders {
+		byID[order.ID] = order
+		ids[i] = order.ID
+	}
+	in := placeholders(len(ids))
+
+	if err := r.loadItems(ctx, byID, in, ids); err != nil {
+		return fmt.Errorf("failed to load order items: %w", err)
+	}
+	if err := r.loadPaymentInfo(ctx, byID, in, ids); err != nil {
+		return fmt.Errorf("failed to load payment info: %w", err)
+	}
+	if err := r.loadShippingInfo(ctx, byID, in, ids); err != nil {
+		return fmt.Errorf("failed to load shipping info: %w", err)
+	}
+
+	return nil
+}
+
+func (r *orderRepository) loadItems(ctx context.Context, byID map[string]*Order, in string, ids []interface{}) error {
+	query := `
+		SELECT id, order_id, product_id, quantity, unit_price, product_name
 		FROM order_items
-		WHERE order_id = ?
+		WHERE order_id IN (` + in + `)
+		ORDER BY order_id, id
 	`
-	
-	for _, order := range orders {
-		rows, err := r.db.QueryContext(ctx, itemsQuery, order.ID)
+
+	rows, err := r.db.QueryContext(ctx, query, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item OrderItem
+		var price string
+		err := rows.Scan(
+			&item.ID,
+			&item.OrderID,
+			&item.ProductID,
+			&item.Quantity,
+			&price,
+			&item.ProductName,
+		)
 		if err != nil {
-			return nil, "", err
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			item := OrderItem{OrderID: order.ID}
-			err := rows.Scan(
-				&item.ID,
-				&item.ProductID,
-				&item.Quantity,
-				&item.UnitPrice,
-				&item.ProductName,
-			)
-			if err != nil {
-				return nil, "", err
-			}
-			order.Items = append(order.Items, item)
+			return err
+		}
+		order, ok := byID[item.OrderID]
+		if !ok {
+			continue
 		}
+		// Items are always in the order's currency
+		if item.UnitPrice, err = money.Parse(order.TotalAmount.Currency, price); err != nil {
+			return fmt.Errorf("failed to parse price of item %s: %w", item.ID, err)
+		}
+		order.Items = append(order.Items, item)
 	}
 
-	// Get payment info
-	paymentQuery := `
-		SELECT payment_id, status, method, processed_at
+	return rows.Err()
+}
+
+func (r *orderRepository) loadPaymentInfo(ctx context.Context, byID map[string]*Order, in string, ids []interface{}) error {
+	query := `
+		SELECT order_id, payment_id, status, method, COALESCE(provider_ref, ''), processed_at, refunded_amount
 		FROM payment_info
-		WHERE order_id = ?
+		WHERE order_id IN (` + in + `)
 	`
-	
-	for _, order := range orders {
-		err = r.db.QueryRowContext(ctx, paymentQuery, order.ID).Scan(
-			&order.PaymentInfo.PaymentID,
-			&order.PaymentInfo.Status,
-			&order.PaymentInfo.Method,
-			&order.PaymentInfo.ProcessedAt,
+
+	rows, err := r.db.QueryContext(ctx, query, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID, refunded string
+		var info PaymentInfo
+		err := rows.Scan(
+			&orderID,
+			&info.PaymentID,
+			&info.Status,
+			&info.Method,
+			&info.Reference,
+			&info.ProcessedAt,
+			&refunded,
 		)
 		if err != nil {
-			return nil, "", err
+			return err
+		}
+		if order, ok := byID[orderID]; ok {
+			if info.Refunded, err = money.Parse(order.TotalAmount.Currency, refunded); err != nil {
+				return fmt.Errorf("failed to parse refunded amount of order %s: %w", orderID, err)
+			}
+			order.PaymentInfo = info
 		}
 	}
 
-	// Get shipping info
-	shippingQuery := `
-		SELECT address_line1, address_line2, city, state, country, postal_code, status
+	return rows.Err()
+}
+
+func (r *orderRepository) loadShippingInfo(ctx context.Context, byID map[string]*Order, in string, ids []interface{}) error {
+	query := `
+		SELECT order_id, address_line1, address_line2, city, state, country, postal_code, status,
+			COALESCE(carrier, ''), COALESCE(tracking_number, ''), shipped_at, delivered_at
 		FROM shipping_info
-		WHERE order_id = ?
+		WHERE order_id IN (` + in + `)
 	`
-	
-	for _, order := range orders {
-		err = r.db.QueryRowContext(ctx, shippingQuery, order.ID).Scan(
-			&order.ShippingInfo.AddressLine1,
-			&order.ShippingInfo.AddressLine2,
-			&order.ShippingInfo.City,
-			&order.ShippingInfo.State,
-			&order.ShippingInfo.Country,
-			&order.ShippingInfo.PostalCode,
-			&order.ShippingInfo.Status,
+
+	rows, err := r.db.QueryContext(ctx, query, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID string
+		var info ShippingInfo
+		err := rows.Scan(
+			&orderID,
+			&info.AddressLine1,
+			&info.AddressLine2,
+			&info.City,
+			&info.State,
+			&info.Country,
+			&info.PostalCode,
+			&info.Status,
+			&info.Carrier,
+			&info.TrackingNumber,
+			&info.ShippedAt,
+			&info.DeliveredAt,
 		)
 		if err != nil {
-			return nil, "", err
+			return err
+		}
+		if order, ok := byID[orderID]; ok {
+			order.ShippingInfo = info
 		}
 	}
 
-	return orders, "", nil
+	return rows.Err()
 }
 
-func (r *orderRepository) UpdateOrderStatus(ctx context.Context, id string, status orderv1.OrderStatus) error {
-	query := `
-		UPDATE orders
-		SET status = ?, updated_at = NOW()
-		WHERE id = ?
-	`
-	
-	result, err := r.db.ExecContext(ctx, query, status, id)
+// placeholders returns n comma separated bind parameters for an IN clause
+func placeholders(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strings.Repeat("?, ", n-1) + "?"
+}
+
+func (r *orderRepository) UpdateOrderStatus(ctx context.Context, id string, t Transition) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if _, err := transitionStatus(ctx, tx, id, t); err != nil {
+		return err
+	}
 
-	rows, err := result.RowsAffected()
+	return tx.Commit()
+}
+
+// CancelOrder cancels the order and its pending shipping in one transaction.
+// The payment is left as it is; the caller returns it through the provider
+// afterwards. It returns ErrOrderShipped once the parcel has left and a
+// *lifecycle.TransitionError when the order status does not allow
+// cancellation.
+func (r *orderRepository) CancelOrder(ctx context.Context, id string, t Transition) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if err := markCancelled(ctx, tx, id, t); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// markCancelled cancels the order and its pending shipping within tx
+func markCancelled(ctx context.Context, tx *sql.Tx, id string, t Transition) error {
+	query := `
+		SELECT s.status
+		FROM orders o
+		JOIN shipping_info s ON s.order_id = o.id
+		WHERE o.id = ?
+		FOR UPDATE
+	`
+
+	var shippingStatus orderv1.ShippingStatus
+	if err := tx.QueryRowContext(ctx, query, id).Scan(&shippingStatus); err != nil {
+		return err
+	}
+
+	if hasShipped(shippingStatus) {
+		return ErrOrderShipped
+	}
+
+	t.To = orderv1.OrderStatus_ORDER_STATUS_CANCELLED
+	if _, err := transitionStatus(ctx, tx, id, t); err != nil {
+		return err
+	}
+
+	orderQuery := `
+		UPDATE orders
+		SET cancel_reason = ?, cancelled_at = NOW()
+		WHERE id = ?
+	`
+
+	if _, err := tx.ExecContext(ctx, orderQuery, t.Reason, id); err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
 
-	if rows == 0 {
-		return sql.ErrNoRows
+	shippingQuery := `
+		UPDATE shipping_info
+		SET status = ?
+		WHERE order_id = ?
+	`
+
+	_, err := tx.ExecContext(ctx, shippingQuery, orderv1.ShippingStatus_SHIPPING_STATUS_CANCELLED, id)
+	if err != nil {
+		return fmt.Errorf("failed to cancel shipping: %w", err)
 	}
 
 	return nil
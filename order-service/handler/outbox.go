@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/zabilal/microservices/order-service/outbox"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// maxEventErrorLength fits order_events.last_error
+const maxEventErrorLength = 500
+
+// insertEvent adds an event to the outbox within tx. It locks the order row
+// first, so the events of an order get their sequence numbers in the order
+// their transactions commit.
+func insertEvent(ctx context.Context, tx *sql.Tx, event outbox.Event) error {
+	var id string
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM orders WHERE id = ? FOR UPDATE", event.OrderID).Scan(&id); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO order_events (id, order_id, type, payload, created_at, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := tx.ExecContext(ctx, query, event.ID, event.OrderID, event.Type, string(event.Payload), event.CreatedAt, event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record %s event: %w", event.Type, err)
+	}
+	return nil
+}
+
+func orderCreatedEvent(order *Order) (outbox.Event, error) {
+	items := make([]outbox.OrderItem, len(order.Items))
+	for i, item := range order.Items {
+		items[i] = outbox.OrderItem{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice.String(),
+		}
+	}
+
+	return outbox.New(order.ID, outbox.TypeOrderCreated, outbox.OrderCreated{
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		Status:    order.Status.String(),
+		Currency:  order.TotalAmount.Currency,
+		Total:     order.TotalAmount.String(),
+		Items:     items,
+		CreatedAt: order.CreatedAt,
+	})
+}
+
+func statusChangedEvent(orderID string, from orderv1.OrderStatus, version int64, t Transition) (outbox.Event, error) {
+	return outbox.New(orderID, outbox.TypeOrderStatusChanged, outbox.OrderStatusChanged{
+		OrderID: orderID,
+		From:    from.String(),
+		To:      t.To.String(),
+		Version: version,
+		Actor:   t.Actor,
+		Reason:  t.Reason,
+	})
+}
+
+func paymentChangedEvent(orderID string, u PaymentUpdate) (outbox.Event, error) {
+	changed := outbox.PaymentStatusChanged{
+		OrderID:   orderID,
+		From:      u.From.String(),
+		To:        u.To.String(),
+		Reference: u.Reference,
+	}
+	if !u.Refunded.IsZero() {
+		changed.Currency = u.Refunded.Currency
+		changed.Refunded = u.Refunded.String()
+	}
+	return outbox.New(orderID, outbox.TypePaymentStatusChanged, changed)
+}
+
+// PendingEvents implements outbox.Store. An event is skipped while it, or an
+// earlier unpublished event of its order, waits for a retry.
+func (r *orderRepository) PendingEvents(ctx context.Context, now time.Time, after int64, limit int) ([]outbox.Event, error) {
+	query := `
+		SELECT e.seq, e.id, e.order_id, e.type, e.payload, e.created_at, e.attempts
+		FROM order_events e
+		WHERE e.published_at IS NULL AND e.seq > ?
+			AND NOT EXISTS (
+				SELECT 1 FROM order_events w
+				WHERE w.order_id = e.order_id AND w.published_at IS NULL
+					AND w.seq <= e.seq AND w.next_attempt_at > ?
+			)
+		ORDER BY e.seq
+		LIMIT ?
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, after, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []outbox.Event
+	for rows.Next() {
+		var (
+			event   outbox.Event
+			payload []byte
+		)
+		if err := rows.Scan(&event.Seq, &event.ID, &event.OrderID, &event.Type, &payload, &event.CreatedAt, &event.Attempts); err != nil {
+			return nil, err
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r *orderRepository) MarkEventPublished(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE order_events SET published_at = NOW(6) WHERE id = ?", id)
+	return err
+}
+
+func (r *orderRepository) MarkEventFailed(ctx context.Context, id string, retryAt time.Time, cause string) error {
+	if len(cause) > maxEventErrorLength {
+		cause = cause[:maxEventErrorLength]
+	}
+
+	query := `
+		UPDATE order_events
+		SET attempts = attempts + 1, next_attempt_at = ?, last_error = ?
+		WHERE id = ?
+	`
+
+	_, err := r.db.ExecContext(ctx, query, retryAt, cause, id)
+	return err
+}
+
+func (r *orderRepository) DeletePublishedEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM order_events WHERE published_at < ? LIMIT ?", before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,489 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	"github.com/zabilal/microservices/order-service/payment"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+const paymentSweepBatch = 100
+
+// PaymentConfig controls how often the payments of cancelled orders that
+// could not be returned at cancellation are retried
+type PaymentConfig struct {
+	SweepInterval time.Duration
+}
+
+// ErrPaymentConflict means the payment status changed between reading it and
+// recording a provider result
+var ErrPaymentConflict = errors.New("payment status changed concurrently")
+
+// PaymentUpdate records the outcome of a provider call
+type PaymentUpdate struct {
+	// From is the payment status the call was made in; the update fails with
+	// ErrPaymentConflict if it changed since
+	From      orderv1.PaymentStatus
+	To        orderv1.PaymentStatus
+	Reference string
+	// ProcessedAt is when the provider made the change; zero means now
+	ProcessedAt time.Time
+	// Refunded is added to the amount refunded so far
+	Refunded money.Money
+	// Order optionally changes the order status in the same transaction
+	Order *Transition
+}
+
+func (h *OrderHandler) AuthorizePayment(ctx context.Context, req *orderv1.AuthorizePaymentRequest) (*orderv1.AuthorizePaymentResponse, error) {
+	order, err := h.orderForUpdate(ctx, req.OrderId, req.ExpectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPaymentTransition(order, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED); err != nil {
+		return nil, err
+	}
+	if err := lifecycle.Check(order.Status, orderv1.OrderStatus_ORDER_STATUS_PROCESSING); err != nil {
+		return nil, status.Convert(err).Err()
+	}
+
+	result, err := h.payments.Authorize(ctx, payment.AuthorizeRequest{
+		OrderID:   order.ID,
+		PaymentID: order.PaymentInfo.PaymentID,
+		Amount:    order.TotalAmount,
+		Method:    order.PaymentInfo.Method,
+	})
+	if err != nil {
+		return nil, h.paymentFailed(ctx, order, err, "authorize payment")
+	}
+
+	// A successful authorization starts fulfilment
+	update := PaymentUpdate{
+		From:      order.PaymentInfo.Status,
+		To:        orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED,
+		Reference: result.Reference,
+		Order: &Transition{
+			To:              orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+			ExpectedVersion: order.Version,
+			Actor:           actorFromContext(ctx),
+			Reason:          "payment authorized",
+		},
+	}
+
+	recorded, err := h.recordPayment(ctx, order, update)
+	if err != nil {
+		h.releaseAuthorization(ctx, order.ID, result.Reference)
+		return nil, err
+	}
+	order = recorded
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.AuthorizePaymentResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+func (h *OrderHandler) CapturePayment(ctx context.Context, req *orderv1.CapturePaymentRequest) (*orderv1.CapturePaymentResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := h.orderForUpdate(ctx, req.OrderId, req.ExpectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPaymentTransition(order, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED); err != nil {
+		return nil, err
+	}
+
+	result, err := h.payments.Capture(ctx, order.PaymentInfo.Reference, order.TotalAmount)
+	if err != nil {
+		return nil, h.paymentFailed(ctx, order, err, "capture payment")
+	}
+
+	order, err = h.recordPayment(ctx, order, PaymentUpdate{
+		From:      order.PaymentInfo.Status,
+		To:        orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+		Reference: result.Reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.CapturePaymentResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+func (h *OrderHandler) RefundPayment(ctx context.Context, req *orderv1.RefundPaymentRequest) (*orderv1.RefundPaymentResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := h.orderForUpdate(ctx, req.OrderId, req.ExpectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPaymentTransition(order, orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED); err != nil {
+		return nil, err
+	}
+	if err := lifecycle.Check(order.Status, orderv1.OrderStatus_ORDER_STATUS_REFUNDED); err != nil {
+		return nil, status.Convert(err).Err()
+	}
+
+	// Returns may already have refunded part of the order
+	remaining, err := order.TotalAmount.Sub(order.PaymentInfo.Refunded)
+	if err != nil {
+		h.logger.Error("failed to compute refund", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to refund payment")
+	}
+
+	result, err := h.payments.Refund(ctx, payment.RefundRequest{
+		Reference: order.PaymentInfo.Reference,
+		RefundID:  order.PaymentInfo.PaymentID,
+		Amount:    remaining,
+	})
+	if err != nil {
+		// A declined refund leaves the captured payment as it was
+		if errors.Is(err, payment.ErrDeclined) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		h.logger.Error("failed to refund payment", zap.Error(err))
+		return nil, status.Error(codes.Unavailable, "payment provider unavailable")
+	}
+
+	order, err = h.recordPayment(ctx, order, PaymentUpdate{
+		From:      order.PaymentInfo.Status,
+		To:        orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED,
+		Reference: result.Reference,
+		Refunded:  remaining,
+		Order: &Transition{
+			To:              orderv1.OrderStatus_ORDER_STATUS_REFUNDED,
+			ExpectedVersion: order.Version,
+			Actor:           actorFromContext(ctx),
+			Reason:          req.Reason,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.RefundPaymentResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+// orderForUpdate loads an order the caller may change, checking the version
+// the caller expects before anything is sent to the provider or carrier
+func (h *OrderHandler) orderForUpdate(ctx context.Context, id string, expectedVersion int64) (*Order, error) {
+	order, err := h.repo.GetOrder(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "order not found")
+		}
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	if !canAccessUser(ctx, order.UserID) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	}
+	if expectedVersion != 0 && order.Version != expectedVersion {
+		return nil, status.Error(codes.Aborted, "order was modified, reload it and retry")
+	}
+
+	return order, nil
+}
+
+func checkPaymentTransition(order *Order, to orderv1.PaymentStatus) error {
+	if !payment.CanTransition(order.PaymentInfo.Status, to) {
+		return status.Errorf(codes.FailedPrecondition, "cannot move payment from %s to %s", order.PaymentInfo.Status, to)
+	}
+	return nil
+}
+
+// paymentFailed handles a failed authorization or capture. A declined payment
+// fails the payment and the order; other errors leave both unchanged so the
+// call can be retried.
+func (h *OrderHandler) paymentFailed(ctx context.Context, order *Order, err error, action string) error {
+	if !errors.Is(err, payment.ErrDeclined) {
+		h.logger.Error("failed to "+action, zap.Error(err))
+		return status.Error(codes.Unavailable, "payment provider unavailable")
+	}
+
+	update := PaymentUpdate{
+		From: order.PaymentInfo.Status,
+		To:   orderv1.PaymentStatus_PAYMENT_STATUS_FAILED,
+	}
+	if lifecycle.CanTransition(order.Status, orderv1.OrderStatus_ORDER_STATUS_FAILED) {
+		update.Order = &Transition{
+			To:              orderv1.OrderStatus_ORDER_STATUS_FAILED,
+			ExpectedVersion: order.Version,
+			Actor:           actorFromContext(ctx),
+			Reason:          err.Error(),
+		}
+	}
+
+	if err := h.repo.UpdatePayment(ctx, order.ID, update); err != nil {
+		return h.paymentUpdateError(err, action)
+	}
+	return status.Error(codes.FailedPrecondition, err.Error())
+}
+
+// recordPayment stores a successful provider result and returns the updated
+// order
+func (h *OrderHandler) recordPayment(ctx context.Context, order *Order, update PaymentUpdate) (*Order, error) {
+	if err := h.repo.UpdatePayment(ctx, order.ID, update); err != nil {
+		// The provider call is idempotent, and authorizations that could not
+		// be recorded are released, so the caller can safely retry
+		return nil, h.paymentUpdateError(err, "record payment")
+	}
+
+	order, err := h.repo.GetOrder(ctx, order.ID)
+	if err != nil {
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	return order, nil
+}
+
+// releaseAuthorization voids an authorization that could not be recorded, so
+// the customer's funds are not held for an order that is still PENDING. The
+// provider returns the same reference to concurrent requests for one order,
+// so an authorization another request did record is kept.
+func (h *OrderHandler) releaseAuthorization(ctx context.Context, orderID, reference string) {
+	// The request may have failed because it was cancelled
+	ctx = context.WithoutCancel(ctx)
+
+	if order, err := h.repo.GetOrder(ctx, orderID); err == nil && order.PaymentInfo.Reference == reference {
+		return
+	}
+	if _, err := h.payments.Void(ctx, reference); err != nil {
+		h.logger.Error("failed to void unrecorded authorization", zap.String("order_id", orderID), zap.Error(err))
+	}
+}
+
+func (h *OrderHandler) paymentUpdateError(err error, action string) error {
+	if errors.Is(err, ErrPaymentConflict) {
+		return status.Error(codes.Aborted, "payment changed concurrently, retry")
+	}
+	return h.statusChangeError(err, action)
+}
+
+// returnPayment voids the authorized payment or refunds the captured payment
+// of a cancelled order and records the result. If the provider call fails the
+// payment stays AUTHORIZED or COMPLETED, which marks the return as pending
+// for WatchPaymentReturns.
+func (h *OrderHandler) returnPayment(ctx context.Context, order *Order) error {
+	update := PaymentUpdate{From: order.PaymentInfo.Status}
+
+	var (
+		result *payment.Result
+		err    error
+	)
+	switch order.PaymentInfo.Status {
+	case orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED:
+		update.To = orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED
+		result, err = h.payments.Void(ctx, order.PaymentInfo.Reference)
+	case orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED:
+		update.To = orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED
+		update.Refunded, err = order.TotalAmount.Sub(order.PaymentInfo.Refunded)
+		if err != nil {
+			return err
+		}
+		result, err = h.payments.Refund(ctx, payment.RefundRequest{
+			Reference: order.PaymentInfo.Reference,
+			RefundID:  order.PaymentInfo.PaymentID,
+			Amount:    update.Refunded,
+		})
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to return payment: %w", err)
+	}
+
+	update.Reference = result.Reference
+	return h.repo.UpdatePayment(ctx, order.ID, update)
+}
+
+// WatchPaymentReturns retries returning the payments of cancelled orders, and
+// the refunds of approved returns, until ctx is cancelled
+func (h *OrderHandler) WatchPaymentReturns(ctx context.Context) {
+	ticker := time.NewTicker(h.paymentCfg.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.sweepPaymentReturns(ctx)
+			h.sweepReturnRefunds(ctx)
+		}
+	}
+}
+
+// sweepPaymentReturns handles one batch per tick, so a payment the provider
+// keeps refusing does not stall the others
+func (h *OrderHandler) sweepPaymentReturns(ctx context.Context) {
+	ids, err := h.repo.ListPendingPaymentReturns(ctx, paymentSweepBatch)
+	if err != nil {
+		h.logger.Error("failed to list pending payment returns", zap.Error(err))
+		return
+	}
+
+	var returned int
+	for _, id := range ids {
+		order, err := h.repo.GetOrder(ctx, id)
+		if err != nil {
+			h.logger.Error("failed to get order", zap.String("order_id", id), zap.Error(err))
+			continue
+		}
+		if err := h.returnPayment(ctx, order); err != nil {
+			h.logger.Warn("payment of cancelled order not returned yet", zap.String("order_id", id), zap.Error(err))
+			continue
+		}
+		returned++
+	}
+
+	if returned > 0 {
+		h.logger.Info("returned payments of cancelled orders", zap.Int("count", returned))
+	}
+}
+
+// ListPendingPaymentReturns returns cancelled orders whose payment was not
+// voided or refunded yet
+func (r *orderRepository) ListPendingPaymentReturns(ctx context.Context, limit int) ([]string, error) {
+	query := `
+		SELECT o.id
+		FROM orders o
+		JOIN payment_info p ON p.order_id = o.id
+		WHERE o.status = ? AND p.status IN (?, ?)
+		LIMIT ?
+	`
+
+	rows, err := r.db.QueryContext(ctx, query,
+		orderv1.OrderStatus_ORDER_STATUS_CANCELLED,
+		orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED,
+		orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdatePayment changes the payment status, and the order status when asked,
+// in one transaction
+func (r *orderRepository) UpdatePayment(ctx context.Context, orderID string, u PaymentUpdate) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updatePayment(ctx, tx, orderID, u); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record payment: %w", err)
+	}
+	return nil
+}
+
+// updatePayment applies u within tx and adds a PaymentStatusChanged event to
+// the outbox. It fails with ErrPaymentConflict if the payment is no longer in
+// u.From.
+func updatePayment(ctx context.Context, tx *sql.Tx, orderID string, u PaymentUpdate) error {
+	processedAt := u.ProcessedAt
+	if processedAt.IsZero() {
+		processedAt = time.Now()
+	}
+
+	query := `
+		UPDATE payment_info
+		SET status = ?, provider_ref = COALESCE(NULLIF(?, ''), provider_ref), processed_at = ?,
+			refunded_amount = refunded_amount + ?
+		WHERE order_id = ? AND status = ?
+	`
+
+	result, err := tx.ExecContext(ctx, query, u.To, u.Reference, processedAt, u.Refunded.String(), orderID, u.From)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrPaymentConflict
+	}
+
+	event, err := paymentChangedEvent(orderID, u)
+	if err != nil {
+		return err
+	}
+	if err := insertEvent(ctx, tx, event); err != nil {
+		return err
+	}
+
+	if u.Order != nil {
+		if _, err := transitionStatus(ctx, tx, orderID, *u.Order); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// The payment is part of the order, so changing it alone still moves the
+	// order's version
+	_, err = tx.ExecContext(ctx, "UPDATE orders SET version = version + 1, updated_at = NOW() WHERE id = ?", orderID)
+	return err
+}
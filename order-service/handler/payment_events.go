@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	"github.com/zabilal/microservices/order-service/payment"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// ErrDuplicatePaymentEvent is returned by ApplyPaymentEvent for an event id
+// that was already recorded
+var ErrDuplicatePaymentEvent = errors.New("payment event already recorded")
+
+// paymentEventStatus is the payment status each provider event reports
+var paymentEventStatus = map[orderv1.PaymentEventType]orderv1.PaymentStatus{
+	orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_AUTHORIZED: orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED,
+	orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_CAPTURED:   orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+	orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_FAILED:     orderv1.PaymentStatus_PAYMENT_STATUS_FAILED,
+	orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_REFUNDED:   orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED,
+	orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_VOIDED:     orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED,
+}
+
+// paymentEventOrderStatus is the order status that follows a payment status,
+// the same way it does for the synchronous payment RPCs
+var paymentEventOrderStatus = map[orderv1.PaymentStatus]orderv1.OrderStatus{
+	orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED: orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+	orderv1.PaymentStatus_PAYMENT_STATUS_FAILED:     orderv1.OrderStatus_ORDER_STATUS_FAILED,
+	orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED:   orderv1.OrderStatus_ORDER_STATUS_REFUNDED,
+}
+
+// PaymentEvent is a payment result the provider reported asynchronously
+type PaymentEvent struct {
+	ID         string
+	OrderID    string
+	Type       orderv1.PaymentEventType
+	OccurredAt time.Time
+	// Applied is false for an event that arrived after the payment had
+	// already moved past it
+	Applied bool
+}
+
+func (h *OrderHandler) ApplyPaymentEvent(ctx context.Context, req *orderv1.ApplyPaymentEventRequest) (*orderv1.ApplyPaymentEventResponse, error) {
+	// Only the gateway, once it verified the webhook signature, reports
+	// payment results
+	if err := requireInternal(ctx); err != nil {
+		return nil, err
+	}
+	if req.EventId == "" {
+		return nil, status.Error(codes.InvalidArgument, "event_id is required")
+	}
+	to, ok := paymentEventStatus[req.Type]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "unknown event type")
+	}
+
+	order, err := h.repo.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "order not found")
+		}
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	reference := order.PaymentInfo.Reference
+	if reference != "" && req.ProviderReference != "" && reference != req.ProviderReference {
+		return nil, status.Error(codes.FailedPrecondition, "provider_reference does not match the order's payment")
+	}
+
+	event := PaymentEvent{
+		ID:      req.EventId,
+		OrderID: order.ID,
+		Type:    req.Type,
+	}
+	if req.OccurredAt != nil {
+		event.OccurredAt = req.OccurredAt.AsTime()
+	}
+
+	var update *PaymentUpdate
+	if payment.CanTransition(order.PaymentInfo.Status, to) {
+		event.Applied = true
+		update = &PaymentUpdate{
+			From:        order.PaymentInfo.Status,
+			To:          to,
+			Reference:   req.ProviderReference,
+			ProcessedAt: event.OccurredAt,
+		}
+		// The order follows when its lifecycle allows; a payment authorized
+		// after the order was cancelled is left for WatchPaymentReturns
+		if next, ok := paymentEventOrderStatus[to]; ok && lifecycle.CanTransition(order.Status, next) {
+			update.Order = &Transition{
+				To:              next,
+				ExpectedVersion: order.Version,
+				Actor:           actorSystem,
+				Reason:          paymentEventReason(req),
+			}
+		}
+	}
+
+	if err := h.repo.ApplyPaymentEvent(ctx, event, update); err != nil {
+		if errors.Is(err, ErrDuplicatePaymentEvent) {
+			return &orderv1.ApplyPaymentEventResponse{Duplicate: true}, nil
+		}
+		// Nothing was recorded, so the provider's retry is evaluated afresh
+		return nil, h.paymentUpdateError(err, "apply payment event")
+	}
+
+	return &orderv1.ApplyPaymentEventResponse{Applied: event.Applied}, nil
+}
+
+func paymentEventReason(req *orderv1.ApplyPaymentEventRequest) string {
+	if req.Reason != "" {
+		return req.Reason
+	}
+	return "payment " + req.Type.String()
+}
+
+// ApplyPaymentEvent records the event and, when u is not nil, applies the
+// payment update in the same transaction. It returns ErrDuplicatePaymentEvent
+// for an event id that was already recorded.
+func (r *orderRepository) ApplyPaymentEvent(ctx context.Context, event PaymentEvent, u *PaymentUpdate) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO payment_events (event_id, order_id, type, applied, occurred_at, received_at)
+		VALUES (?, ?, ?, ?, ?, NOW())
+	`
+
+	occurredAt := sql.NullTime{Time: event.OccurredAt, Valid: !event.OccurredAt.IsZero()}
+	_, err = tx.ExecContext(ctx, query, event.ID, event.OrderID, event.Type, event.Applied, occurredAt)
+	if err != nil {
+		// A concurrent delivery of the same event blocks on the primary key
+		// until this one commits, then lands here
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			return ErrDuplicatePaymentEvent
+		}
+		return fmt.Errorf("failed to record payment event: %w", err)
+	}
+
+	if u != nil {
+		if err := updatePayment(ctx, tx, event.OrderID, *u); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to record payment event: %w", err)
+	}
+	return nil
+}
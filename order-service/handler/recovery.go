@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errPanic is returned in place of a response when a handler panics
+var errPanic = status.Error(codes.Internal, "internal error")
+
+// RecoveryUnaryInterceptor turns a panic in a unary handler into an Internal
+// error so that one bad request cannot take the server down
+func RecoveryUnaryInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(logger, info.FullMethod, r)
+				resp, err = nil, errPanic
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// RecoveryStreamInterceptor is RecoveryUnaryInterceptor for streaming handlers
+func RecoveryStreamInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(logger, info.FullMethod, r)
+				err = errPanic
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+func logPanic(logger *zap.Logger, method string, r interface{}) {
+	logger.Error("handler panicked",
+		zap.String("method", method),
+		zap.Any("panic", r),
+		zap.ByteString("stack", debug.Stack()),
+	)
+}
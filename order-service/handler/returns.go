@@ -0,0 +1,914 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	"github.com/zabilal/microservices/order-service/payment"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/money"
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+var (
+	// ErrReturnQuantity means a return asks for more units of a product than
+	// were bought and are not already being returned
+	ErrReturnQuantity = errors.New("return exceeds the returnable quantity")
+	// ErrReturnConflict means the return was approved, rejected or refunded
+	// concurrently
+	ErrReturnConflict = errors.New("return was resolved concurrently")
+)
+
+// Return is a request to send back some of the items of a delivered order
+type Return struct {
+	ID      string
+	OrderID string
+	UserID  string
+	Status  orderv1.ReturnStatus
+	Items   []ReturnItem
+	Reason  string
+	// Refund is the sum of the items at the price they were bought at
+	Refund         money.Money
+	DecisionReason string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type ReturnItem struct {
+	ProductID string
+	Quantity  int32
+	UnitPrice money.Money
+}
+
+// ReturnDecision moves a return to another status
+type ReturnDecision struct {
+	To     orderv1.ReturnStatus
+	Actor  string
+	Reason string
+	// Reference is the provider reference of the refund of an approved return
+	Reference string
+}
+
+// ReturnFilter selects the returns of an order or, without OrderID, of a user
+type ReturnFilter struct {
+	OrderID string
+	UserID  string
+}
+
+func (h *OrderHandler) RequestReturn(ctx context.Context, req *orderv1.RequestReturnRequest) (*orderv1.RequestReturnResponse, error) {
+	order, err := h.repo.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "order not found")
+		}
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	if !canAccessUser(ctx, order.UserID) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	}
+	if order.ShippingInfo.Status != orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED {
+		return nil, status.Error(codes.FailedPrecondition, "only delivered orders can be returned")
+	}
+
+	items, refund, err := buildReturnItems(order, req.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ret := &Return{
+		ID:        uuid.New().String(),
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		Status:    orderv1.ReturnStatus_RETURN_STATUS_REQUESTED,
+		Items:     items,
+		Reason:    req.Reason,
+		Refund:    refund,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = h.repo.CreateReturn(ctx, ret, Transition{
+		To:     orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED,
+		Actor:  actorFromContext(ctx),
+		Reason: req.Reason,
+	})
+	if err != nil {
+		if errors.Is(err, ErrReturnQuantity) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, h.statusChangeError(err, "request return")
+	}
+
+	return &orderv1.RequestReturnResponse{
+		OrderReturn: convertToProtoReturn(ret),
+	}, nil
+}
+
+// buildReturnItems merges the requested items per product and prices them
+// from the order. Quantities are checked against what was bought; the
+// repository also subtracts what other returns already claim.
+func buildReturnItems(order *Order, requested []*orderv1.ReturnItem) ([]ReturnItem, money.Money, error) {
+	bought := make(map[string]int32)
+	prices := make(map[string]money.Money)
+	for _, item := range order.Items {
+		bought[item.ProductID] += item.Quantity
+		prices[item.ProductID] = item.UnitPrice
+	}
+
+	var items []ReturnItem
+	index := make(map[string]int)
+	for i, item := range requested {
+		price, ok := prices[item.ProductId]
+		if !ok {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d]: product %s is not part of the order", i, item.ProductId)
+		}
+		if item.Quantity <= 0 {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "items[%d]: quantity must be positive", i)
+		}
+
+		if j, ok := index[item.ProductId]; ok {
+			items[j].Quantity += item.Quantity
+		} else {
+			index[item.ProductId] = len(items)
+			items = append(items, ReturnItem{ProductID: item.ProductId, Quantity: item.Quantity, UnitPrice: price})
+		}
+	}
+	if len(items) == 0 {
+		return nil, money.Money{}, status.Error(codes.InvalidArgument, "items are required")
+	}
+
+	refund := money.Zero(order.TotalAmount.Currency)
+	for _, item := range items {
+		if item.Quantity > bought[item.ProductID] {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "only %d of product %s were bought", bought[item.ProductID], item.ProductID)
+		}
+		line, err := item.UnitPrice.Mul(int64(item.Quantity))
+		if err != nil {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "refund: %v", err)
+		}
+		if refund, err = refund.Add(line); err != nil {
+			return nil, money.Money{}, status.Errorf(codes.InvalidArgument, "refund: %v", err)
+		}
+	}
+
+	return items, refund, nil
+}
+
+func (h *OrderHandler) ListReturns(ctx context.Context, req *orderv1.ListReturnsRequest) (*orderv1.ListReturnsResponse, error) {
+	filter := ReturnFilter{OrderID: req.OrderId}
+	if req.OrderId != "" {
+		order, err := h.repo.GetOrder(ctx, req.OrderId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, status.Error(codes.NotFound, "order not found")
+			}
+			h.logger.Error("failed to get order", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to get order")
+		}
+		if !canAccessUser(ctx, order.UserID) {
+			return nil, status.Error(codes.NotFound, "order not found")
+		}
+	} else {
+		filter.UserID = req.UserId
+		if caller, ok := callerFromContext(ctx); ok && filter.UserID == "" {
+			filter.UserID = caller.UserID
+		}
+		if !canAccessUser(ctx, filter.UserID) {
+			return nil, status.Error(codes.PermissionDenied, "cannot list returns of another user")
+		}
+	}
+
+	// Returns are always listed newest first
+	pageFilter := pagination.Filter("returns", filter.OrderID, filter.UserID)
+	page, err := h.cursors.Page(req.PageSize, req.PageToken, true, pageFilter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	returns, hasMore, err := h.repo.ListReturns(ctx, filter, page)
+	if err != nil {
+		h.logger.Error("failed to list returns", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to list returns")
+	}
+
+	var nextPageToken string
+	if hasMore {
+		last := returns[len(returns)-1]
+		nextPageToken, err = h.cursors.NextToken(page, last.CreatedAt, last.ID, pageFilter)
+		if err != nil {
+			h.logger.Error("failed to encode page token", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to list returns")
+		}
+	}
+
+	protoReturns := make([]*orderv1.Return, len(returns))
+	for i, ret := range returns {
+		protoReturns[i] = convertToProtoReturn(ret)
+	}
+
+	return &orderv1.ListReturnsResponse{
+		Returns:       protoReturns,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (h *OrderHandler) ApproveReturn(ctx context.Context, req *orderv1.ApproveReturnRequest) (*orderv1.ApproveReturnResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	// A REFUNDING return is one whose refund failed; approving it again
+	// retries the refund
+	ret, err := h.returnIn(ctx, req.ReturnId,
+		orderv1.ReturnStatus_RETURN_STATUS_REQUESTED,
+		orderv1.ReturnStatus_RETURN_STATUS_REFUNDING,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := h.repo.GetOrder(ctx, ret.OrderID)
+	if err != nil {
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+	if order.PaymentInfo.Status != orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot refund a %s payment", order.PaymentInfo.Status)
+	}
+	if order.Status != orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot approve returns of a %s order", order.Status)
+	}
+
+	// Claim the return before refunding it, so that it cannot be rejected
+	// once the money is on its way back
+	reason := req.Reason
+	if ret.Status == orderv1.ReturnStatus_RETURN_STATUS_REQUESTED {
+		err = h.repo.UpdateReturnStatus(ctx, ret.ID, orderv1.ReturnStatus_RETURN_STATUS_REQUESTED, ReturnDecision{
+			To:     orderv1.ReturnStatus_RETURN_STATUS_REFUNDING,
+			Actor:  actorFromContext(ctx),
+			Reason: reason,
+		})
+		if err != nil {
+			return nil, h.returnUpdateError(err, "approve return")
+		}
+	} else if reason == "" {
+		reason = ret.DecisionReason
+	}
+
+	if err := h.completeRefund(ctx, ret, order.PaymentInfo.Reference, actorFromContext(ctx), reason); err != nil {
+		return nil, err
+	}
+
+	ret, err = h.repo.GetReturn(ctx, ret.ID)
+	if err != nil {
+		h.logger.Error("failed to get return", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get return")
+	}
+	order, err = h.repo.GetOrder(ctx, ret.OrderID)
+	if err != nil {
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.ApproveReturnResponse{
+		OrderReturn: convertToProtoReturn(ret),
+		Order:       convertToProtoOrder(order, user),
+	}, nil
+}
+
+func (h *OrderHandler) RejectReturn(ctx context.Context, req *orderv1.RejectReturnRequest) (*orderv1.RejectReturnResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	ret, err := h.returnIn(ctx, req.ReturnId, orderv1.ReturnStatus_RETURN_STATUS_REQUESTED)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.repo.ResolveReturn(ctx, ret, ReturnDecision{
+		To:     orderv1.ReturnStatus_RETURN_STATUS_REJECTED,
+		Actor:  actorFromContext(ctx),
+		Reason: req.Reason,
+	})
+	if err != nil {
+		return nil, h.returnUpdateError(err, "reject return")
+	}
+
+	ret, err = h.repo.GetReturn(ctx, ret.ID)
+	if err != nil {
+		h.logger.Error("failed to get return", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get return")
+	}
+
+	return &orderv1.RejectReturnResponse{
+		OrderReturn: convertToProtoReturn(ret),
+	}, nil
+}
+
+// completeRefund refunds a REFUNDING return and records the refund. The refund
+// id is the return id, so retrying after a failure does not pay twice. If the
+// provider is unavailable the return stays REFUNDING for WatchPaymentReturns;
+// if it declines, nothing was refunded and the return is REQUESTED again.
+func (h *OrderHandler) completeRefund(ctx context.Context, ret *Return, reference, actor, reason string) error {
+	result, err := h.payments.Refund(ctx, payment.RefundRequest{
+		Reference: reference,
+		RefundID:  ret.ID,
+		Amount:    ret.Refund,
+	})
+	if err != nil {
+		if errors.Is(err, payment.ErrDeclined) {
+			reopen := ReturnDecision{To: orderv1.ReturnStatus_RETURN_STATUS_REQUESTED, Actor: actor, Reason: err.Error()}
+			if err := h.repo.UpdateReturnStatus(ctx, ret.ID, orderv1.ReturnStatus_RETURN_STATUS_REFUNDING, reopen); err != nil {
+				h.logger.Error("failed to reopen return", zap.String("return_id", ret.ID), zap.Error(err))
+			}
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		h.logger.Error("failed to refund return", zap.String("return_id", ret.ID), zap.Error(err))
+		return status.Error(codes.Unavailable, "payment provider unavailable, the refund will be retried")
+	}
+
+	err = h.repo.ResolveReturn(ctx, ret, ReturnDecision{
+		To:        orderv1.ReturnStatus_RETURN_STATUS_REFUNDED,
+		Actor:     actor,
+		Reason:    reason,
+		Reference: result.Reference,
+	})
+	if err != nil {
+		return h.returnUpdateError(err, "approve return")
+	}
+	return nil
+}
+
+// sweepReturnRefunds retries the refunds of returns left REFUNDING. Returns
+// claimed less than a sweep interval ago are left to their ApproveReturn call.
+func (h *OrderHandler) sweepReturnRefunds(ctx context.Context) {
+	ids, err := h.repo.ListRefundingReturns(ctx, time.Now().Add(-h.paymentCfg.SweepInterval), paymentSweepBatch)
+	if err != nil {
+		h.logger.Error("failed to list refunding returns", zap.Error(err))
+		return
+	}
+
+	var refunded int
+	for _, id := range ids {
+		ret, err := h.repo.GetReturn(ctx, id)
+		if err != nil {
+			h.logger.Error("failed to get return", zap.String("return_id", id), zap.Error(err))
+			continue
+		}
+		order, err := h.repo.GetOrder(ctx, ret.OrderID)
+		if err != nil {
+			h.logger.Error("failed to get order", zap.String("order_id", ret.OrderID), zap.Error(err))
+			continue
+		}
+		if err := h.completeRefund(ctx, ret, order.PaymentInfo.Reference, actorSystem, ret.DecisionReason); err != nil {
+			h.logger.Warn("return not refunded yet", zap.String("return_id", id), zap.Error(err))
+			continue
+		}
+		refunded++
+	}
+
+	if refunded > 0 {
+		h.logger.Info("refunded approved returns", zap.Int("count", refunded))
+	}
+}
+
+// returnIn loads a return that is in one of the given statuses
+func (h *OrderHandler) returnIn(ctx context.Context, id string, statuses ...orderv1.ReturnStatus) (*Return, error) {
+	ret, err := h.repo.GetReturn(ctx, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "return not found")
+		}
+		h.logger.Error("failed to get return", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get return")
+	}
+	for _, s := range statuses {
+		if ret.Status == s {
+			return ret, nil
+		}
+	}
+	return nil, status.Errorf(codes.FailedPrecondition, "return is already %s", ret.Status)
+}
+
+func (h *OrderHandler) returnUpdateError(err error, action string) error {
+	if errors.Is(err, ErrReturnConflict) {
+		return status.Error(codes.Aborted, "return was resolved concurrently, reload it")
+	}
+	return h.paymentUpdateError(err, action)
+}
+
+func convertToProtoReturn(ret *Return) *orderv1.Return {
+	items := make([]*orderv1.ReturnItem, len(ret.Items))
+	for i, item := range ret.Items {
+		items[i] = &orderv1.ReturnItem{
+			ProductId: item.ProductID,
+			Quantity:  item.Quantity,
+			Price:     money.ToProto(item.UnitPrice),
+		}
+	}
+
+	return &orderv1.Return{
+		Id:             ret.ID,
+		OrderId:        ret.OrderID,
+		UserId:         ret.UserID,
+		Status:         ret.Status,
+		Items:          items,
+		Reason:         ret.Reason,
+		Refund:         money.ToProto(ret.Refund),
+		DecisionReason: ret.DecisionReason,
+		CreatedAt:      timestamppb.New(ret.CreatedAt),
+		UpdatedAt:      timestamppb.New(ret.UpdatedAt),
+	}
+}
+
+// CreateReturn stores ret and, for an order that is still COMPLETED, applies
+// t to move it to RETURN_REQUESTED. It returns ErrReturnQuantity when other
+// open or refunded returns already claim the units.
+func (r *orderRepository) CreateReturn(ctx context.Context, ret *Return, t Transition) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Returns of one order are serialized on the order row
+	var orderStatus orderv1.OrderStatus
+	err = tx.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = ? FOR UPDATE", ret.OrderID).Scan(&orderStatus)
+	if err != nil {
+		return err
+	}
+
+	switch orderStatus {
+	case orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED:
+	case orderv1.OrderStatus_ORDER_STATUS_COMPLETED:
+		if _, err := transitionStatus(ctx, tx, ret.OrderID, t); err != nil {
+			return err
+		}
+	default:
+		return lifecycle.Check(orderStatus, t.To)
+	}
+
+	returnable, err := returnableQuantities(ctx, tx, ret.OrderID)
+	if err != nil {
+		return err
+	}
+	for _, item := range ret.Items {
+		if item.Quantity > returnable[item.ProductID] {
+			return fmt.Errorf("%w: %d of product %s left", ErrReturnQuantity, returnable[item.ProductID], item.ProductID)
+		}
+	}
+
+	query := `
+		INSERT INTO returns (id, order_id, user_id, status, reason, currency, refund_amount, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	_, err = tx.ExecContext(ctx, query,
+		ret.ID,
+		ret.OrderID,
+		ret.UserID,
+		ret.Status,
+		ret.Reason,
+		ret.Refund.Currency,
+		ret.Refund.String(),
+		ret.CreatedAt,
+		ret.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert return: %w", err)
+	}
+
+	itemQuery := `
+		INSERT INTO return_items (return_id, product_id, quantity, unit_price)
+		VALUES (?, ?, ?, ?)
+	`
+
+	for _, item := range ret.Items {
+		if _, err := tx.ExecContext(ctx, itemQuery, ret.ID, item.ProductID, item.Quantity, item.UnitPrice.String()); err != nil {
+			return fmt.Errorf("failed to insert return item: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// returnableQuantities returns, per product, the units bought minus those
+// claimed by returns that were not rejected
+func returnableQuantities(ctx context.Context, tx *sql.Tx, orderID string) (map[string]int32, error) {
+	query := `
+		SELECT product_id, SUM(quantity)
+		FROM order_items
+		WHERE order_id = ?
+		GROUP BY product_id
+	`
+
+	rows, err := tx.QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	returnable := make(map[string]int32)
+	for rows.Next() {
+		var productID string
+		var quantity int32
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			return nil, err
+		}
+		returnable[productID] = quantity
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	claimedQuery := `
+		SELECT i.product_id, SUM(i.quantity)
+		FROM return_items i
+		JOIN returns r ON r.id = i.return_id
+		WHERE r.order_id = ? AND r.status != ?
+		GROUP BY i.product_id
+	`
+
+	claimed, err := tx.QueryContext(ctx, claimedQuery, orderID, orderv1.ReturnStatus_RETURN_STATUS_REJECTED)
+	if err != nil {
+		return nil, err
+	}
+	defer claimed.Close()
+
+	for claimed.Next() {
+		var productID string
+		var quantity int32
+		if err := claimed.Scan(&productID, &quantity); err != nil {
+			return nil, err
+		}
+		returnable[productID] -= quantity
+	}
+
+	return returnable, claimed.Err()
+}
+
+func (r *orderRepository) GetReturn(ctx context.Context, id string) (*Return, error) {
+	query := `
+		SELECT id, order_id, user_id, status, reason, currency, refund_amount, decision_reason, created_at, updated_at
+		FROM returns
+		WHERE id = ?
+	`
+
+	ret, err := scanReturn(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadReturnItems(ctx, []*Return{ret}); err != nil {
+		return nil, fmt.Errorf("failed to load return items: %w", err)
+	}
+	return ret, nil
+}
+
+func (r *orderRepository) ListReturns(ctx context.Context, filter ReturnFilter, page pagination.Page) ([]*Return, bool, error) {
+	query := `
+		SELECT r.id, r.order_id, r.user_id, r.status, r.reason, r.currency, r.refund_amount,
+			r.decision_reason, r.created_at, r.updated_at
+		FROM returns r
+	`
+	var args []interface{}
+	if filter.OrderID != "" {
+		query += " WHERE r.order_id = ?"
+		args = append(args, filter.OrderID)
+	} else {
+		query += " WHERE r.user_id = ?"
+		args = append(args, filter.UserID)
+	}
+
+	if cond, condArgs := page.Keyset("r.created_at", "r.id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += " ORDER BY " + page.OrderBy("r.created_at", "r.id") + " LIMIT ?"
+	args = append(args, page.Limit())
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var returns []*Return
+	for rows.Next() {
+		ret, err := scanReturn(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		returns = append(returns, ret)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(returns) > int(page.Size)
+	if hasMore {
+		returns = returns[:page.Size]
+	}
+
+	if err := r.loadReturnItems(ctx, returns); err != nil {
+		return nil, false, fmt.Errorf("failed to load return items: %w", err)
+	}
+
+	return returns, hasMore, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReturn(row rowScanner) (*Return, error) {
+	ret := &Return{}
+	var refund string
+	err := row.Scan(
+		&ret.ID,
+		&ret.OrderID,
+		&ret.UserID,
+		&ret.Status,
+		&ret.Reason,
+		&ret.Refund.Currency,
+		&refund,
+		&ret.DecisionReason,
+		&ret.CreatedAt,
+		&ret.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Refund, err = money.Parse(ret.Refund.Currency, refund); err != nil {
+		return nil, fmt.Errorf("failed to parse refund of return %s: %w", ret.ID, err)
+	}
+	return ret, nil
+}
+
+func (r *orderRepository) loadReturnItems(ctx context.Context, returns []*Return) error {
+	if len(returns) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*Return, len(returns))
+	ids := make([]interface{}, len(returns))
+	for i, ret := range returns {
+		byID[ret.ID] = ret
+		ids[i] = ret.ID
+	}
+
+	query := `
+		SELECT return_id, product_id, quantity, unit_price
+		FROM return_items
+		WHERE return_id IN (` + placeholders(len(ids)) + `)
+		ORDER BY product_id
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var returnID, price string
+		var item ReturnItem
+		if err := rows.Scan(&returnID, &item.ProductID, &item.Quantity, &price); err != nil {
+			return err
+		}
+		ret, ok := byID[returnID]
+		if !ok {
+			continue
+		}
+		if item.UnitPrice, err = money.Parse(ret.Refund.Currency, price); err != nil {
+			return fmt.Errorf("failed to parse price of return %s: %w", returnID, err)
+		}
+		ret.Items = append(ret.Items, item)
+	}
+
+	return rows.Err()
+}
+
+// UpdateReturnStatus moves a return from from to d.To and records the
+// decision, or returns ErrReturnConflict if the return is no longer in from
+func (r *orderRepository) UpdateReturnStatus(ctx context.Context, id string, from orderv1.ReturnStatus, d ReturnDecision) error {
+	query := `
+		UPDATE returns
+		SET status = ?, decision_reason = ?, decided_by = ?, updated_at = NOW(6)
+		WHERE id = ? AND status = ?
+	`
+
+	result, err := r.db.ExecContext(ctx, query, d.To, d.Reason, d.Actor, id, from)
+	if err != nil {
+		return fmt.Errorf("failed to update return: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrReturnConflict
+	}
+	return nil
+}
+
+// ListRefundingReturns returns approved returns whose refund was not recorded
+// and that have not changed since before
+func (r *orderRepository) ListRefundingReturns(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	query := `
+		SELECT id
+		FROM returns
+		WHERE status = ? AND updated_at < ?
+		LIMIT ?
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, orderv1.ReturnStatus_RETURN_STATUS_REFUNDING, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ResolveReturn moves a return to d.To in one transaction: a REQUESTED
+// return to REJECTED, or a REFUNDING one to REFUNDED. A refunded return adds
+// its refund to the payment, which becomes REFUNDED once the whole total is. When every item of the order is back the shipment
+// is RETURNED and the order RETURNED, then REFUNDED; otherwise, once no other
+// return is open, the order goes back to COMPLETED.
+func (r *orderRepository) ResolveReturn(ctx context.Context, ret *Return, d ReturnDecision) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currency, total string
+	err = tx.QueryRowContext(ctx, "SELECT currency, total_amount FROM orders WHERE id = ? FOR UPDATE", ret.OrderID).Scan(&currency, &total)
+	if err != nil {
+		return err
+	}
+
+	// The decision on a refunded return was recorded when it was claimed
+	query := `
+		UPDATE returns
+		SET status = ?, decision_reason = ?, decided_by = ?, updated_at = NOW(6)
+		WHERE id = ? AND status = ?
+	`
+	args := []interface{}{d.To, d.Reason, d.Actor, ret.ID, orderv1.ReturnStatus_RETURN_STATUS_REQUESTED}
+	if d.To == orderv1.ReturnStatus_RETURN_STATUS_REFUNDED {
+		query = `
+			UPDATE returns
+			SET status = ?, updated_at = NOW(6)
+			WHERE id = ? AND status = ?
+		`
+		args = []interface{}{d.To, ret.ID, orderv1.ReturnStatus_RETURN_STATUS_REFUNDING}
+	}
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update return: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrReturnConflict
+	}
+
+	fullyRefunded := false
+	if d.To == orderv1.ReturnStatus_RETURN_STATUS_REFUNDED {
+		if fullyRefunded, err = refundReturn(ctx, tx, ret, d.Reference, currency, total); err != nil {
+			return err
+		}
+	}
+
+	var bought, returned, open int64
+	countQuery := `
+		SELECT
+			(SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE order_id = ?),
+			(SELECT COALESCE(SUM(i.quantity), 0) FROM return_items i JOIN returns r ON r.id = i.return_id
+				WHERE r.order_id = ? AND r.status = ?),
+			(SELECT COUNT(*) FROM returns WHERE order_id = ? AND status IN (?, ?))
+	`
+	err = tx.QueryRowContext(ctx, countQuery,
+		ret.OrderID,
+		ret.OrderID, orderv1.ReturnStatus_RETURN_STATUS_REFUNDED,
+		ret.OrderID, orderv1.ReturnStatus_RETURN_STATUS_REQUESTED, orderv1.ReturnStatus_RETURN_STATUS_REFUNDING,
+	).Scan(&bought, &returned, &open)
+	if err != nil {
+		return err
+	}
+
+	t := Transition{Actor: d.Actor, Reason: d.Reason}
+	switch {
+	case returned == bought:
+		shippingQuery := `
+			UPDATE shipping_info
+			SET status = ?
+			WHERE order_id = ? AND status = ?
+		`
+		_, err := tx.ExecContext(ctx, shippingQuery,
+			orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED,
+			ret.OrderID,
+			orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update shipping: %w", err)
+		}
+
+		t.To = orderv1.OrderStatus_ORDER_STATUS_RETURNED
+		if _, err := transitionStatus(ctx, tx, ret.OrderID, t); err != nil {
+			return err
+		}
+		if fullyRefunded {
+			t.To = orderv1.OrderStatus_ORDER_STATUS_REFUNDED
+			if _, err := transitionStatus(ctx, tx, ret.OrderID, t); err != nil {
+				return err
+			}
+		}
+	case open == 0:
+		t.To = orderv1.OrderStatus_ORDER_STATUS_COMPLETED
+		if _, err := transitionStatus(ctx, tx, ret.OrderID, t); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// refundReturn adds the refund of ret to the order's payment within tx and
+// reports whether the whole total has now been refunded
+func refundReturn(ctx context.Context, tx *sql.Tx, ret *Return, reference, currency, total string) (bool, error) {
+	var refunded string
+	err := tx.QueryRowContext(ctx, "SELECT refunded_amount FROM payment_info WHERE order_id = ? FOR UPDATE", ret.OrderID).Scan(&refunded)
+	if err != nil {
+		return false, err
+	}
+
+	totalAmount, err := money.Parse(currency, total)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse total of order %s: %w", ret.OrderID, err)
+	}
+	refundedAmount, err := money.Parse(currency, refunded)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse refunded amount of order %s: %w", ret.OrderID, err)
+	}
+	if refundedAmount, err = refundedAmount.Add(ret.Refund); err != nil {
+		return false, err
+	}
+
+	cmp, err := refundedAmount.Cmp(totalAmount)
+	if err != nil {
+		return false, err
+	}
+	if cmp > 0 {
+		return false, fmt.Errorf("refunds of order %s exceed its total", ret.OrderID)
+	}
+
+	// The payment stays COMPLETED until the whole total is refunded
+	u := PaymentUpdate{
+		From:      orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+		To:        orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+		Reference: reference,
+		Refunded:  ret.Refund,
+	}
+	if cmp == 0 {
+		u.To = orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED
+	}
+	if err := updatePayment(ctx, tx, ret.OrderID, u); err != nil {
+		return false, err
+	}
+	return cmp == 0, nil
+}
@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+// maxFilterStatuses caps OrderFilter.statuses
+const maxFilterStatuses = 10
+
+// OrderFilter selects the orders of a listing. Zero fields match every
+// order. Time ranges include their lower bound and exclude the upper one.
+type OrderFilter struct {
+	UserID        string
+	Statuses      []orderv1.OrderStatus
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// MinTotal and MaxTotal are inclusive and only match orders in their
+	// currency
+	MinTotal        *money.Money
+	MaxTotal        *money.Money
+	PaymentStatus   orderv1.PaymentStatus
+	PaymentMethod   orderv1.PaymentMethod
+	ShippingCountry string
+	ProductID       string
+	// OrderBy is the sort key; the order id breaks ties
+	OrderBy orderv1.OrderBy
+}
+
+// newOrderFilter validates the listing parameters of a request. The legacy
+// single status is added to the statuses of f.
+func newOrderFilter(userID string, legacyStatus orderv1.OrderStatus, f *orderv1.OrderFilter, orderBy orderv1.OrderBy) (OrderFilter, error) {
+	filter := OrderFilter{
+		UserID:          userID,
+		PaymentStatus:   f.GetPaymentStatus(),
+		PaymentMethod:   f.GetPaymentMethod(),
+		ShippingCountry: f.GetShippingCountry(),
+		ProductID:       f.GetProductId(),
+		OrderBy:         orderBy,
+	}
+
+	if len(f.GetStatuses()) > maxFilterStatuses {
+		return OrderFilter{}, status.Errorf(codes.InvalidArgument, "at most %d statuses can be filtered on", maxFilterStatuses)
+	}
+	seen := make(map[orderv1.OrderStatus]bool)
+	for _, s := range append([]orderv1.OrderStatus{legacyStatus}, f.GetStatuses()...) {
+		if s != orderv1.OrderStatus_ORDER_STATUS_UNSPECIFIED && !seen[s] {
+			seen[s] = true
+			filter.Statuses = append(filter.Statuses, s)
+		}
+	}
+
+	var err error
+	if filter.CreatedAfter, filter.CreatedBefore, err = timeRange("created", f.GetCreatedAfter(), f.GetCreatedBefore()); err != nil {
+		return OrderFilter{}, err
+	}
+	if filter.UpdatedAfter, filter.UpdatedBefore, err = timeRange("updated", f.GetUpdatedAfter(), f.GetUpdatedBefore()); err != nil {
+		return OrderFilter{}, err
+	}
+
+	if f.GetMinTotal() != nil {
+		lower, err := money.FromProto(f.GetMinTotal())
+		if err != nil {
+			return OrderFilter{}, status.Errorf(codes.InvalidArgument, "min_total: %v", err)
+		}
+		filter.MinTotal = &lower
+	}
+	if f.GetMaxTotal() != nil {
+		upper, err := money.FromProto(f.GetMaxTotal())
+		if err != nil {
+			return OrderFilter{}, status.Errorf(codes.InvalidArgument, "max_total: %v", err)
+		}
+		filter.MaxTotal = &upper
+	}
+	if filter.MinTotal != nil && filter.MaxTotal != nil {
+		cmp, err := filter.MinTotal.Cmp(*filter.MaxTotal)
+		if err != nil {
+			return OrderFilter{}, status.Error(codes.InvalidArgument, "min_total and max_total must be in the same currency")
+		}
+		if cmp > 0 {
+			return OrderFilter{}, status.Error(codes.InvalidArgument, "min_total must not exceed max_total")
+		}
+	}
+
+	switch orderBy {
+	case orderv1.OrderBy_ORDER_BY_UNSPECIFIED, orderv1.OrderBy_ORDER_BY_CREATED_AT, orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT:
+	default:
+		return OrderFilter{}, status.Error(codes.InvalidArgument, "unknown order_by")
+	}
+
+	return filter, nil
+}
+
+// timeRange converts the bounds of a time range, either of which may be
+// unset
+func timeRange(name string, after, before *timestamppb.Timestamp) (time.Time, time.Time, error) {
+	var from, to time.Time
+	if after != nil {
+		if err := after.CheckValid(); err != nil {
+			return from, to, status.Errorf(codes.InvalidArgument, "%s_after: %v", name, err)
+		}
+		from = after.AsTime()
+	}
+	if before != nil {
+		if err := before.CheckValid(); err != nil {
+			return from, to, status.Errorf(codes.InvalidArgument, "%s_before: %v", name, err)
+		}
+		to = before.AsTime()
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, status.Errorf(codes.InvalidArgument, "%s_after must be before %s_before", name, name)
+	}
+	return from, to, nil
+}
+
+// sortedByTotal reports whether the listing is sorted by total amount rather
+// than creation time
+func (f OrderFilter) sortedByTotal() bool {
+	return f.OrderBy == orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT
+}
+
+// fingerprint identifies the filter in page tokens
+func (f OrderFilter) fingerprint() string {
+	statuses := make([]string, len(f.Statuses))
+	for i, s := range f.Statuses {
+		statuses[i] = s.String()
+	}
+
+	return pagination.Filter(
+		f.UserID,
+		strings.Join(statuses, ","),
+		formatBound(f.CreatedAfter),
+		formatBound(f.CreatedBefore),
+		formatBound(f.UpdatedAfter),
+		formatBound(f.UpdatedBefore),
+		formatAmount(f.MinTotal),
+		formatAmount(f.MaxTotal),
+		f.PaymentStatus.String(),
+		f.PaymentMethod.String(),
+		f.ShippingCountry,
+		f.ProductID,
+		f.OrderBy.String(),
+	)
+}
+
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatAmount(m *money.Money) string {
+	if m == nil {
+		return ""
+	}
+	return m.Currency + " " + m.String()
+}
+
+// where returns the conditions on orders o that select the filtered orders,
+// to be joined with AND, and their arguments
+func (f OrderFilter) where() ([]string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	add := func(cond string, condArgs ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if f.UserID != "" {
+		add("o.user_id = ?", f.UserID)
+	}
+	if len(f.Statuses) > 0 {
+		statuses := make([]interface{}, len(f.Statuses))
+		for i, s := range f.Statuses {
+			statuses[i] = s
+		}
+		add("o.status IN ("+placeholders(len(statuses))+")", statuses...)
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("o.created_at >= ?", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("o.created_at < ?", f.CreatedBefore)
+	}
+	if !f.UpdatedAfter.IsZero() {
+		add("o.updated_at >= ?", f.UpdatedAfter)
+	}
+	if !f.UpdatedBefore.IsZero() {
+		add("o.updated_at < ?", f.UpdatedBefore)
+	}
+	if f.MinTotal != nil {
+		add("o.currency = ? AND o.total_amount >= ?", f.MinTotal.Currency, f.MinTotal.String())
+	}
+	if f.MaxTotal != nil {
+		add("o.currency = ? AND o.total_amount <= ?", f.MaxTotal.Currency, f.MaxTotal.String())
+	}
+
+	var payment []string
+	var paymentArgs []interface{}
+	if f.PaymentStatus != orderv1.PaymentStatus_PAYMENT_STATUS_UNSPECIFIED {
+		payment = append(payment, "p.status = ?")
+		paymentArgs = append(paymentArgs, f.PaymentStatus)
+	}
+	if f.PaymentMethod != orderv1.PaymentMethod_PAYMENT_METHOD_UNSPECIFIED {
+		payment = append(payment, "p.method = ?")
+		paymentArgs = append(paymentArgs, f.PaymentMethod)
+	}
+	if len(payment) > 0 {
+		add("EXISTS (SELECT 1 FROM payment_info p WHERE p.order_id = o.id AND "+strings.Join(payment, " AND ")+")", paymentArgs...)
+	}
+
+	if f.ShippingCountry != "" {
+		add("EXISTS (SELECT 1 FROM shipping_info s WHERE s.order_id = o.id AND s.country = ?)", f.ShippingCountry)
+	}
+	if f.ProductID != "" {
+		add("EXISTS (SELECT 1 FROM order_items i WHERE i.order_id = o.id AND i.product_id = ?)", f.ProductID)
+	}
+
+	return conds, args
+}
+
+// keyset returns the condition continuing after the page's cursor in the
+// filter's sort order, and the ORDER BY expression. Totals are only
+// comparable within a currency, so orders sorted by total are grouped by
+// currency first.
+func (f OrderFilter) keyset(page pagination.Page) (string, []interface{}, string) {
+	if f.sortedByTotal() {
+		cond, args := page.KeyKeyset("o.currency", "o.total_amount", "o.id")
+		return cond, args, page.OrderBy("o.currency", "o.total_amount", "o.id")
+	}
+	cond, args := page.Keyset("o.created_at", "o.id")
+	return cond, args, page.OrderBy("o.created_at", "o.id")
+}
+
+// nextToken returns the token of the page after the one ending with last
+func (f OrderFilter) nextToken(cursors *pagination.Codec, page pagination.Page, last *Order) (string, error) {
+	if f.sortedByTotal() {
+		return cursors.NextKeyToken(page, last.TotalAmount.Currency, last.TotalAmount.String(), last.ID, f.fingerprint())
+	}
+	return cursors.NextToken(page, last.CreatedAt, last.ID, f.fingerprint())
+}
+
+// after returns the cursor continuing the listing after last, for callers
+// that page through every result without handing out tokens
+func (f OrderFilter) after(page pagination.Page, last *Order) *pagination.Cursor {
+	cursor := &pagination.Cursor{ID: last.ID, Desc: page.Desc}
+	if f.sortedByTotal() {
+		cursor.Group = last.TotalAmount.Currency
+		cursor.Key = last.TotalAmount.String()
+	} else {
+		cursor.CreatedAt = last.CreatedAt
+	}
+	return cursor
+}
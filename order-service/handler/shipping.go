@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	"github.com/zabilal/microservices/order-service/shipping"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+// ErrShippingConflict means the shipping status changed between reading it
+// and the conditional update
+var ErrShippingConflict = errors.New("shipping status changed concurrently")
+
+// ShippingUpdate is a shipping status change. The order's version is checked
+// and bumped with it, so a shipment is never recorded against an order that
+// changed since it was read.
+type ShippingUpdate struct {
+	From orderv1.ShippingStatus
+	To   orderv1.ShippingStatus
+	// Carrier and TrackingNumber are kept when empty
+	Carrier        string
+	TrackingNumber string
+	// Order.To is UNSPECIFIED to leave the order status as it is
+	Order Transition
+}
+
+func (h *OrderHandler) MarkShipped(ctx context.Context, req *orderv1.MarkShippedRequest) (*orderv1.MarkShippedResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Carrier == "" || req.TrackingNumber == "" {
+		return nil, status.Error(codes.InvalidArgument, "carrier and tracking_number are required")
+	}
+
+	order, err := h.orderForUpdate(ctx, req.OrderId, req.ExpectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only paid orders leave the warehouse
+	if order.Status != orderv1.OrderStatus_ORDER_STATUS_PROCESSING {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot ship a %s order", order.Status)
+	}
+
+	order, err = h.recordShipping(ctx, order, ShippingUpdate{
+		To:             orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED,
+		Carrier:        req.Carrier,
+		TrackingNumber: req.TrackingNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.MarkShippedResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+func (h *OrderHandler) MarkDelivered(ctx context.Context, req *orderv1.MarkDeliveredRequest) (*orderv1.MarkDeliveredResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := h.orderForUpdate(ctx, req.OrderId, req.ExpectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err = h.recordShipping(ctx, order, ShippingUpdate{
+		To: orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED,
+		Order: Transition{
+			To:     orderv1.OrderStatus_ORDER_STATUS_COMPLETED,
+			Reason: "delivered",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.MarkDeliveredResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+func (h *OrderHandler) RecordReturn(ctx context.Context, req *orderv1.RecordReturnRequest) (*orderv1.RecordReturnResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := h.orderForUpdate(ctx, req.OrderId, req.ExpectedVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err = h.recordShipping(ctx, order, ShippingUpdate{
+		To: orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED,
+		Order: Transition{
+			To:     orderv1.OrderStatus_ORDER_STATUS_RETURNED,
+			Reason: req.Reason,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user details
+	user, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+	if err != nil {
+		h.logger.Error("failed to get user details", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user details")
+	}
+
+	return &orderv1.RecordReturnResponse{
+		Order: convertToProtoOrder(order, user),
+	}, nil
+}
+
+// recordShipping checks u against the order it was read from, stores it and
+// returns the updated order
+func (h *OrderHandler) recordShipping(ctx context.Context, order *Order, u ShippingUpdate) (*Order, error) {
+	u.From = order.ShippingInfo.Status
+	if !shipping.CanTransition(u.From, u.To) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot move shipment from %s to %s", u.From, u.To)
+	}
+	if u.Order.To != orderv1.OrderStatus_ORDER_STATUS_UNSPECIFIED {
+		if err := lifecycle.Check(order.Status, u.Order.To); err != nil {
+			return nil, status.Convert(err).Err()
+		}
+	}
+	u.Order.ExpectedVersion = order.Version
+	u.Order.Actor = actorFromContext(ctx)
+
+	if err := h.repo.UpdateShipping(ctx, order.ID, u); err != nil {
+		if errors.Is(err, ErrShippingConflict) {
+			return nil, status.Error(codes.Aborted, "shipment changed concurrently, retry")
+		}
+		return nil, h.statusChangeError(err, "update shipping")
+	}
+
+	order, err := h.repo.GetOrder(ctx, order.ID)
+	if err != nil {
+		h.logger.Error("failed to get order", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+	return order, nil
+}
+
+// UpdateShipping applies u and the order change that goes with it in one
+// transaction. It returns ErrShippingConflict if the shipping status is no
+// longer u.From and ErrVersionMismatch if the order changed.
+func (r *orderRepository) UpdateShipping(ctx context.Context, orderID string, u ShippingUpdate) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var shippedAt, deliveredAt sql.NullTime
+	switch u.To {
+	case orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED:
+		shippedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	case orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED:
+		deliveredAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	query := `
+		UPDATE shipping_info
+		SET status = ?,
+			carrier = COALESCE(NULLIF(?, ''), carrier),
+			tracking_number = COALESCE(NULLIF(?, ''), tracking_number),
+			shipped_at = COALESCE(?, shipped_at),
+			delivered_at = COALESCE(?, delivered_at)
+		WHERE order_id = ? AND status = ?
+	`
+
+	result, err := tx.ExecContext(ctx, query, u.To, u.Carrier, u.TrackingNumber, shippedAt, deliveredAt, orderID, u.From)
+	if err != nil {
+		return fmt.Errorf("failed to update shipping: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrShippingConflict
+	}
+
+	if u.Order.To != orderv1.OrderStatus_ORDER_STATUS_UNSPECIFIED {
+		if _, err := transitionStatus(ctx, tx, orderID, u.Order); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	orderQuery := `
+		UPDATE orders
+		SET version = version + 1, updated_at = NOW()
+		WHERE id = ? AND version = ?
+	`
+
+	result, err = tx.ExecContext(ctx, orderQuery, orderID, u.Order.ExpectedVersion)
+	if err != nil {
+		return fmt.Errorf("failed to update order: %w", err)
+	}
+
+	rows, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrVersionMismatch
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+// WatchConfig controls how often a watched order is reloaded without a change
+// having been seen in this process, which picks up changes made through other
+// replicas and by the reservation sweeper
+type WatchConfig struct {
+	ResyncInterval time.Duration
+}
+
+// orderBroker tells the watchers in this process that an order changed. A
+// notification only asks the watcher to reload the order, so one that falls
+// behind gets the latest state instead of a backlog.
+type orderBroker struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan struct{}]struct{}
+	// closed ends every watch when the server shuts down
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newOrderBroker() *orderBroker {
+	return &orderBroker{
+		watchers: make(map[string]map[chan struct{}]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel that receives a value after the order changes
+// and a function that stops the subscription
+func (b *orderBroker) subscribe(orderID string) (<-chan struct{}, func()) {
+	// A pending notification already covers any further change
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watchers[orderID] == nil {
+		b.watchers[orderID] = make(map[chan struct{}]struct{})
+	}
+	b.watchers[orderID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.watchers[orderID], ch)
+		if len(b.watchers[orderID]) == 0 {
+			delete(b.watchers, orderID)
+		}
+	}
+}
+
+func (b *orderBroker) publish(orderID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.watchers[orderID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *orderBroker) close() {
+	b.closeOnce.Do(func() { close(b.closed) })
+}
+
+// StopWatches ends all WatchOrder streams with Unavailable, so clients
+// reconnect to another replica. Call it before stopping the gRPC server
+// gracefully, which would otherwise wait for the streams forever.
+func (h *OrderHandler) StopWatches() {
+	h.broker.close()
+}
+
+// watchedRepository notifies the broker after every successful change to an
+// order
+type watchedRepository struct {
+	OrderRepository
+	broker *orderBroker
+}
+
+func (r *watchedRepository) notify(orderID string, err error) error {
+	if err == nil {
+		r.broker.publish(orderID)
+	}
+	return err
+}
+
+func (r *watchedRepository) UpdateOrderStatus(ctx context.Context, id string, t Transition) error {
+	return r.notify(id, r.OrderRepository.UpdateOrderStatus(ctx, id, t))
+}
+
+func (r *watchedRepository) UpdateOrderStatuses(ctx context.Context, updates []StatusUpdate, atomic bool) ([]error, error) {
+	outcomes, err := r.OrderRepository.UpdateOrderStatuses(ctx, updates, atomic)
+	if err == nil {
+		for i, u := range updates {
+			r.notify(u.OrderID, outcomes[i])
+		}
+	}
+	return outcomes, err
+}
+
+func (r *watchedRepository) CancelOrder(ctx context.Context, id string, t Transition) error {
+	return r.notify(id, r.OrderRepository.CancelOrder(ctx, id, t))
+}
+
+func (r *watchedRepository) UpdatePayment(ctx context.Context, orderID string, u PaymentUpdate) error {
+	return r.notify(orderID, r.OrderRepository.UpdatePayment(ctx, orderID, u))
+}
+
+func (r *watchedRepository) ApplyPaymentEvent(ctx context.Context, event PaymentEvent, u *PaymentUpdate) error {
+	return r.notify(event.OrderID, r.OrderRepository.ApplyPaymentEvent(ctx, event, u))
+}
+
+func (r *watchedRepository) UpdateShipping(ctx context.Context, orderID string, u ShippingUpdate) error {
+	return r.notify(orderID, r.OrderRepository.UpdateShipping(ctx, orderID, u))
+}
+
+func (r *watchedRepository) CreateReturn(ctx context.Context, ret *Return, t Transition) error {
+	return r.notify(ret.OrderID, r.OrderRepository.CreateReturn(ctx, ret, t))
+}
+
+func (r *watchedRepository) ResolveReturn(ctx context.Context, ret *Return, d ReturnDecision) error {
+	return r.notify(ret.OrderID, r.OrderRepository.ResolveReturn(ctx, ret, d))
+}
+
+// WatchOrder sends the order if it is newer than req.SinceVersion and then
+// again after each change, until the client goes away
+func (h *OrderHandler) WatchOrder(req *orderv1.WatchOrderRequest, stream orderv1.OrderService_WatchOrderServer) error {
+	ctx := stream.Context()
+
+	// Subscribe before the first read, so a change made in between is seen
+	changes, unsubscribe := h.broker.subscribe(req.OrderId)
+	defer unsubscribe()
+
+	resync := time.NewTicker(h.watch.ResyncInterval)
+	defer resync.Stop()
+
+	var (
+		user    *userv1.User
+		started bool
+	)
+	sent := req.SinceVersion
+	for {
+		order, err := h.repo.GetOrder(ctx, req.OrderId)
+		switch {
+		case ctx.Err() != nil:
+			return status.FromContextError(ctx.Err()).Err()
+		case errors.Is(err, sql.ErrNoRows):
+			return status.Error(codes.NotFound, "order not found")
+		case err != nil:
+			h.logger.Error("failed to get order", zap.Error(err))
+			return status.Error(codes.Internal, "failed to get order")
+		}
+
+		if !canAccessUser(ctx, order.UserID) {
+			return status.Error(codes.NotFound, "order not found")
+		}
+		if !started {
+			// Tells the gateway the watch was accepted before any change
+			if err := stream.SendHeader(metadata.MD{}); err != nil {
+				return err
+			}
+			started = true
+		}
+
+		if order.Version > sent {
+			// Get user details once; they are not part of the changes watched
+			if user == nil {
+				resp, err := h.userClient.GetUser(ctx, &userv1.GetUserRequest{Id: order.UserID})
+				if err != nil {
+					h.logger.Error("failed to get user details", zap.Error(err))
+					return status.Error(codes.Internal, "failed to get user details")
+				}
+				user = resp.GetUser()
+			}
+
+			if err := stream.Send(&orderv1.WatchOrderResponse{Order: convertToProtoOrder(order, user)}); err != nil {
+				return err
+			}
+			sent = order.Version
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-h.broker.closed:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-changes:
+		case <-resync.C:
+		}
+	}
+}
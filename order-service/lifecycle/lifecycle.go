@@ -0,0 +1,122 @@
+// Package lifecycle defines the order state machine shared by every path that
+// changes an order's status.
+package lifecycle
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// Initial is the status of a newly created order
+const Initial = orderv1.OrderStatus_ORDER_STATUS_PENDING
+
+// PreconditionType is the PreconditionFailure violation type used for
+// rejected transitions
+const PreconditionType = "ORDER_STATUS"
+
+// transitions lists the statuses an order may move to from each status.
+// Statuses without an entry are terminal.
+var transitions = map[orderv1.OrderStatus][]orderv1.OrderStatus{
+	orderv1.OrderStatus_ORDER_STATUS_PENDING: {
+		orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+		orderv1.OrderStatus_ORDER_STATUS_CANCELLED,
+		orderv1.OrderStatus_ORDER_STATUS_FAILED,
+	},
+	orderv1.OrderStatus_ORDER_STATUS_PROCESSING: {
+		orderv1.OrderStatus_ORDER_STATUS_COMPLETED,
+		orderv1.OrderStatus_ORDER_STATUS_FAILED,
+		orderv1.OrderStatus_ORDER_STATUS_CANCELLED,
+	},
+	orderv1.OrderStatus_ORDER_STATUS_COMPLETED: {
+		orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED,
+		orderv1.OrderStatus_ORDER_STATUS_REFUNDED,
+	},
+	orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED: {
+		orderv1.OrderStatus_ORDER_STATUS_RETURNED,
+		// The return was rejected
+		orderv1.OrderStatus_ORDER_STATUS_COMPLETED,
+	},
+	orderv1.OrderStatus_ORDER_STATUS_RETURNED: {
+		orderv1.OrderStatus_ORDER_STATUS_REFUNDED,
+	},
+}
+
+// CanTransition reports whether an order may move from one status to another
+func CanTransition(from, to orderv1.OrderStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the statuses reachable from status
+func Next(status orderv1.OrderStatus) []orderv1.OrderStatus {
+	return append([]orderv1.OrderStatus(nil), transitions[status]...)
+}
+
+// IsTerminal reports whether no further transitions are possible
+func IsTerminal(status orderv1.OrderStatus) bool {
+	return len(transitions[status]) == 0
+}
+
+// Check returns a *TransitionError if the transition is not allowed
+func Check(from, to orderv1.OrderStatus) error {
+	if CanTransition(from, to) {
+		return nil
+	}
+	return &TransitionError{From: from, To: to, Allowed: Next(from)}
+}
+
+// TransitionError is returned for a status change the lifecycle forbids. It
+// converts to a FailedPrecondition status carrying the allowed next states.
+type TransitionError struct {
+	From    orderv1.OrderStatus
+	To      orderv1.OrderStatus
+	Allowed []orderv1.OrderStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot move order from %s to %s", e.From, e.To)
+}
+
+// GRPCStatus lets status.FromError and status.Convert pick up the details
+func (e *TransitionError) GRPCStatus() *status.Status {
+	allowed := make([]string, len(e.Allowed))
+	for i, s := range e.Allowed {
+		allowed[i] = s.String()
+	}
+
+	description := "no further status changes are allowed"
+	if len(allowed) > 0 {
+		description = "allowed next statuses: " + strings.Join(allowed, ", ")
+	}
+
+	st := status.New(codes.FailedPrecondition, e.Error())
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        PreconditionType,
+			Subject:     e.From.String(),
+			Description: description,
+		}},
+	}, &errdetails.ErrorInfo{
+		Reason: "INVALID_STATUS_TRANSITION",
+		Domain: "order.v1",
+		Metadata: map[string]string{
+			"from":    e.From.String(),
+			"to":      e.To.String(),
+			"allowed": strings.Join(allowed, ","),
+		},
+	})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
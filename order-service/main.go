@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -16,6 +18,10 @@ import (
 	"github.com/zabilal/microservices/monitoring/metrics"
 	"github.com/zabilal/microservices/monitoring/tracing"
 	"github.com/zabilal/microservices/order-service/handler"
+	"github.com/zabilal/microservices/order-service/outbox"
+	"github.com/zabilal/microservices/order-service/payment"
+	"github.com/zabilal/microservices/pkg/pagination"
+	"github.com/zabilal/microservices/pkg/servicetoken"
 )
 
 type Config struct {
@@ -25,6 +31,17 @@ type Config struct {
 	JaegerEndpoint   string
 	UserServiceAddr  string
 	DatabaseConfig   DatabaseConfig
+	PageSecret       string
+	PageTokenTTL     time.Duration
+	ServiceToken     string
+	Idempotency      handler.IdempotencyConfig
+	Inventory        handler.InventoryConfig
+	PaymentProvider  string
+	Payments         handler.PaymentConfig
+	Watch            handler.WatchConfig
+	EventPublisher   string
+	EventFile        string
+	Outbox           outbox.RelayConfig
 }
 
 type DatabaseConfig struct {
@@ -64,15 +81,58 @@ func main() {
 		}
 	}()
 
+	// Calls from and to other services carry the shared service token
+	serviceToken, err := servicetoken.New(cfg.ServiceToken)
+	if err != nil {
+		log.Fatal("Failed to initialize service token", zap.Error(err))
+	}
+
 	// Initialize user service client
-	userConn, err := grpc.Dial(cfg.UserServiceAddr, grpc.WithInsecure())
+	userConn, err := grpc.Dial(cfg.UserServiceAddr, grpc.WithInsecure(), serviceToken.DialOption())
 	if err != nil {
 		log.Fatal("Failed to connect to user service", zap.Error(err))
 	}
 	defer userConn.Close()
 
-	// Initialize repository
-	repo := handler.NewOrderRepository(cfg.DatabaseConfig)
+	// Initialize repository and product catalog on a shared pool
+	db, err := handler.OpenDatabase(cfg.DatabaseConfig)
+	if err != nil {
+		log.Fatal("Failed to open database", zap.Error(err))
+	}
+	defer db.Close()
+	repo := handler.NewOrderRepositoryFromDB(db)
+	catalog := handler.NewSQLCatalog(db)
+
+	// Initialize payment provider
+	var payments payment.Provider
+	switch cfg.PaymentProvider {
+	case "fake":
+		payments = payment.NewFakeProvider()
+	default:
+		log.Fatal("Unknown payment provider", zap.String("provider", cfg.PaymentProvider))
+	}
+
+	// Initialize event publisher
+	var publisher outbox.Publisher
+	switch cfg.EventPublisher {
+	case "memory":
+		publisher = outbox.NewMemoryPublisher()
+	case "file":
+		filePublisher, err := outbox.NewFilePublisher(cfg.EventFile)
+		if err != nil {
+			log.Fatal("Failed to open event file", zap.Error(err))
+		}
+		defer filePublisher.Close()
+		publisher = filePublisher
+	default:
+		log.Fatal("Unknown event publisher", zap.String("publisher", cfg.EventPublisher))
+	}
+
+	// Initialize page token codec
+	cursors, err := pagination.NewCodec(cfg.PageSecret, cfg.PageTokenTTL)
+	if err != nil {
+		log.Fatal("Failed to initialize page token codec", zap.Error(err))
+	}
 
 	// Initialize gRPC server
 	lis, err := net.Listen("tcp", cfg.ServerAddress)
@@ -80,10 +140,22 @@ func main() {
 		log.Fatal("Failed to listen", zap.Error(err))
 	}
 
-	server := grpc.NewServer()
-	orderHandler := handler.NewOrderHandler(repo, userConn, log)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(handler.RecoveryUnaryInterceptor(log), serviceToken.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(handler.RecoveryStreamInterceptor(log), serviceToken.StreamServerInterceptor()),
+	)
+	orderHandler := handler.NewOrderHandler(repo, catalog, payments, userConn, cursors, cfg.Idempotency, cfg.Inventory, cfg.Payments, cfg.Watch, log)
 	handler.RegisterOrderServiceServer(server, orderHandler)
 
+	// Remove expired idempotency keys and stock reservations, retry payment
+	// returns and relay outbox events in the background
+	sweepCtx, stopSweep := context.WithCancel(context.Background())
+	defer stopSweep()
+	go orderHandler.WatchIdempotencyKeys(sweepCtx)
+	go orderHandler.WatchReservations(sweepCtx)
+	go orderHandler.WatchPaymentReturns(sweepCtx)
+	go outbox.NewRelay(repo, publisher, cfg.Outbox, log).Run(sweepCtx)
+
 	// Start server
 	go func() {
 		log.Info("Starting gRPC server", zap.String("address", cfg.ServerAddress))
@@ -99,6 +171,7 @@ func main() {
 
 	// Graceful shutdown
 	log.Info("Shutting down server...")
+	orderHandler.StopWatches()
 	server.GracefulStop()
 	if err := metricsServer.Stop(context.Background()); err != nil {
 		log.Error("Failed to stop metrics server", zap.Error(err))
@@ -110,6 +183,9 @@ func loadConfig() *Config {
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
 	viper.AddConfigPath("/etc/microservices")
+	// Secrets come from the environment, e.g. PAGINATION_SECRET
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
 	
 	if err := viper.ReadInConfig(); err != nil {
 		panic(fmt.Errorf("fatal error loading config file: %w", err))
@@ -128,5 +204,32 @@ func loadConfig() *Config {
 			Password: viper.GetString("database.password"),
 			DBName:   viper.GetString("database.dbname"),
 		},
+		PageSecret:   viper.GetString("pagination.secret"),
+		PageTokenTTL: viper.GetDuration("pagination.token_ttl"),
+		ServiceToken: viper.GetString("service_token"),
+		Idempotency: handler.IdempotencyConfig{
+			Retention:     viper.GetDuration("idempotency.retention"),
+			SweepInterval: viper.GetDuration("idempotency.sweep_interval"),
+		},
+		Inventory: handler.InventoryConfig{
+			ReservationTTL: viper.GetDuration("inventory.reservation_ttl"),
+			SweepInterval:  viper.GetDuration("inventory.sweep_interval"),
+		},
+		PaymentProvider: viper.GetString("payments.provider"),
+		Payments: handler.PaymentConfig{
+			SweepInterval: viper.GetDuration("payments.sweep_interval"),
+		},
+		Watch: handler.WatchConfig{
+			ResyncInterval: viper.GetDuration("watch.resync_interval"),
+		},
+		EventPublisher: viper.GetString("outbox.publisher"),
+		EventFile:      viper.GetString("outbox.file"),
+		Outbox: outbox.RelayConfig{
+			PollInterval: viper.GetDuration("outbox.poll_interval"),
+			BatchSize:    viper.GetInt("outbox.batch_size"),
+			MinBackoff:   viper.GetDuration("outbox.min_backoff"),
+			MaxBackoff:   viper.GetDuration("outbox.max_backoff"),
+			Retention:    viper.GetDuration("outbox.retention"),
+		},
 	}
 }
@@ -0,0 +1,63 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FilePublisher appends events to a file as JSON lines, one message per line
+// with the subject and headers a NATS message would carry. It stands in for a
+// broker when running locally.
+type FilePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+type fileMessage struct {
+	Subject   string          `json:"subject"`
+	ID        string          `json:"id"`
+	OrderID   string          `json:"order_id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// NewFilePublisher opens path for appending, creating it if needed
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event file: %w", err)
+	}
+	return &FilePublisher{file: file}, nil
+}
+
+// Publish writes the event and syncs the file, so a published event survives
+// a crash
+func (p *FilePublisher) Publish(ctx context.Context, event Event) error {
+	line, err := json.Marshal(fileMessage{
+		Subject:   event.Subject(),
+		ID:        event.ID,
+		OrderID:   event.OrderID,
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt,
+		Data:      event.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+func (p *FilePublisher) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,45 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryPublisher hands events to subscribers in the same process. Events
+// published while nobody subscribes are dropped.
+type MemoryPublisher struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]func(Event)
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{subs: make(map[int]func(Event))}
+}
+
+// Publish calls every subscriber with the event before returning.
+// Subscribers must not block.
+func (p *MemoryPublisher) Publish(ctx context.Context, event Event) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, fn := range p.subs {
+		fn(event)
+	}
+	return nil
+}
+
+// Subscribe registers fn for every event published from now on and returns
+// a function that removes it
+func (p *MemoryPublisher) Subscribe(fn func(Event)) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.next
+	p.next++
+	p.subs[id] = fn
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.subs, id)
+	}
+}
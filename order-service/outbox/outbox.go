@@ -0,0 +1,118 @@
+// Package outbox publishes order domain events. Events are written to an
+// outbox table in the transaction that makes the change they describe and a
+// Relay hands them to a Publisher afterwards, so an event is never lost and
+// never published for a change that rolled back. Delivery is at least once:
+// consumers must ignore events whose ID they have already seen.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	TypeOrderCreated         = "OrderCreated"
+	TypeOrderStatusChanged   = "OrderStatusChanged"
+	TypePaymentStatusChanged = "PaymentStatusChanged"
+)
+
+// Event is an entry of the outbox
+type Event struct {
+	// Seq orders the events; it is assigned when the event is stored
+	Seq       int64
+	ID        string
+	OrderID   string
+	Type      string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	// Attempts counts the failed attempts to publish the event
+	Attempts int
+}
+
+// Subject is the topic the event is published on, e.g. orders.OrderCreated
+func (e Event) Subject() string {
+	return "orders." + e.Type
+}
+
+// New returns an event of type typ for the order with payload encoded as
+// JSON
+func New(orderID, typ string, payload interface{}) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("failed to encode %s event: %w", typ, err)
+	}
+	return Event{
+		ID:        uuid.New().String(),
+		OrderID:   orderID,
+		Type:      typ,
+		Payload:   data,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// OrderCreated is published when an order is placed. Amounts are decimal
+// strings in Currency.
+type OrderCreated struct {
+	OrderID   string      `json:"order_id"`
+	UserID    string      `json:"user_id"`
+	Status    string      `json:"status"`
+	Currency  string      `json:"currency"`
+	Total     string      `json:"total"`
+	Items     []OrderItem `json:"items"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type OrderItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int32  `json:"quantity"`
+	UnitPrice string `json:"unit_price"`
+}
+
+// OrderStatusChanged is published for every status change of an order.
+// Version is the order version after the change.
+type OrderStatusChanged struct {
+	OrderID string `json:"order_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Version int64  `json:"version"`
+	Actor   string `json:"actor,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// PaymentStatusChanged is published whenever a payment result is recorded,
+// including partial refunds that leave the status as it was. Refunded is the
+// amount paid back by this change.
+type PaymentStatusChanged struct {
+	OrderID   string `json:"order_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Reference string `json:"reference,omitempty"`
+	Currency  string `json:"currency,omitempty"`
+	Refunded  string `json:"refunded,omitempty"`
+}
+
+// Publisher delivers events to downstream systems. Publish must not return
+// before the event is durably handed over; an error makes the relay retry.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Store is the outbox table
+type Store interface {
+	// PendingEvents returns up to limit unpublished events with a Seq
+	// greater than after, in Seq order. An order whose earliest unpublished
+	// event is not due for a retry at now contributes no events, so the
+	// events of one order stay in order.
+	PendingEvents(ctx context.Context, now time.Time, after int64, limit int) ([]Event, error)
+	MarkEventPublished(ctx context.Context, id string) error
+	// MarkEventFailed counts a failed attempt and schedules the next one
+	MarkEventFailed(ctx context.Context, id string, retryAt time.Time, cause string) error
+	// DeletePublishedEvents removes up to limit events published before
+	// before
+	DeletePublishedEvents(ctx context.Context, before time.Time, limit int) (int64, error)
+}
@@ -0,0 +1,150 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RelayConfig controls how often the outbox is polled and how failed
+// publishes are retried. Failed events wait MinBackoff, doubling with every
+// further failure up to MaxBackoff. Published events are deleted once they
+// are older than Retention; zero keeps them.
+type RelayConfig struct {
+	PollInterval time.Duration
+	BatchSize    int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	Retention    time.Duration
+}
+
+// Relay moves events from the outbox to a publisher. Run a single relay per
+// database: two relays would each keep the events of an order in order, but
+// not relative to each other.
+type Relay struct {
+	store     Store
+	publisher Publisher
+	cfg       RelayConfig
+	logger    *zap.Logger
+}
+
+func NewRelay(store Store, publisher Publisher, cfg RelayConfig, logger *zap.Logger) *Relay {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+
+	return &Relay{
+		store:     store,
+		publisher: publisher,
+		cfg:       cfg,
+		logger:    logger,
+	}
+}
+
+// Run publishes pending events until ctx is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Flush(ctx); err != nil {
+				r.logger.Error("failed to relay outbox events", zap.Error(err))
+			}
+			r.purge(ctx)
+		}
+	}
+}
+
+// Flush walks the outbox once, publishing the events that are due, and
+// returns how many were published. Once an event of an order fails, the
+// order's later events wait for it.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	var (
+		published int
+		after     int64
+	)
+	blocked := make(map[string]bool)
+	for {
+		events, err := r.store.PendingEvents(ctx, time.Now(), after, r.cfg.BatchSize)
+		if err != nil {
+			return published, err
+		}
+
+		for _, event := range events {
+			after = event.Seq
+			if blocked[event.OrderID] {
+				continue
+			}
+
+			if err := r.publisher.Publish(ctx, event); err != nil {
+				blocked[event.OrderID] = true
+				retryAt := time.Now().Add(r.backoff(event.Attempts + 1))
+				r.logger.Warn("failed to publish event",
+					zap.String("event_id", event.ID),
+					zap.String("order_id", event.OrderID),
+					zap.Int("attempts", event.Attempts+1),
+					zap.Time("retry_at", retryAt),
+					zap.Error(err),
+				)
+				if err := r.store.MarkEventFailed(ctx, event.ID, retryAt, err.Error()); err != nil {
+					return published, err
+				}
+				continue
+			}
+
+			// If this fails the event is published again later, which at
+			// least once delivery allows
+			if err := r.store.MarkEventPublished(ctx, event.ID); err != nil {
+				return published, err
+			}
+			published++
+		}
+
+		if len(events) < r.cfg.BatchSize {
+			return published, nil
+		}
+	}
+}
+
+// backoff returns how long to wait before the given attempt
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.cfg.MinBackoff
+	for i := 1; i < attempts && wait < r.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.cfg.MaxBackoff {
+		wait = r.cfg.MaxBackoff
+	}
+	return wait
+}
+
+func (r *Relay) purge(ctx context.Context) {
+	if r.cfg.Retention <= 0 {
+		return
+	}
+	deleted, err := r.store.DeletePublishedEvents(ctx, time.Now().Add(-r.cfg.Retention), r.cfg.BatchSize)
+	if err != nil {
+		r.logger.Error("failed to delete published events", zap.Error(err))
+		return
+	}
+	if deleted > 0 {
+		r.logger.Info("deleted published events", zap.Int64("count", deleted))
+	}
+}
@@ -0,0 +1,137 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+// DeclinedMinorUnits makes FakeProvider decline authorizations whose amount,
+// in minor units, ends in these two digits, e.g. 10.13 USD or 413 JPY
+const DeclinedMinorUnits = 13
+
+type fakePayment struct {
+	amount   money.Money
+	captured bool
+	voided   bool
+	// refunds maps refund ids to their amounts
+	refunds  map[string]money.Money
+	refunded money.Money
+}
+
+// FakeProvider is a deterministic in-memory Provider for local development
+// and tests. References are derived from the order id, and authorizations are
+// declined only for amounts ending in DeclinedMinorUnits.
+type FakeProvider struct {
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{payments: make(map[string]*fakePayment)}
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if req.Amount.Minor <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrDeclined)
+	}
+	if req.Amount.Minor%100 == DeclinedMinorUnits {
+		return nil, fmt.Errorf("%w: card declined", ErrDeclined)
+	}
+
+	// A voided authorization is replaced, so that a request whose first
+	// authorization was released can be retried
+	reference := "fake_" + req.OrderID
+	if existing, ok := p.payments[reference]; ok && !existing.voided {
+		if existing.amount != req.Amount {
+			return nil, fmt.Errorf("%w: order already authorized for %s %s", ErrDeclined, existing.amount, existing.amount.Currency)
+		}
+		return &Result{Reference: reference}, nil
+	}
+
+	p.payments[reference] = &fakePayment{
+		amount:   req.Amount,
+		refunds:  make(map[string]money.Money),
+		refunded: money.Zero(req.Amount.Currency),
+	}
+	return &Result{Reference: reference}, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, reference string, amount money.Money) (*Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, err := p.lookup(reference)
+	if err != nil {
+		return nil, err
+	}
+	if payment.voided {
+		return nil, fmt.Errorf("%w: authorization was voided", ErrDeclined)
+	}
+	if cmp, err := amount.Cmp(payment.amount); err != nil || cmp > 0 {
+		return nil, fmt.Errorf("%w: capture exceeds the authorized amount", ErrDeclined)
+	}
+
+	payment.captured = true
+	return &Result{Reference: reference}, nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, req RefundRequest) (*Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, err := p.lookup(req.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if !payment.captured {
+		return nil, fmt.Errorf("%w: nothing was captured", ErrDeclined)
+	}
+	if previous, ok := payment.refunds[req.RefundID]; ok {
+		if previous != req.Amount {
+			return nil, fmt.Errorf("%w: refund %s was for %s", ErrDeclined, req.RefundID, previous)
+		}
+		return &Result{Reference: req.Reference}, nil
+	}
+
+	refunded, err := payment.refunded.Add(req.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDeclined, err)
+	}
+	if cmp, err := refunded.Cmp(payment.amount); err != nil || cmp > 0 {
+		return nil, fmt.Errorf("%w: refunds exceed the captured amount", ErrDeclined)
+	}
+
+	payment.refunds[req.RefundID] = req.Amount
+	payment.refunded = refunded
+	return &Result{Reference: req.Reference}, nil
+}
+
+func (p *FakeProvider) Void(ctx context.Context, reference string) (*Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, err := p.lookup(reference)
+	if err != nil {
+		return nil, err
+	}
+	if payment.captured {
+		return nil, fmt.Errorf("%w: captured payments must be refunded", ErrDeclined)
+	}
+
+	payment.voided = true
+	return &Result{Reference: reference}, nil
+}
+
+func (p *FakeProvider) lookup(reference string) (*fakePayment, error) {
+	payment, ok := p.payments[reference]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown payment %q", ErrDeclined, reference)
+	}
+	return payment, nil
+}
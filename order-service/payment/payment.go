@@ -0,0 +1,77 @@
+// Package payment abstracts the payment provider that authorizes, captures,
+// refunds and voids order payments, and defines the payment state machine.
+package payment
+
+import (
+	"context"
+	"errors"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+// ErrDeclined is returned when the provider refuses the operation, e.g. for
+// insufficient funds. Other errors are treated as transient.
+var ErrDeclined = errors.New("payment declined")
+
+// Provider is a payment service provider. Every call is idempotent for the
+// same order, so a retried request does not charge twice.
+type Provider interface {
+	// Authorize reserves the amount on the customer's payment method
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Result, error)
+	// Capture collects an authorized amount
+	Capture(ctx context.Context, reference string, amount money.Money) (*Result, error)
+	// Refund returns all or part of a captured amount to the customer. The
+	// refunds of a payment may not add up to more than was captured.
+	Refund(ctx context.Context, req RefundRequest) (*Result, error)
+	// Void releases an authorization that was not captured
+	Void(ctx context.Context, reference string) (*Result, error)
+}
+
+type AuthorizeRequest struct {
+	OrderID   string
+	PaymentID string
+	Amount    money.Money
+	Method    orderv1.PaymentMethod
+}
+
+type RefundRequest struct {
+	Reference string
+	// RefundID makes the call idempotent, so retrying a partial refund does
+	// not return the money twice
+	RefundID string
+	Amount   money.Money
+}
+
+// Result is the provider's answer to a successful call
+type Result struct {
+	// Reference identifies the payment at the provider and is passed to
+	// later calls
+	Reference string
+}
+
+// transitions lists the payment statuses reachable from each status
+var transitions = map[orderv1.PaymentStatus][]orderv1.PaymentStatus{
+	orderv1.PaymentStatus_PAYMENT_STATUS_PENDING: {
+		orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED,
+		orderv1.PaymentStatus_PAYMENT_STATUS_FAILED,
+	},
+	orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED: {
+		orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+		orderv1.PaymentStatus_PAYMENT_STATUS_FAILED,
+		orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED,
+	},
+	orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED: {
+		orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED,
+	},
+}
+
+// CanTransition reports whether a payment may move from one status to another
+func CanTransition(from, to orderv1.PaymentStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
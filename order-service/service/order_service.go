@@ -16,6 +16,8 @@ import (
 		userpb "github.com/zabilal/microservices/pkg/genproto/user/v1"
 		"github.com/zabilal/microservices/internal/pkg/logger"
 		"github.com/zabilal/microservices/internal/order/repository"
+		"github.com/zabilal/microservices/order-service/lifecycle"
+		"github.com/zabilal/microservices/pkg/money"
 )
 
 type OrderService struct {
@@ -50,7 +52,7 @@ func (s *OrderService) CreateOrder(ctx context.Context, req *pb.CreateOrderReque
 		g, ctx := errgroup.WithContext(ctx)
 
 		var user *userpb.User
-		var totalAmount float64
+		var totalAmount money.Money
 
 		// Fetch user details concurrently
 		g.Go(func() error {
@@ -66,9 +68,22 @@ func (s *OrderService) CreateOrder(ctx context.Context, req *pb.CreateOrderReque
 
 		// Calculate total amount concurrently
 		g.Go(func() error {
-				var sum float64
-				for _, item := range req.Items {
-						sum += float64(item.Quantity) * item.UnitPrice
+				var sum money.Money
+				for i, item := range req.Items {
+						price, err := money.FromProto(item.Price)
+						if err != nil {
+								return status.Errorf(codes.InvalidArgument, "invalid unit price: %v", err)
+						}
+						if i == 0 {
+								sum = money.Zero(price.Currency)
+						}
+						line, err := price.Mul(int64(item.Quantity))
+						if err != nil {
+								return status.Errorf(codes.InvalidArgument, "invalid unit price: %v", err)
+						}
+						if sum, err = sum.Add(line); err != nil {
+								return status.Errorf(codes.InvalidArgument, "invalid unit price: %v", err)
+						}
 				}
 				totalAmount = sum
 				return nil
@@ -85,7 +100,7 @@ func (s *OrderService) CreateOrder(ctx context.Context, req *pb.CreateOrderReque
 				Id:          uuid.New().String(),
 				UserId:      req.UserId,
 				Items:       req.Items,
-				TotalAmount: totalAmount,
+				Total:       money.ToProto(totalAmount),
 				Status:      pb.OrderStatus_ORDER_STATUS_PENDING,
 				User:        user,
 				CreatedAt:   ptypes.TimestampNow(),
@@ -123,8 +138,8 @@ func (s *OrderService) UpdateOrderStatus(ctx context.Context, req *pb.UpdateOrde
 		}
 
 		// Validate status transition
-		if !isValidStatusTransition(order.Status, req.Status) {
-				return nil, status.Error(codes.InvalidArgument, "invalid status transition")
+		if err := lifecycle.Check(order.Status, req.Status); err != nil {
+				return nil, status.Convert(err).Err()
 		}
 
 		order.Status = req.Status
@@ -151,36 +166,9 @@ func validateCreateOrderRequest(req *pb.CreateOrderRequest) error {
 				if item.Quantity <= 0 {
 						return status.Error(codes.InvalidArgument, "item quantity must be positive")
 				}
-				if item.UnitPrice <= 0 {
+				if item.Price.GetUnits() <= 0 && item.Price.GetNanos() <= 0 {
 						return status.Error(codes.InvalidArgument, "item unit price must be positive")
 				}
 		}
 		return nil
 }
-
-func isValidStatusTransition(current, new pb.OrderStatus) bool {
-		// Define valid status transitions
-		transitions := map[pb.OrderStatus][]pb.OrderStatus{
-				pb.OrderStatus_ORDER_STATUS_PENDING: {
-						pb.OrderStatus_ORDER_STATUS_PROCESSING,
-						pb.OrderStatus_ORDER_STATUS_CANCELLED,
-				},
-				pb.OrderStatus_ORDER_STATUS_PROCESSING: {
-						pb.OrderStatus_ORDER_STATUS_COMPLETED,
-						pb.OrderStatus_ORDER_STATUS_FAILED,
-				},
-		}
-
-		validTransitions, exists := transitions[current]
-		if !exists {
-				return false
-		}
-
-		for _, validStatus := range validTransitions {
-				if new == validStatus {
-						return true
-				}
-		}
-
-		return false
-}
\ No newline at end of file
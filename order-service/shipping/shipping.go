@@ -0,0 +1,31 @@
+// Package shipping defines the shipment state machine.
+package shipping
+
+import (
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// transitions lists the shipping statuses reachable from each status
+var transitions = map[orderv1.ShippingStatus][]orderv1.ShippingStatus{
+	orderv1.ShippingStatus_SHIPPING_STATUS_PENDING: {
+		orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED,
+		orderv1.ShippingStatus_SHIPPING_STATUS_CANCELLED,
+	},
+	orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED: {
+		orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED,
+	},
+	orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED: {
+		orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED,
+	},
+}
+
+// CanTransition reports whether a shipment may move from one status to
+// another
+func CanTransition(from, to orderv1.ShippingStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
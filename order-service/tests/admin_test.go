@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// exportStream collects the batches ExportOrders sends
+type exportStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	batches [][]*orderv1.Order
+}
+
+func (s *exportStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *exportStream) Send(resp *orderv1.ExportOrdersResponse) error {
+	s.batches = append(s.batches, resp.Orders)
+	return nil
+}
+
+func TestAdminListOrders(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	first := placeOrder(t, h, "user-1")
+	second := placeOrder(t, h, "user-2")
+	admin := asUser("admin-1", "admin")
+
+	resp, err := h.AdminListOrders(admin, &orderv1.AdminListOrdersRequest{})
+	require.NoError(t, err)
+	owners := make(map[string]string)
+	for _, order := range resp.Orders {
+		owners[order.Id] = order.User.GetId()
+	}
+	require.Equal(t, map[string]string{first.Id: "user-1", second.Id: "user-2"}, owners)
+
+	resp, err = h.AdminListOrders(admin, &orderv1.AdminListOrdersRequest{UserId: "user-2"})
+	require.NoError(t, err)
+	require.Len(t, resp.Orders, 1)
+	require.Equal(t, second.Id, resp.Orders[0].Id)
+
+	// Pages continue across users
+	page, err := h.AdminListOrders(admin, &orderv1.AdminListOrdersRequest{PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, page.Orders, 1)
+	next, err := h.AdminListOrders(admin, &orderv1.AdminListOrdersRequest{PageSize: 1, PageToken: page.NextPageToken})
+	require.NoError(t, err)
+	require.Len(t, next.Orders, 1)
+	require.ElementsMatch(t, []string{first.Id, second.Id}, []string{page.Orders[0].Id, next.Orders[0].Id})
+	require.Empty(t, next.NextPageToken)
+}
+
+func TestAdminListOrdersRequiresAdmin(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	placeOrder(t, h, "user-1")
+
+	_, err := h.AdminListOrders(asUser("user-1", ""), &orderv1.AdminListOrdersRequest{UserId: "user-1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	err = h.ExportOrders(&orderv1.ExportOrdersRequest{}, &exportStream{ctx: asUser("user-1", "")})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestExportOrders(t *testing.T) {
+	repo := stockedRepo(t)
+	_, err := repo.AdjustStock(context.Background(), handler.StockAdjustment{ProductID: "p1", Delta: 1000})
+	require.NoError(t, err)
+	h := newTestOrderHandler(t, repo, testCatalog())
+
+	// One more order than fits in a batch
+	want := make(map[string]bool)
+	for i := 0; i < 501; i++ {
+		order := placeOrder(t, h, []string{"user-1", "user-2"}[i%2])
+		want[order.Id] = true
+	}
+
+	stream := &exportStream{ctx: asUser("admin-1", "admin")}
+	err = h.ExportOrders(&orderv1.ExportOrdersRequest{OrderBy: orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT}, stream)
+	require.NoError(t, err)
+	require.Len(t, stream.batches, 2)
+	require.Len(t, stream.batches[0], 500)
+	require.Len(t, stream.batches[1], 1)
+
+	got := make(map[string]bool)
+	for _, batch := range stream.batches {
+		for _, order := range batch {
+			require.False(t, got[order.Id], "order %s exported twice", order.Id)
+			got[order.Id] = true
+			require.Equal(t, order.UserId, order.User.GetId())
+		}
+	}
+	require.Equal(t, want, got)
+}
+
+func TestExportOrdersFilters(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	placeOrder(t, h, "user-1")
+	other := placeOrder(t, h, "user-2")
+	admin := asUser("admin-1", "admin")
+
+	stream := &exportStream{ctx: admin}
+	require.NoError(t, h.ExportOrders(&orderv1.ExportOrdersRequest{UserId: "user-2"}, stream))
+	require.Len(t, stream.batches, 1)
+	require.Equal(t, other.Id, stream.batches[0][0].Id)
+
+	// Nothing matching sends nothing
+	stream = &exportStream{ctx: admin}
+	require.NoError(t, h.ExportOrders(&orderv1.ExportOrdersRequest{Filter: &orderv1.OrderFilter{ProductId: "p2"}}, stream))
+	require.Empty(t, stream.batches)
+
+	err := h.ExportOrders(&orderv1.ExportOrdersRequest{OrderBy: orderv1.OrderBy(9)}, &exportStream{ctx: admin})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
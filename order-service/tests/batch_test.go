@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func TestBatchGetOrders(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	first := placeOrder(t, h)
+	second := placeOrder(t, h)
+
+	resp, err := h.BatchGetOrders(context.Background(), &orderv1.BatchGetOrdersRequest{
+		OrderIds: []string{second.Id, "missing", first.Id, second.Id},
+	})
+	require.NoError(t, err)
+
+	var ids []string
+	for _, order := range resp.Orders {
+		ids = append(ids, order.Id)
+		require.Equal(t, "user-1", order.User.GetId())
+	}
+	require.Equal(t, []string{second.Id, first.Id, second.Id}, ids)
+	require.Equal(t, []string{"missing"}, resp.MissingOrderIds)
+}
+
+func TestBatchGetOrdersAccess(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := placeOrder(t, h)
+
+	// Another user's order is missing rather than forbidden, as in GetOrder
+	resp, err := h.BatchGetOrders(asUser("user-2", ""), &orderv1.BatchGetOrdersRequest{OrderIds: []string{order.Id}})
+	require.NoError(t, err)
+	require.Empty(t, resp.Orders)
+	require.Equal(t, []string{order.Id}, resp.MissingOrderIds)
+
+	resp, err = h.BatchGetOrders(asUser("user-1", ""), &orderv1.BatchGetOrdersRequest{OrderIds: []string{order.Id}})
+	require.NoError(t, err)
+	require.Len(t, resp.Orders, 1)
+
+	ids := make([]string, 101)
+	for i := range ids {
+		ids[i] = order.Id
+	}
+	_, err = h.BatchGetOrders(context.Background(), &orderv1.BatchGetOrdersRequest{OrderIds: ids})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBatchUpdateOrderStatus(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	moved := placeOrder(t, h)
+	stale := placeOrder(t, h)
+
+	resp, err := h.BatchUpdateOrderStatus(asUser("admin-1", "admin"), &orderv1.BatchUpdateOrderStatusRequest{
+		Requests: []*orderv1.UpdateOrderStatusRequest{
+			{OrderId: moved.Id, Status: orderv1.OrderStatus_ORDER_STATUS_PROCESSING},
+			{OrderId: stale.Id, Status: orderv1.OrderStatus_ORDER_STATUS_PROCESSING, ExpectedVersion: stale.Version + 1},
+			{OrderId: "missing", Status: orderv1.OrderStatus_ORDER_STATUS_PROCESSING},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Results, 3)
+
+	require.Nil(t, resp.Results[0].Error)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, resp.Results[0].Order.Status)
+	require.Equal(t, moved.Version+1, resp.Results[0].Order.Version)
+	require.Equal(t, "user-1", resp.Results[0].Order.User.GetId())
+
+	require.Nil(t, resp.Results[1].Order)
+	require.Equal(t, int32(codes.Aborted), resp.Results[1].Error.Code)
+	require.Equal(t, int32(codes.NotFound), resp.Results[2].Error.Code)
+
+	// The failed change left its order alone
+	unchanged, err := repo.GetOrder(context.Background(), stale.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PENDING, unchanged.Status)
+	require.Equal(t, stale.Version, unchanged.Version)
+}
+
+func TestBatchUpdateOrderStatusAllOrNothing(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	first := placeOrder(t, h)
+	second := placeOrder(t, h)
+	events := len(repo.outbox)
+
+	resp, err := h.BatchUpdateOrderStatus(asUser("admin-1", "admin"), &orderv1.BatchUpdateOrderStatusRequest{
+		Requests: []*orderv1.UpdateOrderStatusRequest{
+			{OrderId: first.Id, Status: orderv1.OrderStatus_ORDER_STATUS_PROCESSING},
+			// PENDING cannot move to COMPLETED directly
+			{OrderId: second.Id, Status: orderv1.OrderStatus_ORDER_STATUS_COMPLETED},
+		},
+		AllOrNothing: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(codes.Aborted), resp.Results[0].Error.Code)
+	require.Equal(t, int32(codes.FailedPrecondition), resp.Results[1].Error.Code)
+
+	for _, id := range []string{first.Id, second.Id} {
+		order, err := repo.GetOrder(context.Background(), id)
+		require.NoError(t, err)
+		require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PENDING, order.Status)
+	}
+	require.Len(t, repo.outbox, events)
+}
+
+func TestBatchUpdateOrderStatusCancels(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+	order := authorizedOrder(t, h)
+
+	resp, err := h.BatchUpdateOrderStatus(asUser("admin-1", "admin"), &orderv1.BatchUpdateOrderStatusRequest{
+		Requests: []*orderv1.UpdateOrderStatusRequest{
+			{OrderId: order.Id, Status: orderv1.OrderStatus_ORDER_STATUS_CANCELLED, Reason: "fraud"},
+		},
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.Results[0].Error)
+
+	cancelled := resp.Results[0].Order
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_CANCELLED, cancelled.Status)
+	require.Equal(t, "fraud", cancelled.CancelReason)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED, cancelled.PaymentInfo.Status)
+	require.Equal(t, 1, payments.voids)
+}
+
+func TestBatchUpdateOrderStatusRequiresAdmin(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := placeOrder(t, h)
+
+	_, err := h.BatchUpdateOrderStatus(asUser("user-1", ""), &orderv1.BatchUpdateOrderStatusRequest{
+		Requests: []*orderv1.UpdateOrderStatusRequest{
+			{OrderId: order.Id, Status: orderv1.OrderStatus_ORDER_STATUS_PROCESSING},
+		},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// placeOrder creates an order through the handler for user-1, or for userID
+// when one is given
+func placeOrder(t *testing.T, h *handler.OrderHandler, userID ...string) *orderv1.Order {
+	req := createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 1})
+	if len(userID) > 0 {
+		req.UserId = userID[0]
+	}
+	resp, err := h.CreateOrder(context.Background(), req)
+	require.NoError(t, err)
+	return resp.Order
+}
+
+func TestCancelOrderFromStatus(t *testing.T) {
+	tests := []struct {
+		from orderv1.OrderStatus
+		want codes.Code
+	}{
+		{orderv1.OrderStatus_ORDER_STATUS_PENDING, codes.OK},
+		{orderv1.OrderStatus_ORDER_STATUS_PROCESSING, codes.OK},
+		{orderv1.OrderStatus_ORDER_STATUS_COMPLETED, codes.FailedPrecondition},
+		{orderv1.OrderStatus_ORDER_STATUS_FAILED, codes.FailedPrecondition},
+		{orderv1.OrderStatus_ORDER_STATUS_CANCELLED, codes.FailedPrecondition},
+		{orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED, codes.FailedPrecondition},
+		{orderv1.OrderStatus_ORDER_STATUS_RETURNED, codes.FailedPrecondition},
+		{orderv1.OrderStatus_ORDER_STATUS_REFUNDED, codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from.String(), func(t *testing.T) {
+			repo := stockedRepo(t)
+			h := newTestOrderHandler(t, repo, testCatalog())
+			order := placeOrder(t, h)
+			repo.setStatus(order.Id, tt.from)
+
+			resp, err := h.CancelOrder(asUser("user-1", ""), &orderv1.CancelOrderRequest{
+				OrderId: order.Id,
+				Reason:  "changed my mind",
+			})
+			require.Equal(t, tt.want, status.Code(err), "%v", err)
+			if tt.want != codes.OK {
+				stored, err := repo.GetOrder(context.Background(), order.Id)
+				require.NoError(t, err)
+				require.Equal(t, tt.from, stored.Status)
+				return
+			}
+
+			require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_CANCELLED, resp.Order.Status)
+			require.Equal(t, "changed my mind", resp.Order.CancelReason)
+			require.NotNil(t, resp.Order.CancelledAt)
+			require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_CANCELLED, resp.Order.ShippingInfo.Status)
+		})
+	}
+}
+
+func TestCancelShippedOrder(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := placeOrder(t, h)
+	repo.orders[order.Id].ShippingInfo.Status = orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED
+
+	_, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestCancelOrderOfAnotherUser(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := placeOrder(t, h)
+
+	_, err := h.CancelOrder(asUser("user-2", ""), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Admins may cancel any order
+	_, err = h.CancelOrder(asUser("admin-1", "admin"), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+}
+
+func TestCancelOrderStaleVersion(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := placeOrder(t, h)
+
+	_, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{
+		OrderId:         order.Id,
+		ExpectedVersion: order.Version + 1,
+	})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{
+		OrderId:         order.Id,
+		ExpectedVersion: order.Version,
+	})
+	require.NoError(t, err)
+}
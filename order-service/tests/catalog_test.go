@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+func testCatalog() *handler.MemoryCatalog {
+	return handler.NewMemoryCatalog(
+		handler.Product{ID: "p1", Name: "Widget", Price: money.Money{Currency: "USD", Minor: 1999}, Active: true},
+		handler.Product{ID: "p2", Name: "Gadget", Price: money.Money{Currency: "USD", Minor: 10}, Active: true},
+		handler.Product{ID: "retired", Name: "Old", Price: money.Money{Currency: "USD", Minor: 100}},
+		handler.Product{ID: "yen", Name: "Import", Price: money.Money{Currency: "JPY", Minor: 500}, Active: true},
+	)
+}
+
+func createOrderRequest(items ...*orderv1.OrderItem) *orderv1.CreateOrderRequest {
+	return &orderv1.CreateOrderRequest{
+		UserId:        "user-1",
+		Items:         items,
+		ShippingInfo:  &orderv1.ShippingInfo{AddressLine1: "1 Main St", City: "Springfield", Country: "US", PostalCode: "12345"},
+		PaymentMethod: orderv1.PaymentMethod_PAYMENT_METHOD_CREDIT_CARD,
+	}
+}
+
+// stockedRepo returns a repository with plenty of stock of every test product
+func stockedRepo(t *testing.T) *memoryOrderRepo {
+	repo := newMemoryOrderRepo()
+	for _, id := range []string{"p1", "p2", "retired", "yen"} {
+		_, err := repo.AdjustStock(context.Background(), handler.StockAdjustment{ProductID: id, Delta: 100})
+		require.NoError(t, err)
+	}
+	return repo
+}
+
+func TestCreateOrderUsesCatalogPrices(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+
+	resp, err := h.CreateOrder(context.Background(), createOrderRequest(
+		// Client supplied names and prices without an expectation are ignored
+		&orderv1.OrderItem{ProductId: "p1", Quantity: 2, ProductName: "Free stuff"},
+		&orderv1.OrderItem{ProductId: "p2", Quantity: 3},
+	))
+	require.NoError(t, err)
+
+	total, err := money.FromProto(resp.Order.Total)
+	require.NoError(t, err)
+	require.Equal(t, "40.28", total.String())
+	require.Equal(t, "Widget", resp.Order.Items[0].ProductName)
+
+	stored, err := repo.GetOrder(context.Background(), resp.Order.Id)
+	require.NoError(t, err)
+	require.Equal(t, money.Money{Currency: "USD", Minor: 1999}, stored.Items[0].UnitPrice)
+	require.Equal(t, "Widget", stored.Items[0].ProductName)
+}
+
+func TestCreateOrderRejectsBadItems(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+
+	tests := []struct {
+		name  string
+		items []*orderv1.OrderItem
+		code  codes.Code
+	}{
+		{
+			name:  "unknown product",
+			items: []*orderv1.OrderItem{{ProductId: "nope", Quantity: 1}},
+			code:  codes.InvalidArgument,
+		},
+		{
+			name:  "inactive product",
+			items: []*orderv1.OrderItem{{ProductId: "retired", Quantity: 1}},
+			code:  codes.FailedPrecondition,
+		},
+		{
+			name: "stale expected price",
+			items: []*orderv1.OrderItem{{
+				ProductId: "p1",
+				Quantity:  1,
+				Price:     money.ToProto(money.Money{Currency: "USD", Minor: 1}),
+			}},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "mixed currencies",
+			items: []*orderv1.OrderItem{
+				{ProductId: "p1", Quantity: 1},
+				{ProductId: "yen", Quantity: 1},
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.CreateOrder(context.Background(), createOrderRequest(tt.items...))
+			require.Error(t, err)
+			require.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
+
+func TestCreateOrderRequiresShippingInfo(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+
+	req := createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 1})
+	req.ShippingInfo = nil
+	_, err := h.CreateOrder(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Empty(t, repo.orders)
+}
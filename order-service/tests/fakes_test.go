@@ -0,0 +1,916 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	"github.com/zabilal/microservices/order-service/outbox"
+	"github.com/zabilal/microservices/order-service/payment"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+const testPageSecret = "0123456789abcdef0123456789abcdef"
+
+// memoryOrderRepo keeps orders in memory. Only the methods the handler tests
+// need are implemented.
+type memoryOrderRepo struct {
+	mu      sync.Mutex
+	orders  map[string]*handler.Order
+	stock   map[string]*handler.Stock
+	history map[string][]*handler.StatusChange
+	keys    map[string]*handler.IdempotencyKey
+	events  map[string]handler.PaymentEvent
+	returns map[string]*handler.Return
+	outbox  []*storedEvent
+}
+
+// storedEvent is a row of the outbox
+type storedEvent struct {
+	outbox.Event
+	published bool
+	retryAt   time.Time
+}
+
+func newMemoryOrderRepo() *memoryOrderRepo {
+	return &memoryOrderRepo{
+		orders:  make(map[string]*handler.Order),
+		stock:   make(map[string]*handler.Stock),
+		history: make(map[string][]*handler.StatusChange),
+		keys:    make(map[string]*handler.IdempotencyKey),
+		events:  make(map[string]handler.PaymentEvent),
+		returns: make(map[string]*handler.Return),
+	}
+}
+
+func (r *memoryOrderRepo) CreateOrder(ctx context.Context, order *handler.Order, key *handler.IdempotencyKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wanted := make(map[string]int32)
+	for _, item := range order.Items {
+		wanted[item.ProductID] += item.Quantity
+	}
+	for id, quantity := range wanted {
+		if stock, ok := r.stock[id]; !ok || stock.Available() < quantity {
+			return fmt.Errorf("%w for product %s", handler.ErrInsufficientStock, id)
+		}
+	}
+	if key != nil {
+		// An expired key that has not been swept yet may be reused
+		if claimed, ok := r.keys[idempotencyKeyID(key.UserID, key.Key)]; ok && !claimed.ExpiresAt.Before(key.CreatedAt) {
+			return handler.ErrIdempotencyKeyExists
+		}
+		claimed := *key
+		r.keys[idempotencyKeyID(key.UserID, key.Key)] = &claimed
+	}
+	for id, quantity := range wanted {
+		r.stock[id].Reserved += quantity
+	}
+
+	stored := *order
+	r.orders[order.ID] = &stored
+
+	items := make([]outbox.OrderItem, len(order.Items))
+	for i, item := range order.Items {
+		items[i] = outbox.OrderItem{ProductID: item.ProductID, Quantity: item.Quantity, UnitPrice: item.UnitPrice.String()}
+	}
+	return r.addEvent(order.ID, outbox.TypeOrderCreated, outbox.OrderCreated{
+		OrderID:   order.ID,
+		UserID:    order.UserID,
+		Status:    order.Status.String(),
+		Currency:  order.TotalAmount.Currency,
+		Total:     order.TotalAmount.String(),
+		Items:     items,
+		CreatedAt: order.CreatedAt,
+	})
+}
+
+func (r *memoryOrderRepo) GetOrder(ctx context.Context, id string) (*handler.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order, ok := r.orders[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	stored := *order
+	return &stored, nil
+}
+
+// ListOrders filters and sorts like the SQL repository. Totals are grouped
+// by currency and compared by their amount, as DECIMAL values are.
+func (r *memoryOrderRepo) ListOrders(ctx context.Context, filter handler.OrderFilter, page pagination.Page) ([]*handler.Order, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byTotal := filter.OrderBy == orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT
+	// before reports whether a sorts before b in ascending order
+	before := func(a, b pagination.Cursor) bool {
+		if byTotal && a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if aTotal, bTotal := parseAmount(a.Key), parseAmount(b.Key); byTotal && aTotal != bTotal {
+			return aTotal < bTotal
+		}
+		if !byTotal && !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	}
+
+	var orders []*handler.Order
+	for _, order := range r.orders {
+		if !matchesFilter(order, filter) {
+			continue
+		}
+		if after := page.After; after != nil {
+			if page.Desc && !before(sortKey(order), *after) || !page.Desc && !before(*after, sortKey(order)) {
+				continue
+			}
+		}
+		stored := *order
+		orders = append(orders, &stored)
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		a, b := orders[i], orders[j]
+		if page.Desc {
+			a, b = b, a
+		}
+		return before(sortKey(a), sortKey(b))
+	})
+
+	hasMore := len(orders) > int(page.Size)
+	if hasMore {
+		orders = orders[:page.Size]
+	}
+	return orders, hasMore, nil
+}
+
+// sortKey is the cursor position of order in either sort order
+func sortKey(order *handler.Order) pagination.Cursor {
+	return pagination.Cursor{
+		CreatedAt: order.CreatedAt,
+		Group:     order.TotalAmount.Currency,
+		Key:       order.TotalAmount.String(),
+		ID:        order.ID,
+	}
+}
+
+func parseAmount(s string) float64 {
+	value, _ := strconv.ParseFloat(s, 64)
+	return value
+}
+
+func matchesFilter(order *handler.Order, f handler.OrderFilter) bool {
+	if f.UserID != "" && order.UserID != f.UserID {
+		return false
+	}
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, s := range f.Statuses {
+			found = found || order.Status == s
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.CreatedAfter.IsZero() && order.CreatedAt.Before(f.CreatedAfter) ||
+		!f.CreatedBefore.IsZero() && !order.CreatedAt.Before(f.CreatedBefore) ||
+		!f.UpdatedAfter.IsZero() && order.UpdatedAt.Before(f.UpdatedAfter) ||
+		!f.UpdatedBefore.IsZero() && !order.UpdatedAt.Before(f.UpdatedBefore) {
+		return false
+	}
+	if f.MinTotal != nil {
+		if cmp, err := order.TotalAmount.Cmp(*f.MinTotal); err != nil || cmp < 0 {
+			return false
+		}
+	}
+	if f.MaxTotal != nil {
+		if cmp, err := order.TotalAmount.Cmp(*f.MaxTotal); err != nil || cmp > 0 {
+			return false
+		}
+	}
+	if f.PaymentStatus != orderv1.PaymentStatus_PAYMENT_STATUS_UNSPECIFIED && order.PaymentInfo.Status != f.PaymentStatus ||
+		f.PaymentMethod != orderv1.PaymentMethod_PAYMENT_METHOD_UNSPECIFIED && order.PaymentInfo.Method != f.PaymentMethod ||
+		f.ShippingCountry != "" && order.ShippingInfo.Country != f.ShippingCountry {
+		return false
+	}
+	if f.ProductID != "" {
+		found := false
+		for _, item := range order.Items {
+			found = found || item.ProductID == f.ProductID
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *memoryOrderRepo) UpdateOrderStatus(ctx context.Context, id string, t handler.Transition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.transition(id, t)
+}
+
+func (r *memoryOrderRepo) CancelOrder(ctx context.Context, id string, t handler.Transition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cancel(id, t)
+}
+
+func (r *memoryOrderRepo) GetOrders(ctx context.Context, ids []string) ([]*handler.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var orders []*handler.Order
+	for _, id := range ids {
+		if order, ok := r.orders[id]; ok {
+			stored := *order
+			orders = append(orders, &stored)
+		}
+	}
+	return orders, nil
+}
+
+func (r *memoryOrderRepo) UpdateOrderStatuses(ctx context.Context, updates []handler.StatusUpdate, atomic bool) ([]error, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	outcomes := make([]error, len(updates))
+	batch := r.snapshot()
+	for i, u := range updates {
+		item := r.snapshot()
+		if u.To == orderv1.OrderStatus_ORDER_STATUS_CANCELLED {
+			outcomes[i] = r.cancel(u.OrderID, u.Transition)
+		} else {
+			outcomes[i] = r.transition(u.OrderID, u.Transition)
+		}
+		if outcomes[i] == nil {
+			continue
+		}
+
+		if !atomic {
+			r.restore(item)
+			continue
+		}
+		r.restore(batch)
+		for j := range outcomes {
+			if outcomes[j] == nil {
+				outcomes[j] = handler.ErrBatchAborted
+			}
+		}
+		break
+	}
+	return outcomes, nil
+}
+
+// repoSnapshot holds what a status change touches, so a failed change can be
+// rolled back
+type repoSnapshot struct {
+	orders  map[string]handler.Order
+	history map[string][]*handler.StatusChange
+	outbox  int
+}
+
+func (r *memoryOrderRepo) snapshot() repoSnapshot {
+	snap := repoSnapshot{
+		orders:  make(map[string]handler.Order, len(r.orders)),
+		history: make(map[string][]*handler.StatusChange, len(r.history)),
+		outbox:  len(r.outbox),
+	}
+	for id, order := range r.orders {
+		snap.orders[id] = *order
+	}
+	for id, changes := range r.history {
+		snap.history[id] = changes
+	}
+	return snap
+}
+
+func (r *memoryOrderRepo) restore(snap repoSnapshot) {
+	for id, order := range snap.orders {
+		*r.orders[id] = order
+	}
+	r.history = snap.history
+	r.outbox = r.outbox[:snap.outbox]
+}
+
+// cancel cancels the order the way the SQL repository does, with r.mu held
+func (r *memoryOrderRepo) cancel(id string, t handler.Transition) error {
+	order, ok := r.orders[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	switch order.ShippingInfo.Status {
+	case orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED,
+		orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED,
+		orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED:
+		return handler.ErrOrderShipped
+	}
+
+	t.To = orderv1.OrderStatus_ORDER_STATUS_CANCELLED
+	if err := r.transition(id, t); err != nil {
+		return err
+	}
+
+	order.CancelReason = t.Reason
+	order.CancelledAt = sql.NullTime{Time: time.Now(), Valid: true}
+	order.ShippingInfo.Status = orderv1.ShippingStatus_SHIPPING_STATUS_CANCELLED
+	return nil
+}
+
+func (r *memoryOrderRepo) UpdatePayment(ctx context.Context, orderID string, u handler.PaymentUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updatePayment(orderID, u)
+}
+
+func (r *memoryOrderRepo) ApplyPaymentEvent(ctx context.Context, event handler.PaymentEvent, u *handler.PaymentUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.events[event.ID]; ok {
+		return handler.ErrDuplicatePaymentEvent
+	}
+	if u != nil {
+		if err := r.updatePayment(event.OrderID, *u); err != nil {
+			return err
+		}
+	}
+	r.events[event.ID] = event
+	return nil
+}
+
+func (r *memoryOrderRepo) UpdateShipping(ctx context.Context, orderID string, u handler.ShippingUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[orderID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if order.ShippingInfo.Status != u.From {
+		return handler.ErrShippingConflict
+	}
+	if u.Order.To != orderv1.OrderStatus_ORDER_STATUS_UNSPECIFIED {
+		if err := r.transition(orderID, u.Order); err != nil {
+			return err
+		}
+	} else {
+		if order.Version != u.Order.ExpectedVersion {
+			return handler.ErrVersionMismatch
+		}
+		order.Version++
+	}
+
+	now := sql.NullTime{Time: time.Now(), Valid: true}
+	switch u.To {
+	case orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED:
+		order.ShippingInfo.ShippedAt = now
+	case orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED:
+		order.ShippingInfo.DeliveredAt = now
+	}
+	order.ShippingInfo.Status = u.To
+	if u.Carrier != "" {
+		order.ShippingInfo.Carrier = u.Carrier
+	}
+	if u.TrackingNumber != "" {
+		order.ShippingInfo.TrackingNumber = u.TrackingNumber
+	}
+	return nil
+}
+
+func (r *memoryOrderRepo) CreateReturn(ctx context.Context, ret *handler.Return, t handler.Transition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	order, ok := r.orders[ret.OrderID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	switch order.Status {
+	case orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED:
+	case orderv1.OrderStatus_ORDER_STATUS_COMPLETED:
+		if err := r.transition(ret.OrderID, t); err != nil {
+			return err
+		}
+	default:
+		return lifecycle.Check(order.Status, t.To)
+	}
+
+	returnable := make(map[string]int32)
+	for _, item := range order.Items {
+		returnable[item.ProductID] += item.Quantity
+	}
+	for _, other := range r.returns {
+		if other.OrderID != ret.OrderID || other.Status == orderv1.ReturnStatus_RETURN_STATUS_REJECTED {
+			continue
+		}
+		for _, item := range other.Items {
+			returnable[item.ProductID] -= item.Quantity
+		}
+	}
+	for _, item := range ret.Items {
+		if item.Quantity > returnable[item.ProductID] {
+			return handler.ErrReturnQuantity
+		}
+	}
+
+	stored := *ret
+	r.returns[ret.ID] = &stored
+	return nil
+}
+
+func (r *memoryOrderRepo) GetReturn(ctx context.Context, id string) (*handler.Return, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret, ok := r.returns[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	stored := *ret
+	return &stored, nil
+}
+
+// ListReturns ignores the page cursor; tests only look at the first page
+func (r *memoryOrderRepo) ListReturns(ctx context.Context, filter handler.ReturnFilter, page pagination.Page) ([]*handler.Return, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var returns []*handler.Return
+	for _, ret := range r.returns {
+		if filter.OrderID != "" && ret.OrderID != filter.OrderID {
+			continue
+		}
+		if filter.OrderID == "" && ret.UserID != filter.UserID {
+			continue
+		}
+		stored := *ret
+		returns = append(returns, &stored)
+	}
+	sort.Slice(returns, func(i, j int) bool {
+		return returns[i].CreatedAt.After(returns[j].CreatedAt)
+	})
+
+	hasMore := len(returns) > int(page.Size)
+	if hasMore {
+		returns = returns[:page.Size]
+	}
+	return returns, hasMore, nil
+}
+
+func (r *memoryOrderRepo) UpdateReturnStatus(ctx context.Context, id string, from orderv1.ReturnStatus, d handler.ReturnDecision) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.returns[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if stored.Status != from {
+		return handler.ErrReturnConflict
+	}
+	stored.Status = d.To
+	stored.DecisionReason = d.Reason
+	stored.UpdatedAt = time.Now()
+	return nil
+}
+
+func (r *memoryOrderRepo) ListRefundingReturns(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []string
+	for id, ret := range r.returns {
+		if len(ids) == limit {
+			break
+		}
+		if ret.Status == orderv1.ReturnStatus_RETURN_STATUS_REFUNDING && ret.UpdatedAt.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *memoryOrderRepo) ResolveReturn(ctx context.Context, ret *handler.Return, d handler.ReturnDecision) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.returns[ret.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	from := orderv1.ReturnStatus_RETURN_STATUS_REQUESTED
+	if d.To == orderv1.ReturnStatus_RETURN_STATUS_REFUNDED {
+		from = orderv1.ReturnStatus_RETURN_STATUS_REFUNDING
+	}
+	if stored.Status != from {
+		return handler.ErrReturnConflict
+	}
+	order := r.orders[ret.OrderID]
+
+	fullyRefunded := false
+	if d.To == orderv1.ReturnStatus_RETURN_STATUS_REFUNDED {
+		refunded, err := order.PaymentInfo.Refunded.Add(ret.Refund)
+		if err != nil {
+			return err
+		}
+		fullyRefunded = refunded == order.TotalAmount
+		u := handler.PaymentUpdate{
+			From:      orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+			To:        orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED,
+			Reference: d.Reference,
+			Refunded:  ret.Refund,
+		}
+		if fullyRefunded {
+			u.To = orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED
+		}
+		if err := r.updatePayment(ret.OrderID, u); err != nil {
+			return err
+		}
+	}
+	stored.Status = d.To
+	if d.To != orderv1.ReturnStatus_RETURN_STATUS_REFUNDED {
+		stored.DecisionReason = d.Reason
+	}
+	stored.UpdatedAt = time.Now()
+
+	var bought, returned int32
+	for _, item := range order.Items {
+		bought += item.Quantity
+	}
+	open := false
+	for _, other := range r.returns {
+		if other.OrderID != ret.OrderID {
+			continue
+		}
+		switch other.Status {
+		case orderv1.ReturnStatus_RETURN_STATUS_REQUESTED, orderv1.ReturnStatus_RETURN_STATUS_REFUNDING:
+			open = true
+		case orderv1.ReturnStatus_RETURN_STATUS_REFUNDED:
+			for _, item := range other.Items {
+				returned += item.Quantity
+			}
+		}
+	}
+
+	t := handler.Transition{Actor: d.Actor, Reason: d.Reason}
+	switch {
+	case returned == bought:
+		order.ShippingInfo.Status = orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED
+		t.To = orderv1.OrderStatus_ORDER_STATUS_RETURNED
+		if err := r.transition(ret.OrderID, t); err != nil {
+			return err
+		}
+		if fullyRefunded {
+			t.To = orderv1.OrderStatus_ORDER_STATUS_REFUNDED
+			return r.transition(ret.OrderID, t)
+		}
+	case !open:
+		t.To = orderv1.OrderStatus_ORDER_STATUS_COMPLETED
+		return r.transition(ret.OrderID, t)
+	}
+	return nil
+}
+
+// updatePayment applies u with r.mu held
+func (r *memoryOrderRepo) updatePayment(orderID string, u handler.PaymentUpdate) error {
+	order, ok := r.orders[orderID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if order.PaymentInfo.Status != u.From {
+		return handler.ErrPaymentConflict
+	}
+	changed := outbox.PaymentStatusChanged{OrderID: orderID, From: u.From.String(), To: u.To.String(), Reference: u.Reference}
+	if !u.Refunded.IsZero() {
+		changed.Currency = u.Refunded.Currency
+		changed.Refunded = u.Refunded.String()
+	}
+	if err := r.addEvent(orderID, outbox.TypePaymentStatusChanged, changed); err != nil {
+		return err
+	}
+	if u.Order != nil {
+		if err := r.transition(orderID, *u.Order); err != nil {
+			return err
+		}
+	}
+
+	if !u.Refunded.IsZero() {
+		refunded, err := order.PaymentInfo.Refunded.Add(u.Refunded)
+		if err != nil {
+			return err
+		}
+		order.PaymentInfo.Refunded = refunded
+	}
+	order.PaymentInfo.Status = u.To
+	if u.Reference != "" {
+		order.PaymentInfo.Reference = u.Reference
+	}
+	if u.Order == nil {
+		order.Version++
+	}
+	return nil
+}
+
+func (r *memoryOrderRepo) ListPendingPaymentReturns(ctx context.Context, limit int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []string
+	for id, order := range r.orders {
+		if len(ids) == limit {
+			break
+		}
+		if order.Status != orderv1.OrderStatus_ORDER_STATUS_CANCELLED {
+			continue
+		}
+		switch order.PaymentInfo.Status {
+		case orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED:
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// transition applies a status change the way the SQL repository does,
+// without stock bookkeeping
+func (r *memoryOrderRepo) transition(id string, t handler.Transition) error {
+	order, ok := r.orders[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if t.ExpectedVersion != 0 && order.Version != t.ExpectedVersion {
+		return handler.ErrVersionMismatch
+	}
+	if err := lifecycle.Check(order.Status, t.To); err != nil {
+		return err
+	}
+
+	r.history[id] = append(r.history[id], &handler.StatusChange{
+		ID:         fmt.Sprintf("%s-%d", id, len(r.history[id])+1),
+		OrderID:    id,
+		FromStatus: order.Status,
+		ToStatus:   t.To,
+		Actor:      t.Actor,
+		Reason:     t.Reason,
+		CreatedAt:  time.Now(),
+	})
+	from := order.Status
+	order.Status = t.To
+	order.Version++
+	return r.addEvent(id, outbox.TypeOrderStatusChanged, outbox.OrderStatusChanged{
+		OrderID: id,
+		From:    from.String(),
+		To:      t.To.String(),
+		Version: order.Version,
+		Actor:   t.Actor,
+		Reason:  t.Reason,
+	})
+}
+
+// addEvent appends an event to the outbox with r.mu held
+func (r *memoryOrderRepo) addEvent(orderID, typ string, payload interface{}) error {
+	event, err := outbox.New(orderID, typ, payload)
+	if err != nil {
+		return err
+	}
+	event.Seq = int64(len(r.outbox) + 1)
+	r.outbox = append(r.outbox, &storedEvent{Event: event, retryAt: event.CreatedAt})
+	return nil
+}
+
+func (r *memoryOrderRepo) PendingEvents(ctx context.Context, now time.Time, after int64, limit int) ([]outbox.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []outbox.Event
+	waiting := make(map[string]bool)
+	for _, stored := range r.outbox {
+		if len(events) == limit {
+			break
+		}
+		if stored.published {
+			continue
+		}
+		if stored.retryAt.After(now) {
+			waiting[stored.OrderID] = true
+		}
+		if !waiting[stored.OrderID] && stored.Seq > after {
+			events = append(events, stored.Event)
+		}
+	}
+	return events, nil
+}
+
+func (r *memoryOrderRepo) MarkEventPublished(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stored := range r.outbox {
+		if stored.ID == id {
+			stored.published = true
+		}
+	}
+	return nil
+}
+
+func (r *memoryOrderRepo) MarkEventFailed(ctx context.Context, id string, retryAt time.Time, cause string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stored := range r.outbox {
+		if stored.ID == id {
+			stored.Attempts++
+			stored.retryAt = retryAt
+		}
+	}
+	return nil
+}
+
+func (r *memoryOrderRepo) DeletePublishedEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	panic("not implemented")
+}
+
+// setStatus moves an order straight to status, bypassing the lifecycle, to
+// set up a test
+func (r *memoryOrderRepo) setStatus(id string, to orderv1.OrderStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.orders[id].Status = to
+}
+
+func (r *memoryOrderRepo) ListStatusHistory(ctx context.Context, orderID string) ([]*handler.StatusChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := make([]*handler.StatusChange, len(r.history[orderID]))
+	copy(history, r.history[orderID])
+	return history, nil
+}
+
+func idempotencyKeyID(userID, key string) string {
+	return userID + "/" + key
+}
+
+func (r *memoryOrderRepo) GetIdempotencyKey(ctx context.Context, userID, key string) (*handler.IdempotencyKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, ok := r.keys[idempotencyKeyID(userID, key)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	stored := *record
+	return &stored, nil
+}
+
+func (r *memoryOrderRepo) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time, limit int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted int64
+	for id, record := range r.keys {
+		if deleted == int64(limit) {
+			break
+		}
+		if record.ExpiresAt.Before(before) {
+			delete(r.keys, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r *memoryOrderRepo) GetStock(ctx context.Context, productID string) (*handler.Stock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stock, ok := r.stock[productID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *stock
+	return &copied, nil
+}
+
+func (r *memoryOrderRepo) AdjustStock(ctx context.Context, adj handler.StockAdjustment) (*handler.Stock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stock, ok := r.stock[adj.ProductID]
+	if !ok {
+		stock = &handler.Stock{ProductID: adj.ProductID}
+		r.stock[adj.ProductID] = stock
+	}
+	if stock.OnHand+adj.Delta < stock.Reserved {
+		return nil, handler.ErrInsufficientStock
+	}
+	stock.OnHand += adj.Delta
+	stock.UpdatedAt = time.Now()
+	copied := *stock
+	return &copied, nil
+}
+
+func (r *memoryOrderRepo) ExpireReservations(ctx context.Context, before time.Time, limit int) (int64, error) {
+	return 0, nil
+}
+
+// fakeUserService knows every user id it is asked about
+type fakeUserService struct {
+	userv1.UnimplementedUserServiceServer
+}
+
+func (fakeUserService) BatchGetUsers(ctx context.Context, req *userv1.BatchGetUsersRequest) (*userv1.BatchGetUsersResponse, error) {
+	resp := &userv1.BatchGetUsersResponse{}
+	for _, id := range req.Ids {
+		resp.Users = append(resp.Users, &userv1.User{Id: id})
+	}
+	return resp, nil
+}
+
+func (fakeUserService) GetUser(ctx context.Context, req *userv1.GetUserRequest) (*userv1.GetUserResponse, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return &userv1.GetUserResponse{User: &userv1.User{Id: req.Id}}, nil
+}
+
+// dialFakeUserService serves fakeUserService over an in-memory listener
+func dialFakeUserService(t *testing.T) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	userv1.RegisterUserServiceServer(server, fakeUserService{})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// recordingProvider counts the payments returned through FakeProvider and can
+// be made unavailable
+type recordingProvider struct {
+	*payment.FakeProvider
+	mu          sync.Mutex
+	unavailable bool
+	voids       int
+	refunds     int
+}
+
+func newRecordingProvider() *recordingProvider {
+	return &recordingProvider{FakeProvider: payment.NewFakeProvider()}
+}
+
+func (p *recordingProvider) setUnavailable(unavailable bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unavailable = unavailable
+}
+
+func (p *recordingProvider) Void(ctx context.Context, reference string) (*payment.Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unavailable {
+		return nil, errors.New("provider unavailable")
+	}
+	p.voids++
+	return p.FakeProvider.Void(ctx, reference)
+}
+
+func (p *recordingProvider) Refund(ctx context.Context, req payment.RefundRequest) (*payment.Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unavailable {
+		return nil, errors.New("provider unavailable")
+	}
+	p.refunds++
+	return p.FakeProvider.Refund(ctx, req)
+}
+
+func newTestOrderHandler(t *testing.T, repo handler.OrderRepository, catalog handler.ProductCatalog) *handler.OrderHandler {
+	return newPaymentTestHandler(t, repo, catalog, payment.NewFakeProvider(), handler.PaymentConfig{})
+}
+
+func newPaymentTestHandler(t *testing.T, repo handler.OrderRepository, catalog handler.ProductCatalog, payments payment.Provider, cfg handler.PaymentConfig) *handler.OrderHandler {
+	cursors, err := pagination.NewCodec(testPageSecret, time.Hour)
+	require.NoError(t, err)
+	return handler.NewOrderHandler(repo, catalog, payments, dialFakeUserService(t), cursors, handler.IdempotencyConfig{}, handler.InventoryConfig{}, cfg, handler.WatchConfig{}, zap.NewNop())
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func TestGetOrderHistory(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+	order := placeOrder(t, h)
+
+	for _, to := range []orderv1.OrderStatus{
+		orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+		orderv1.OrderStatus_ORDER_STATUS_COMPLETED,
+	} {
+		_, err := h.UpdateOrderStatus(admin, &orderv1.UpdateOrderStatusRequest{OrderId: order.Id, Status: to, Reason: to.String()})
+		require.NoError(t, err)
+	}
+
+	resp, err := h.GetOrderHistory(asUser("user-1", ""), &orderv1.GetOrderHistoryRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Len(t, resp.History, 2)
+
+	// Oldest change first
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PENDING, resp.History[0].FromStatus)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, resp.History[0].ToStatus)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, resp.History[1].FromStatus)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_COMPLETED, resp.History[1].ToStatus)
+	require.Equal(t, "admin-1", resp.History[1].Actor)
+	require.Equal(t, "ORDER_STATUS_COMPLETED", resp.History[1].Reason)
+	require.NotNil(t, resp.History[1].ChangedAt)
+
+	_, err = h.GetOrderHistory(asUser("user-2", ""), &orderv1.GetOrderHistoryRequest{OrderId: order.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGetOrderReadMask(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := placeOrder(t, h)
+
+	_, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+
+	// History is left out unless asked for
+	resp, err := h.GetOrder(context.Background(), &orderv1.GetOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Empty(t, resp.History)
+
+	resp, err = h.GetOrder(context.Background(), &orderv1.GetOrderRequest{
+		OrderId:  order.Id,
+		ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"history"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.History, 1)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_CANCELLED, resp.History[0].ToStatus)
+	require.Equal(t, "system", resp.History[0].Actor)
+
+	resp, err = h.GetOrder(context.Background(), &orderv1.GetOrderRequest{
+		OrderId:  order.Id,
+		ReadMask: &fieldmaskpb.FieldMask{Paths: []string{"status"}},
+	})
+	require.NoError(t, err)
+	require.Empty(t, resp.History)
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	"github.com/zabilal/microservices/order-service/payment"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+func keyedOrderRequest(key string, quantity int32) *orderv1.CreateOrderRequest {
+	req := createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: quantity})
+	req.IdempotencyKey = key
+	return req
+}
+
+func TestCreateOrderReplaysIdempotencyKey(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+
+	first, err := h.CreateOrder(context.Background(), keyedOrderRequest("key-1", 1))
+	require.NoError(t, err)
+
+	again, err := h.CreateOrder(context.Background(), keyedOrderRequest("key-1", 1))
+	require.NoError(t, err)
+	require.Equal(t, first.Order.Id, again.Order.Id)
+	require.True(t, proto.Equal(first.Order, again.Order))
+	require.Len(t, repo.orders, 1)
+
+	// The stock is only reserved once
+	stock, err := repo.GetStock(context.Background(), "p1")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), stock.Reserved)
+
+	// Keys are scoped to the user placing the order
+	other := keyedOrderRequest("key-1", 1)
+	other.UserId = "user-2"
+	resp, err := h.CreateOrder(context.Background(), other)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Order.Id, resp.Order.Id)
+}
+
+func TestCreateOrderRejectsReusedKey(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+
+	_, err := h.CreateOrder(context.Background(), keyedOrderRequest("key-1", 1))
+	require.NoError(t, err)
+
+	_, err = h.CreateOrder(context.Background(), keyedOrderRequest("key-1", 2))
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	require.Len(t, repo.orders, 1)
+}
+
+func TestCreateOrderReusesExpiredKey(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+
+	first, err := h.CreateOrder(context.Background(), keyedOrderRequest("key-1", 1))
+	require.NoError(t, err)
+	repo.keys[idempotencyKeyID("user-1", "key-1")].ExpiresAt = time.Now().Add(-time.Minute)
+
+	// Once the key expired even a different request may use it
+	resp, err := h.CreateOrder(context.Background(), keyedOrderRequest("key-1", 2))
+	require.NoError(t, err)
+	require.NotEqual(t, first.Order.Id, resp.Order.Id)
+}
+
+func TestIdempotencyKeySweeper(t *testing.T) {
+	repo := stockedRepo(t)
+	cursors, err := pagination.NewCodec(testPageSecret, time.Hour)
+	require.NoError(t, err)
+	h := handler.NewOrderHandler(repo, testCatalog(), payment.NewFakeProvider(), dialFakeUserService(t), cursors,
+		handler.IdempotencyConfig{Retention: time.Hour, SweepInterval: 10 * time.Millisecond},
+		handler.InventoryConfig{}, handler.PaymentConfig{}, handler.WatchConfig{}, zap.NewNop())
+
+	for i := 0; i < 3; i++ {
+		_, err := h.CreateOrder(context.Background(), keyedOrderRequest(fmt.Sprintf("key-%d", i), 1))
+		require.NoError(t, err)
+	}
+	repo.keys[idempotencyKeyID("user-1", "key-0")].ExpiresAt = time.Now().Add(-time.Minute)
+	repo.keys[idempotencyKeyID("user-1", "key-1")].ExpiresAt = time.Now().Add(-time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.WatchIdempotencyKeys(ctx)
+
+	require.Eventually(t, func() bool {
+		_, err := repo.GetIdempotencyKey(context.Background(), "user-1", "key-1")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = repo.GetIdempotencyKey(context.Background(), "user-1", "key-0")
+	require.Error(t, err)
+	_, err = repo.GetIdempotencyKey(context.Background(), "user-1", "key-2")
+	require.NoError(t, err)
+}
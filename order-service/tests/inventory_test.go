@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func asUser(userID, roles string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-user-id", userID,
+		"x-user-roles", roles,
+	))
+}
+
+func TestAdjustStock(t *testing.T) {
+	h := newTestOrderHandler(t, newMemoryOrderRepo(), testCatalog())
+	admin := asUser("admin-1", "admin")
+
+	resp, err := h.AdjustStock(admin, &orderv1.AdjustStockRequest{ProductId: "p1", Delta: 5, Reason: "delivery"})
+	require.NoError(t, err)
+	require.Equal(t, int32(5), resp.Stock.OnHand)
+	require.Equal(t, int32(5), resp.Stock.Available)
+
+	_, err = h.AdjustStock(admin, &orderv1.AdjustStockRequest{ProductId: "p1", Delta: -6})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = h.AdjustStock(admin, &orderv1.AdjustStockRequest{ProductId: "nope", Delta: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = h.AdjustStock(asUser("user-1", ""), &orderv1.AdjustStockRequest{ProductId: "p1", Delta: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestCreateOrderReservesStock(t *testing.T) {
+	repo := newMemoryOrderRepo()
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+
+	_, err := h.AdjustStock(admin, &orderv1.AdjustStockRequest{ProductId: "p1", Delta: 3})
+	require.NoError(t, err)
+
+	_, err = h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 2}))
+	require.NoError(t, err)
+
+	stock, err := h.GetStock(admin, &orderv1.GetStockRequest{ProductId: "p1"})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), stock.Stock.Reserved)
+	require.Equal(t, int32(1), stock.Stock.Available)
+
+	_, err = h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 2}))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Reserved units cannot be removed from stock
+	_, err = h.AdjustStock(admin, &orderv1.AdjustStockRequest{ProductId: "p1", Delta: -2})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
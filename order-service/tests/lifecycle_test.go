@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/lifecycle"
+	pb "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func TestLifecycleTransitions(t *testing.T) {
+	tests := []struct {
+		from, to pb.OrderStatus
+		allowed  bool
+	}{
+		{pb.OrderStatus_ORDER_STATUS_PENDING, pb.OrderStatus_ORDER_STATUS_PROCESSING, true},
+		{pb.OrderStatus_ORDER_STATUS_PENDING, pb.OrderStatus_ORDER_STATUS_CANCELLED, true},
+		{pb.OrderStatus_ORDER_STATUS_PROCESSING, pb.OrderStatus_ORDER_STATUS_COMPLETED, true},
+		{pb.OrderStatus_ORDER_STATUS_PROCESSING, pb.OrderStatus_ORDER_STATUS_FAILED, true},
+		{pb.OrderStatus_ORDER_STATUS_COMPLETED, pb.OrderStatus_ORDER_STATUS_RETURN_REQUESTED, true},
+		{pb.OrderStatus_ORDER_STATUS_RETURNED, pb.OrderStatus_ORDER_STATUS_REFUNDED, true},
+		{pb.OrderStatus_ORDER_STATUS_COMPLETED, pb.OrderStatus_ORDER_STATUS_PENDING, false},
+		{pb.OrderStatus_ORDER_STATUS_CANCELLED, pb.OrderStatus_ORDER_STATUS_PROCESSING, false},
+		{pb.OrderStatus_ORDER_STATUS_PENDING, pb.OrderStatus_ORDER_STATUS_COMPLETED, false},
+		{pb.OrderStatus_ORDER_STATUS_PENDING, pb.OrderStatus_ORDER_STATUS_PENDING, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from.String()+"->"+tt.to.String(), func(t *testing.T) {
+			assert.Equal(t, tt.allowed, lifecycle.CanTransition(tt.from, tt.to))
+			assert.Equal(t, tt.allowed, lifecycle.Check(tt.from, tt.to) == nil)
+		})
+	}
+
+	assert.True(t, lifecycle.IsTerminal(pb.OrderStatus_ORDER_STATUS_CANCELLED))
+	assert.True(t, lifecycle.IsTerminal(pb.OrderStatus_ORDER_STATUS_REFUNDED))
+	assert.False(t, lifecycle.IsTerminal(pb.OrderStatus_ORDER_STATUS_PENDING))
+}
+
+func TestLifecycleErrorDetails(t *testing.T) {
+	err := lifecycle.Check(pb.OrderStatus_ORDER_STATUS_COMPLETED, pb.OrderStatus_ORDER_STATUS_PENDING)
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+
+	var failure *errdetails.PreconditionFailure
+	for _, d := range st.Details() {
+		if f, ok := d.(*errdetails.PreconditionFailure); ok {
+			failure = f
+		}
+	}
+	if assert.NotNil(t, failure) && assert.Len(t, failure.Violations, 1) {
+		v := failure.Violations[0]
+		assert.Equal(t, lifecycle.PreconditionType, v.Type)
+		assert.Equal(t, "ORDER_STATUS_COMPLETED", v.Subject)
+		assert.Contains(t, v.Description, "ORDER_STATUS_RETURN_REQUESTED")
+		assert.Contains(t, v.Description, "ORDER_STATUS_REFUNDED")
+	}
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+// BenchmarkListOrders runs against the MySQL compatible database in
+// ORDER_SERVICE_TEST_DSN, which must have the migrations applied and set
+// parseTime=true like OpenDatabase does, and reports the number of statements
+// issued per ListOrders call. It must not grow with the page size.
+func BenchmarkListOrders(b *testing.B) {
+	dsn := os.Getenv("ORDER_SERVICE_TEST_DSN")
+	if dsn == "" {
+		b.Skip("ORDER_SERVICE_TEST_DSN not set")
+	}
+
+	db := sql.OpenDB(&countingConnector{dsn: dsn})
+	defer db.Close()
+
+	ctx := context.Background()
+	repo := handler.NewOrderRepositoryFromDB(db)
+	userID := uuid.New().String()
+	if _, err := db.ExecContext(ctx,
+		"INSERT INTO users (id, username, email, password_hash) VALUES (?, ?, ?, ?)",
+		userID, userID, userID+"@example.com", "x",
+	); err != nil {
+		b.Fatal(err)
+	}
+
+	// Creating an order reserves stock, so there must be enough of it
+	for _, productID := range []string{"p1", "p2"} {
+		if _, err := repo.AdjustStock(ctx, handler.StockAdjustment{
+			ProductID: productID,
+			Delta:     100,
+			Actor:     "benchmark",
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		order := &handler.Order{
+			ID:          uuid.New().String(),
+			UserID:      userID,
+			Status:      orderv1.OrderStatus_ORDER_STATUS_PENDING,
+			TotalAmount: money.Money{Currency: "USD", Minor: 2000},
+			Items: []handler.OrderItem{
+				{ProductID: "p1", Quantity: 1, UnitPrice: money.Money{Currency: "USD", Minor: 1000}, ProductName: "One"},
+				{ProductID: "p2", Quantity: 1, UnitPrice: money.Money{Currency: "USD", Minor: 1000}, ProductName: "Two"},
+			},
+			PaymentInfo:   handler.PaymentInfo{Method: orderv1.PaymentMethod_PAYMENT_METHOD_CREDIT_CARD},
+			ShippingInfo:  handler.ShippingInfo{AddressLine1: "1 Main St", City: "Springfield", Country: "US", PostalCode: "12345"},
+			ReservedUntil: time.Now().Add(time.Hour),
+		}
+		if err := repo.CreateOrder(ctx, order, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, size := range []int32{10, 50, 100} {
+		b.Run(fmt.Sprintf("page_size=%d", size), func(b *testing.B) {
+			page := pagination.Page{Size: size, Desc: true}
+			filter := handler.OrderFilter{
+				UserID:   userID,
+				Statuses: []orderv1.OrderStatus{orderv1.OrderStatus_ORDER_STATUS_PENDING},
+			}
+			queries.Store(0)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				orders, _, err := repo.ListOrders(ctx, filter, page)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(orders) != int(size) {
+					b.Fatalf("got %d orders, want %d", len(orders), size)
+				}
+			}
+
+			b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// queries counts the statements sent through countingConnector
+var queries atomic.Int64
+
+type countingConnector struct {
+	dsn  string
+	once sync.Once
+	conn driver.Connector
+	err  error
+}
+
+func (c *countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.once.Do(func() {
+		var cfg *mysql.Config
+		if cfg, c.err = mysql.ParseDSN(c.dsn); c.err == nil {
+			c.conn, c.err = mysql.NewConnector(cfg)
+		}
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	conn, err := c.conn.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+func (c *countingConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+type countingConn struct {
+	driver.Conn
+}
+
+func (c *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queries.Add(1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	queries.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+func TestMoneyParseAndFormat(t *testing.T) {
+	m, err := money.Parse("USD", "12.3400")
+	require.NoError(t, err)
+	require.Equal(t, int64(1234), m.Minor)
+	require.Equal(t, "12.34", m.String())
+
+	m, err = money.Parse("JPY", "500")
+	require.NoError(t, err)
+	require.Equal(t, "500", m.String())
+
+	m, err = money.Parse("KWD", "-0.005")
+	require.NoError(t, err)
+	require.Equal(t, "-0.005", m.String())
+
+	_, err = money.Parse("USD", "0.001")
+	require.ErrorIs(t, err, money.ErrPrecision)
+	_, err = money.Parse("usd", "1")
+	require.ErrorIs(t, err, money.ErrInvalidCurrency)
+	_, err = money.Parse("USD", "1e3")
+	require.ErrorIs(t, err, money.ErrInvalidAmount)
+}
+
+func TestMoneyExactSum(t *testing.T) {
+	price, err := money.Parse("USD", "0.10")
+	require.NoError(t, err)
+
+	// 0.1 * 3 is not exactly 0.3 in float64
+	line, err := price.Mul(3)
+	require.NoError(t, err)
+	require.Equal(t, "0.30", line.String())
+
+	_, err = line.Add(money.Money{Currency: "EUR", Minor: 1})
+	require.ErrorIs(t, err, money.ErrCurrencyMismatch)
+}
+
+func TestMoneyRoundsHalfEven(t *testing.T) {
+	for minor, want := range map[int64]int64{5: 2, 15: 8, -15: -8, 7: 4} {
+		got, err := money.Money{Currency: "USD", Minor: minor}.MulRat(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, want, got.Minor, "%d / 2", minor)
+	}
+}
+
+func TestMoneyProtoRoundTrip(t *testing.T) {
+	m, err := money.FromProto(&moneypb.Money{CurrencyCode: "USD", Units: -1, Nanos: -250_000_000})
+	require.NoError(t, err)
+	require.Equal(t, int64(-125), m.Minor)
+
+	p := money.ToProto(m)
+	require.Equal(t, int64(-1), p.Units)
+	require.Equal(t, int32(-250_000_000), p.Nanos)
+
+	_, err = money.FromProto(&moneypb.Money{CurrencyCode: "USD", Nanos: 1_000})
+	require.ErrorIs(t, err, money.ErrPrecision)
+	_, err = money.FromProto(&moneypb.Money{CurrencyCode: "USD", Units: 1, Nanos: -1})
+	require.ErrorIs(t, err, money.ErrInvalidAmount)
+}
@@ -296,7 +296,7 @@ func TestUpdateOrderStatus(t *testing.T) {
 				Status: pb.OrderStatus_ORDER_STATUS_DELIVERED,
 			},
 			expectError: true,
-			errorCode:   codes.InvalidArgument,
+			errorCode:   codes.FailedPrecondition,
 		},
 	}
 
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zabilal/microservices/order-service/outbox"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func testRelayConfig() outbox.RelayConfig {
+	return outbox.RelayConfig{
+		PollInterval: time.Millisecond,
+		BatchSize:    2,
+		MinBackoff:   time.Millisecond,
+		MaxBackoff:   10 * time.Millisecond,
+	}
+}
+
+// flakyPublisher fails the first attempts to publish the events of one order
+type flakyPublisher struct {
+	mu        sync.Mutex
+	failOrder string
+	failures  int
+	published []outbox.Event
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, event outbox.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if event.OrderID == p.failOrder && p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, event)
+	return nil
+}
+
+func eventTypes(events []outbox.Event, orderID string) []string {
+	var types []string
+	for _, event := range events {
+		if event.OrderID == orderID {
+			types = append(types, event.Type)
+		}
+	}
+	return types
+}
+
+func TestOrderEventsAreRelayed(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := authorizedOrder(t, h)
+
+	publisher := outbox.NewMemoryPublisher()
+	var received []outbox.Event
+	unsubscribe := publisher.Subscribe(func(event outbox.Event) {
+		received = append(received, event)
+	})
+	defer unsubscribe()
+
+	relay := outbox.NewRelay(repo, publisher, testRelayConfig(), zap.NewNop())
+	published, err := relay.Flush(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, published)
+
+	// The payment is authorized before the order starts processing
+	require.Equal(t, []string{
+		outbox.TypeOrderCreated,
+		outbox.TypePaymentStatusChanged,
+		outbox.TypeOrderStatusChanged,
+	}, eventTypes(received, order.Id))
+
+	var created outbox.OrderCreated
+	require.NoError(t, json.Unmarshal(received[0].Payload, &created))
+	require.Equal(t, "user-1", created.UserID)
+	require.Equal(t, "USD", created.Currency)
+	require.Equal(t, "19.99", created.Total)
+	require.Len(t, created.Items, 1)
+
+	var changed outbox.OrderStatusChanged
+	require.NoError(t, json.Unmarshal(received[2].Payload, &changed))
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PENDING.String(), changed.From)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING.String(), changed.To)
+	require.Equal(t, order.Version, changed.Version)
+
+	// Published events are not sent again
+	published, err = relay.Flush(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, published)
+}
+
+func TestRelayRetriesInOrder(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	stuck := authorizedOrder(t, h)
+	other := authorizedOrder(t, h)
+
+	publisher := &flakyPublisher{failOrder: stuck.Id, failures: 2}
+	relay := outbox.NewRelay(repo, publisher, testRelayConfig(), zap.NewNop())
+
+	// The other order is not held up by the failing one
+	_, err := relay.Flush(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, eventTypes(publisher.published, stuck.Id))
+	require.Len(t, eventTypes(publisher.published, other.Id), 3)
+
+	pending, err := repo.PendingEvents(context.Background(), time.Now().Add(time.Hour), 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, pending[0].Attempts)
+
+	require.Eventually(t, func() bool {
+		_, err := relay.Flush(context.Background())
+		require.NoError(t, err)
+		return len(eventTypes(publisher.published, stuck.Id)) == 3
+	}, time.Second, 5*time.Millisecond)
+
+	require.Equal(t, []string{
+		outbox.TypeOrderCreated,
+		outbox.TypePaymentStatusChanged,
+		outbox.TypeOrderStatusChanged,
+	}, eventTypes(publisher.published, stuck.Id))
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	publisher, err := outbox.NewFilePublisher(path)
+	require.NoError(t, err)
+
+	event, err := outbox.New("order-1", outbox.TypeOrderStatusChanged, outbox.OrderStatusChanged{OrderID: "order-1", To: "ORDER_STATUS_CANCELLED"})
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish(context.Background(), event))
+	require.NoError(t, publisher.Publish(context.Background(), event))
+	require.NoError(t, publisher.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var message struct {
+			Subject string                    `json:"subject"`
+			ID      string                    `json:"id"`
+			Data    outbox.OrderStatusChanged `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &message))
+		require.Equal(t, "orders.OrderStatusChanged", message.Subject)
+		require.Equal(t, event.ID, message.ID)
+		require.Equal(t, "ORDER_STATUS_CANCELLED", message.Data.To)
+		lines++
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, 2, lines)
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zabilal/microservices/pkg/pagination"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	codec, err := pagination.NewCodec(testPageSecret, time.Hour)
+	require.NoError(t, err)
+
+	filter := pagination.Filter("user-1", "ORDER_STATUS_PENDING")
+	page, err := codec.Page(0, "", true, filter)
+	require.NoError(t, err)
+	require.Equal(t, int32(pagination.DefaultPageSize), page.Size)
+	require.Nil(t, page.After)
+
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	token, err := codec.NextToken(page, createdAt, "order-1", filter)
+	require.NoError(t, err)
+
+	next, err := codec.Page(10, token, true, filter)
+	require.NoError(t, err)
+	require.NotNil(t, next.After)
+	require.True(t, next.After.CreatedAt.Equal(createdAt))
+	require.Equal(t, "order-1", next.After.ID)
+
+	cond, args := next.Keyset("o.created_at", "o.id")
+	require.Equal(t, "(o.created_at < ? OR (o.created_at = ? AND o.id < ?))", cond)
+	require.Len(t, args, 3)
+	require.Equal(t, "o.created_at DESC, o.id DESC", next.OrderBy("o.created_at", "o.id"))
+	require.Equal(t, int32(11), next.Limit())
+}
+
+func TestPageTokenRejected(t *testing.T) {
+	codec, err := pagination.NewCodec(testPageSecret, time.Hour)
+	require.NoError(t, err)
+
+	filter := pagination.Filter("user-1")
+	page, err := codec.Page(10, "", false, filter)
+	require.NoError(t, err)
+	token, err := codec.NextToken(page, time.Now(), "order-1", filter)
+	require.NoError(t, err)
+
+	other, err := pagination.NewCodec(strings.ToUpper(testPageSecret), time.Hour)
+	require.NoError(t, err)
+	expiring, err := pagination.NewCodec(testPageSecret, time.Nanosecond)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		name   string
+		codec  *pagination.Codec
+		token  string
+		desc   bool
+		filter string
+		want   error
+	}{
+		{"garbage", codec, "not-a-token", false, filter, pagination.ErrInvalidToken},
+		{"tampered", codec, "x" + token, false, filter, pagination.ErrInvalidToken},
+		{"wrong secret", other, token, false, filter, pagination.ErrInvalidToken},
+		{"other filter", codec, token, false, pagination.Filter("user-2"), pagination.ErrInvalidToken},
+		{"other direction", codec, token, true, filter, pagination.ErrInvalidToken},
+		{"expired", expiring, token, false, filter, pagination.ErrExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.codec.Page(10, tt.token, tt.desc, tt.filter)
+			require.True(t, errors.Is(err, tt.want), "got %v", err)
+		})
+	}
+}
+
+func TestPageSecretTooShort(t *testing.T) {
+	_, err := pagination.NewCodec("change-me", time.Hour)
+	require.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func TestApplyPaymentEvent(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := placeOrder(t, h)
+
+	event := &orderv1.ApplyPaymentEventRequest{
+		EventId:           "evt-1",
+		Type:              orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_AUTHORIZED,
+		OrderId:           order.Id,
+		ProviderReference: "auth-1",
+	}
+	resp, err := h.ApplyPaymentEvent(context.Background(), event)
+	require.NoError(t, err)
+	require.True(t, resp.Applied)
+	require.False(t, resp.Duplicate)
+
+	stored, err := repo.GetOrder(context.Background(), order.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, stored.PaymentInfo.Status)
+	require.Equal(t, "auth-1", stored.PaymentInfo.Reference)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, stored.Status)
+
+	// Providers deliver at least once
+	resp, err = h.ApplyPaymentEvent(context.Background(), event)
+	require.NoError(t, err)
+	require.True(t, resp.Duplicate)
+	require.False(t, resp.Applied)
+
+	_, err = h.ApplyPaymentEvent(context.Background(), &orderv1.ApplyPaymentEventRequest{
+		EventId:           "evt-2",
+		Type:              orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_CAPTURED,
+		OrderId:           order.Id,
+		ProviderReference: "someone-elses",
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestLatePaymentEventIsRecordedOnly(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	order := authorizedOrder(t, h)
+
+	// The synchronous authorization got there first
+	resp, err := h.ApplyPaymentEvent(context.Background(), &orderv1.ApplyPaymentEventRequest{
+		EventId: "evt-1",
+		Type:    orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_AUTHORIZED,
+		OrderId: order.Id,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.Applied)
+	require.False(t, resp.Duplicate)
+
+	stored, err := repo.GetOrder(context.Background(), order.Id)
+	require.NoError(t, err)
+	require.Equal(t, order.Version, stored.Version)
+}
+
+func TestApplyPaymentEventRejectsUsers(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := placeOrder(t, h)
+
+	_, err := h.ApplyPaymentEvent(asUser("admin-1", "admin"), &orderv1.ApplyPaymentEventRequest{
+		EventId: "evt-1",
+		Type:    orderv1.PaymentEventType_PAYMENT_EVENT_TYPE_FAILED,
+		OrderId: order.Id,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = h.ApplyPaymentEvent(context.Background(), &orderv1.ApplyPaymentEventRequest{
+		EventId: "evt-1",
+		OrderId: order.Id,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
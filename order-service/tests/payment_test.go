@@ -0,0 +1,265 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	"github.com/zabilal/microservices/order-service/payment"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+func TestPaymentTransitions(t *testing.T) {
+	require.True(t, payment.CanTransition(orderv1.PaymentStatus_PAYMENT_STATUS_PENDING, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED))
+	require.True(t, payment.CanTransition(orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED))
+	require.True(t, payment.CanTransition(orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED, orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED))
+	require.False(t, payment.CanTransition(orderv1.PaymentStatus_PAYMENT_STATUS_PENDING, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED))
+	require.False(t, payment.CanTransition(orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED))
+}
+
+func TestFakeProviderIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	p := payment.NewFakeProvider()
+	amount := money.Money{Currency: "USD", Minor: 1999}
+
+	first, err := p.Authorize(ctx, payment.AuthorizeRequest{OrderID: "o1", Amount: amount})
+	require.NoError(t, err)
+	again, err := p.Authorize(ctx, payment.AuthorizeRequest{OrderID: "o1", Amount: amount})
+	require.NoError(t, err)
+	require.Equal(t, first.Reference, again.Reference)
+
+	_, err = p.Authorize(ctx, payment.AuthorizeRequest{OrderID: "o2", Amount: money.Money{Currency: "USD", Minor: 1013}})
+	require.ErrorIs(t, err, payment.ErrDeclined)
+
+	_, err = p.Refund(ctx, payment.RefundRequest{Reference: first.Reference, RefundID: "r1", Amount: amount})
+	require.ErrorIs(t, err, payment.ErrDeclined)
+	_, err = p.Capture(ctx, first.Reference, amount)
+	require.NoError(t, err)
+	_, err = p.Void(ctx, first.Reference)
+	require.ErrorIs(t, err, payment.ErrDeclined)
+}
+
+func TestPaymentLifecycle(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+
+	created, err := h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 1}))
+	require.NoError(t, err)
+	orderID := created.Order.Id
+
+	authorized, err := h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: orderID})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, authorized.Order.PaymentInfo.Status)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, authorized.Order.Status)
+
+	// Only admins capture
+	_, err = h.CapturePayment(asUser("user-1", ""), &orderv1.CapturePaymentRequest{OrderId: orderID})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	captured, err := h.CapturePayment(admin, &orderv1.CapturePaymentRequest{OrderId: orderID})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED, captured.Order.PaymentInfo.Status)
+
+	// Refunds need an order the lifecycle lets move to REFUNDED
+	_, err = h.RefundPayment(admin, &orderv1.RefundPaymentRequest{OrderId: orderID})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	require.NoError(t, repo.UpdateOrderStatus(context.Background(), orderID, handler.Transition{To: orderv1.OrderStatus_ORDER_STATUS_COMPLETED}))
+	refunded, err := h.RefundPayment(admin, &orderv1.RefundPaymentRequest{OrderId: orderID, Reason: "customer request"})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED, refunded.Order.PaymentInfo.Status)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_REFUNDED, refunded.Order.Status)
+}
+
+func TestDeclinedAuthorizationFailsOrder(t *testing.T) {
+	repo := stockedRepo(t)
+	catalog := testCatalog()
+	catalog.Put(handler.Product{ID: "unlucky", Name: "Unlucky", Price: money.Money{Currency: "USD", Minor: 1013}, Active: true})
+	_, err := repo.AdjustStock(context.Background(), handler.StockAdjustment{ProductID: "unlucky", Delta: 1})
+	require.NoError(t, err)
+	h := newTestOrderHandler(t, repo, catalog)
+
+	created, err := h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "unlucky", Quantity: 1}))
+	require.NoError(t, err)
+
+	_, err = h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: created.Order.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	order, err := repo.GetOrder(context.Background(), created.Order.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_FAILED, order.PaymentInfo.Status)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_FAILED, order.Status)
+}
+
+// authorizedOrder creates an order and authorizes its payment
+func authorizedOrder(t *testing.T, h *handler.OrderHandler) *orderv1.Order {
+	created, err := h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 1}))
+	require.NoError(t, err)
+	authorized, err := h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: created.Order.Id})
+	require.NoError(t, err)
+	return authorized.Order
+}
+
+func TestCancelVoidsAuthorizedPayment(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+	order := authorizedOrder(t, h)
+
+	cancelled, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_CANCELLED, cancelled.Order.Status)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED, cancelled.Order.PaymentInfo.Status)
+	require.Equal(t, 1, payments.voids)
+}
+
+func TestCancelRefundsCapturedPayment(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+	order := authorizedOrder(t, h)
+	_, err := h.CapturePayment(asUser("admin-1", "admin"), &orderv1.CapturePaymentRequest{OrderId: order.Id})
+	require.NoError(t, err)
+
+	cancelled, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED, cancelled.Order.PaymentInfo.Status)
+	require.Equal(t, 1, payments.refunds)
+}
+
+func TestFailedCancelKeepsPayment(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(repo *memoryOrderRepo, order *orderv1.Order) *orderv1.CancelOrderRequest
+		code  codes.Code
+	}{
+		{
+			name: "shipped",
+			setup: func(repo *memoryOrderRepo, order *orderv1.Order) *orderv1.CancelOrderRequest {
+				repo.orders[order.Id].ShippingInfo.Status = orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED
+				return &orderv1.CancelOrderRequest{OrderId: order.Id}
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "stale version",
+			setup: func(repo *memoryOrderRepo, order *orderv1.Order) *orderv1.CancelOrderRequest {
+				return &orderv1.CancelOrderRequest{OrderId: order.Id, ExpectedVersion: order.Version - 1}
+			},
+			code: codes.Aborted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := stockedRepo(t)
+			payments := newRecordingProvider()
+			h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+			order := authorizedOrder(t, h)
+
+			_, err := h.CancelOrder(context.Background(), tt.setup(repo, order))
+			require.Equal(t, tt.code, status.Code(err))
+
+			// The order stays open, so its money must not be returned
+			stored, err := repo.GetOrder(context.Background(), order.Id)
+			require.NoError(t, err)
+			require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, stored.Status)
+			require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, stored.PaymentInfo.Status)
+			require.Zero(t, payments.voids)
+		})
+	}
+}
+
+func TestPendingPaymentReturnIsRetried(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{SweepInterval: 10 * time.Millisecond})
+	order := authorizedOrder(t, h)
+
+	// The cancellation stands even if the provider cannot be reached
+	payments.setUnavailable(true)
+	cancelled, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_CANCELLED, cancelled.Order.Status)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, cancelled.Order.PaymentInfo.Status)
+
+	payments.setUnavailable(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.WatchPaymentReturns(ctx)
+
+	require.Eventually(t, func() bool {
+		stored, err := repo.GetOrder(context.Background(), order.Id)
+		return err == nil && stored.PaymentInfo.Status == orderv1.PaymentStatus_PAYMENT_STATUS_VOIDED
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPendingRefundIsRetried(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{SweepInterval: 10 * time.Millisecond})
+	order := authorizedOrder(t, h)
+	_, err := h.CapturePayment(asUser("admin-1", "admin"), &orderv1.CapturePaymentRequest{OrderId: order.Id})
+	require.NoError(t, err)
+
+	payments.setUnavailable(true)
+	cancelled, err := h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_CANCELLED, cancelled.Order.Status)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED, cancelled.Order.PaymentInfo.Status)
+
+	payments.setUnavailable(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.WatchPaymentReturns(ctx)
+
+	require.Eventually(t, func() bool {
+		stored, err := repo.GetOrder(context.Background(), order.Id)
+		return err == nil && stored.PaymentInfo.Status == orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED
+	}, time.Second, 10*time.Millisecond)
+
+	// The refund was issued once, by the sweep
+	payments.mu.Lock()
+	defer payments.mu.Unlock()
+	require.Equal(t, 1, payments.refunds)
+}
+
+// failingPaymentRepo cannot record payment results
+type failingPaymentRepo struct {
+	*memoryOrderRepo
+}
+
+func (r failingPaymentRepo) UpdatePayment(ctx context.Context, orderID string, u handler.PaymentUpdate) error {
+	return errors.New("database unavailable")
+}
+
+func TestUnrecordedAuthorizationIsVoided(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, failingPaymentRepo{repo}, testCatalog(), payments, handler.PaymentConfig{})
+	created, err := h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 1}))
+	require.NoError(t, err)
+
+	_, err = h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: created.Order.Id})
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Equal(t, 1, payments.voids)
+
+	stored, err := repo.GetOrder(context.Background(), created.Order.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_PENDING, stored.PaymentInfo.Status)
+
+	// Once payments can be recorded again the request can be retried
+	h = newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+	authorized, err := h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: created.Order.Id})
+	require.NoError(t, err)
+	_, err = h.CapturePayment(asUser("admin-1", "admin"), &orderv1.CapturePaymentRequest{OrderId: authorized.Order.Id})
+	require.NoError(t, err)
+}
@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+)
+
+func TestRecoveryInterceptors(t *testing.T) {
+	unary := handler.RecoveryUnaryInterceptor(zap.NewNop())
+	info := &grpc.UnaryServerInfo{FullMethod: "/order.v1.OrderService/CreateOrder"}
+	resp, err := unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		var order *handler.Order
+		return order.ID, nil
+	})
+	require.Nil(t, resp)
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	stream := handler.RecoveryStreamInterceptor(zap.NewNop())
+	err = stream(nil, &exportStream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: "/order.v1.OrderService/ExportOrders"}, func(srv interface{}, ss grpc.ServerStream) error {
+		panic("boom")
+	})
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	// Ordinary errors pass through untouched
+	_, err = unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
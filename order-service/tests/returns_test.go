@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+	"github.com/zabilal/microservices/pkg/money"
+)
+
+// deliveredOrder creates a paid order of two p1 and three p2, 40.28 USD in
+// total, and delivers it
+func deliveredOrder(t *testing.T, h *handler.OrderHandler) *orderv1.Order {
+	ctx := context.Background()
+	admin := asUser("admin-1", "admin")
+
+	created, err := h.CreateOrder(ctx, createOrderRequest(
+		&orderv1.OrderItem{ProductId: "p1", Quantity: 2},
+		&orderv1.OrderItem{ProductId: "p2", Quantity: 3},
+	))
+	require.NoError(t, err)
+	id := created.Order.Id
+
+	_, err = h.AuthorizePayment(ctx, &orderv1.AuthorizePaymentRequest{OrderId: id})
+	require.NoError(t, err)
+	_, err = h.CapturePayment(admin, &orderv1.CapturePaymentRequest{OrderId: id})
+	require.NoError(t, err)
+	_, err = h.MarkShipped(admin, &orderv1.MarkShippedRequest{OrderId: id, Carrier: "UPS", TrackingNumber: "1Z999"})
+	require.NoError(t, err)
+	delivered, err := h.MarkDelivered(admin, &orderv1.MarkDeliveredRequest{OrderId: id})
+	require.NoError(t, err)
+	return delivered.Order
+}
+
+func requestReturn(t *testing.T, h *handler.OrderHandler, orderID string, items ...*orderv1.ReturnItem) *orderv1.Return {
+	resp, err := h.RequestReturn(asUser("user-1", ""), &orderv1.RequestReturnRequest{OrderId: orderID, Items: items, Reason: "changed my mind"})
+	require.NoError(t, err)
+	return resp.OrderReturn
+}
+
+func usd(minor int64) money.Money {
+	return money.Money{Currency: "USD", Minor: minor}
+}
+
+func TestPartialReturn(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+	admin := asUser("admin-1", "admin")
+	order := deliveredOrder(t, h)
+
+	ret := requestReturn(t, h, order.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 1})
+	require.Equal(t, orderv1.ReturnStatus_RETURN_STATUS_REQUESTED, ret.Status)
+	refund, err := money.FromProto(ret.Refund)
+	require.NoError(t, err)
+	require.Equal(t, usd(1999), refund)
+
+	stored, err := repo.GetOrder(context.Background(), order.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED, stored.Status)
+
+	// Units claimed by an open return cannot be returned twice
+	_, err = h.RequestReturn(asUser("user-1", ""), &orderv1.RequestReturnRequest{
+		OrderId: order.Id,
+		Items:   []*orderv1.ReturnItem{{ProductId: "p1", Quantity: 2}},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = h.RequestReturn(asUser("user-1", ""), &orderv1.RequestReturnRequest{
+		OrderId: order.Id,
+		Items:   []*orderv1.ReturnItem{{ProductId: "p2", Quantity: 4}},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = h.RequestReturn(asUser("user-2", ""), &orderv1.RequestReturnRequest{
+		OrderId: order.Id,
+		Items:   []*orderv1.ReturnItem{{ProductId: "p2", Quantity: 1}},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Only admins decide
+	_, err = h.ApproveReturn(asUser("user-1", ""), &orderv1.ApproveReturnRequest{ReturnId: ret.Id})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	approved, err := h.ApproveReturn(admin, &orderv1.ApproveReturnRequest{ReturnId: ret.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ReturnStatus_RETURN_STATUS_REFUNDED, approved.OrderReturn.Status)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_COMPLETED, approved.Order.Status)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED, approved.Order.PaymentInfo.Status)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED, approved.Order.ShippingInfo.Status)
+	refunded, err := money.FromProto(approved.Order.PaymentInfo.Refunded)
+	require.NoError(t, err)
+	require.Equal(t, usd(1999), refunded)
+	require.Equal(t, 1, payments.refunds)
+
+	_, err = h.ApproveReturn(admin, &orderv1.ApproveReturnRequest{ReturnId: ret.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestReturnEveryItem(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+	order := deliveredOrder(t, h)
+
+	widgets := requestReturn(t, h, order.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 2})
+	gadgets := requestReturn(t, h, order.Id,
+		&orderv1.ReturnItem{ProductId: "p2", Quantity: 1},
+		&orderv1.ReturnItem{ProductId: "p2", Quantity: 2},
+	)
+	require.Len(t, gadgets.Items, 1)
+	require.Equal(t, int32(3), gadgets.Items[0].Quantity)
+
+	// Another return is still open
+	approved, err := h.ApproveReturn(admin, &orderv1.ApproveReturnRequest{ReturnId: widgets.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED, approved.Order.Status)
+
+	approved, err = h.ApproveReturn(admin, &orderv1.ApproveReturnRequest{ReturnId: gadgets.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED, approved.Order.ShippingInfo.Status)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_REFUNDED, approved.Order.Status)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_REFUNDED, approved.Order.PaymentInfo.Status)
+	require.True(t, proto.Equal(approved.Order.Total, approved.Order.PaymentInfo.Refunded))
+
+	history, err := repo.ListStatusHistory(context.Background(), order.Id)
+	require.NoError(t, err)
+	last := history[len(history)-2:]
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_RETURNED, last[0].ToStatus)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_REFUNDED, last[1].ToStatus)
+}
+
+func TestRejectReturn(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+	order := deliveredOrder(t, h)
+
+	ret := requestReturn(t, h, order.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 2})
+	rejected, err := h.RejectReturn(admin, &orderv1.RejectReturnRequest{ReturnId: ret.Id, Reason: "used"})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ReturnStatus_RETURN_STATUS_REJECTED, rejected.OrderReturn.Status)
+	require.Equal(t, "used", rejected.OrderReturn.DecisionReason)
+
+	stored, err := repo.GetOrder(context.Background(), order.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_COMPLETED, stored.Status)
+	require.True(t, stored.PaymentInfo.Refunded.IsZero())
+
+	// The rejected units may be asked for again
+	requestReturn(t, h, order.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 2})
+}
+
+func TestFailedRefundIsRetried(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{})
+	admin := asUser("admin-1", "admin")
+	order := deliveredOrder(t, h)
+	ret := requestReturn(t, h, order.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 1})
+
+	payments.setUnavailable(true)
+	_, err := h.ApproveReturn(admin, &orderv1.ApproveReturnRequest{ReturnId: ret.Id, Reason: "unopened"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// The approval claimed the return, so it can no longer be rejected
+	stored, err := repo.GetReturn(context.Background(), ret.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ReturnStatus_RETURN_STATUS_REFUNDING, stored.Status)
+	_, err = h.RejectReturn(admin, &orderv1.RejectReturnRequest{ReturnId: ret.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	payments.setUnavailable(false)
+	approved, err := h.ApproveReturn(admin, &orderv1.ApproveReturnRequest{ReturnId: ret.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ReturnStatus_RETURN_STATUS_REFUNDED, approved.OrderReturn.Status)
+	require.Equal(t, "unopened", approved.OrderReturn.DecisionReason)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_COMPLETED, approved.Order.Status)
+	require.Equal(t, 1, payments.refunds)
+}
+
+func TestRefundingReturnIsSwept(t *testing.T) {
+	repo := stockedRepo(t)
+	payments := newRecordingProvider()
+	h := newPaymentTestHandler(t, repo, testCatalog(), payments, handler.PaymentConfig{SweepInterval: 10 * time.Millisecond})
+	order := deliveredOrder(t, h)
+	ret := requestReturn(t, h, order.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 1})
+
+	payments.setUnavailable(true)
+	_, err := h.ApproveReturn(asUser("admin-1", "admin"), &orderv1.ApproveReturnRequest{ReturnId: ret.Id})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	payments.setUnavailable(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.WatchPaymentReturns(ctx)
+
+	require.Eventually(t, func() bool {
+		stored, err := repo.GetReturn(context.Background(), ret.Id)
+		return err == nil && stored.Status == orderv1.ReturnStatus_RETURN_STATUS_REFUNDED
+	}, time.Second, 10*time.Millisecond)
+
+	stored, err := repo.GetOrder(context.Background(), order.Id)
+	require.NoError(t, err)
+	require.Equal(t, usd(1999), stored.PaymentInfo.Refunded)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_COMPLETED, stored.Status)
+}
+
+func TestReturnBeforeDelivery(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := authorizedOrder(t, h)
+
+	_, err := h.RequestReturn(asUser("user-1", ""), &orderv1.RequestReturnRequest{
+		OrderId: order.Id,
+		Items:   []*orderv1.ReturnItem{{ProductId: "p1", Quantity: 1}},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestListReturns(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	first := deliveredOrder(t, h)
+	second := deliveredOrder(t, h)
+	requestReturn(t, h, first.Id, &orderv1.ReturnItem{ProductId: "p1", Quantity: 1})
+	requestReturn(t, h, second.Id, &orderv1.ReturnItem{ProductId: "p2", Quantity: 1})
+
+	byOrder, err := h.ListReturns(asUser("user-1", ""), &orderv1.ListReturnsRequest{OrderId: first.Id, PageSize: 10})
+	require.NoError(t, err)
+	require.Len(t, byOrder.Returns, 1)
+	require.Equal(t, first.Id, byOrder.Returns[0].OrderId)
+
+	byUser, err := h.ListReturns(asUser("user-1", ""), &orderv1.ListReturnsRequest{PageSize: 10})
+	require.NoError(t, err)
+	require.Len(t, byUser.Returns, 2)
+
+	_, err = h.ListReturns(asUser("user-2", ""), &orderv1.ListReturnsRequest{UserId: "user-1", PageSize: 10})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = h.ListReturns(asUser("user-2", ""), &orderv1.ListReturnsRequest{OrderId: first.Id, PageSize: 10})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
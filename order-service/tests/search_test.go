@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/type/money"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// searchOrders places three orders of user-1: 19.99 USD of p1, 0.30 USD of
+// p2 and, authorized and so PROCESSING, 20.09 USD of both
+func searchOrders(t *testing.T, h *handler.OrderHandler) (p1, p2, both *orderv1.Order) {
+	resp, err := h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p1", Quantity: 1}))
+	require.NoError(t, err)
+	p1 = resp.Order
+
+	resp, err = h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "p2", Quantity: 3}))
+	require.NoError(t, err)
+	p2 = resp.Order
+
+	resp, err = h.CreateOrder(context.Background(), createOrderRequest(
+		&orderv1.OrderItem{ProductId: "p1", Quantity: 1},
+		&orderv1.OrderItem{ProductId: "p2", Quantity: 1},
+	))
+	require.NoError(t, err)
+	authorized, err := h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: resp.Order.Id})
+	require.NoError(t, err)
+	both = authorized.Order
+
+	return p1, p2, both
+}
+
+func listOrderIDs(t *testing.T, h *handler.OrderHandler, req *orderv1.ListOrdersRequest) []string {
+	req.UserId = "user-1"
+	resp, err := h.ListOrders(context.Background(), req)
+	require.NoError(t, err)
+
+	ids := make([]string, len(resp.Orders))
+	for i, order := range resp.Orders {
+		ids[i] = order.Id
+	}
+	return ids
+}
+
+func TestListOrdersFilters(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	p1, p2, both := searchOrders(t, h)
+
+	tests := []struct {
+		name   string
+		filter *orderv1.OrderFilter
+		want   []string
+	}{
+		{"no filter", nil, []string{p1.Id, p2.Id, both.Id}},
+		{"statuses", &orderv1.OrderFilter{Statuses: []orderv1.OrderStatus{
+			orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+			orderv1.OrderStatus_ORDER_STATUS_COMPLETED,
+		}}, []string{both.Id}},
+		{"product", &orderv1.OrderFilter{ProductId: "p2"}, []string{p2.Id, both.Id}},
+		{"payment status", &orderv1.OrderFilter{PaymentStatus: orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED}, []string{both.Id}},
+		{"payment method", &orderv1.OrderFilter{PaymentMethod: orderv1.PaymentMethod_PAYMENT_METHOD_BANK_TRANSFER}, nil},
+		{"shipping country", &orderv1.OrderFilter{ShippingCountry: "US"}, []string{p1.Id, p2.Id, both.Id}},
+		{"total range", &orderv1.OrderFilter{
+			MinTotal: &money.Money{CurrencyCode: "USD", Units: 1},
+			MaxTotal: &money.Money{CurrencyCode: "USD", Units: 20},
+		}, []string{p1.Id}},
+		{"other currency", &orderv1.OrderFilter{MinTotal: &money.Money{CurrencyCode: "EUR"}}, nil},
+		{"created range", &orderv1.OrderFilter{
+			CreatedAfter:  timestamppb.New(time.Now().Add(-time.Hour)),
+			CreatedBefore: timestamppb.New(time.Now().Add(time.Hour)),
+		}, []string{p1.Id, p2.Id, both.Id}},
+		{"updated later", &orderv1.OrderFilter{UpdatedAfter: timestamppb.New(time.Now().Add(time.Hour))}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := listOrderIDs(t, h, &orderv1.ListOrdersRequest{Filter: tt.filter})
+			require.ElementsMatch(t, tt.want, ids)
+		})
+	}
+
+	// The single status field still works, and UNSPECIFIED matches everything
+	ids := listOrderIDs(t, h, &orderv1.ListOrdersRequest{Status: orderv1.OrderStatus_ORDER_STATUS_PENDING})
+	require.ElementsMatch(t, []string{p1.Id, p2.Id}, ids)
+}
+
+func TestListOrdersByTotal(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	p1, p2, both := searchOrders(t, h)
+
+	ids := listOrderIDs(t, h, &orderv1.ListOrdersRequest{OrderBy: orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT})
+	require.Equal(t, []string{both.Id, p1.Id, p2.Id}, ids)
+
+	// Pages continue after the total of the last order
+	req := &orderv1.ListOrdersRequest{
+		UserId:    "user-1",
+		PageSize:  2,
+		OrderBy:   orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT,
+		SortOrder: orderv1.SortOrder_SORT_ORDER_ASC,
+	}
+	first, err := h.ListOrders(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, first.Orders, 2)
+	require.Equal(t, p2.Id, first.Orders[0].Id)
+	require.Equal(t, p1.Id, first.Orders[1].Id)
+	require.NotEmpty(t, first.NextPageToken)
+
+	req.PageToken = first.NextPageToken
+	second, err := h.ListOrders(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, second.Orders, 1)
+	require.Equal(t, both.Id, second.Orders[0].Id)
+	require.Empty(t, second.NextPageToken)
+
+	// A token only continues the query it came from
+	req.OrderBy = orderv1.OrderBy_ORDER_BY_CREATED_AT
+	_, err = h.ListOrders(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestListOrdersByTotalGroupsCurrencies(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	p1, p2, both := searchOrders(t, h)
+	resp, err := h.CreateOrder(context.Background(), createOrderRequest(&orderv1.OrderItem{ProductId: "yen", Quantity: 1}))
+	require.NoError(t, err)
+	yen := resp.Order
+
+	// 500 JPY is not more than 20.09 USD; totals only compare within a currency
+	for _, tt := range []struct {
+		sort orderv1.SortOrder
+		want []string
+	}{
+		{orderv1.SortOrder_SORT_ORDER_ASC, []string{yen.Id, p2.Id, p1.Id, both.Id}},
+		{orderv1.SortOrder_SORT_ORDER_DESC, []string{both.Id, p1.Id, p2.Id, yen.Id}},
+	} {
+		req := &orderv1.ListOrdersRequest{
+			UserId:    "user-1",
+			PageSize:  1,
+			OrderBy:   orderv1.OrderBy_ORDER_BY_TOTAL_AMOUNT,
+			SortOrder: tt.sort,
+		}
+		var ids []string
+		for {
+			page, err := h.ListOrders(context.Background(), req)
+			require.NoError(t, err)
+			for _, order := range page.Orders {
+				ids = append(ids, order.Id)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			req.PageToken = page.NextPageToken
+		}
+		require.Equal(t, tt.want, ids, tt.sort.String())
+	}
+}
+
+func TestListOrdersInvalidFilters(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		req  *orderv1.ListOrdersRequest
+	}{
+		{"no user", &orderv1.ListOrdersRequest{}},
+		{"empty range", &orderv1.ListOrdersRequest{UserId: "user-1", Filter: &orderv1.OrderFilter{
+			CreatedAfter:  timestamppb.New(now),
+			CreatedBefore: timestamppb.New(now),
+		}}},
+		{"inverted totals", &orderv1.ListOrdersRequest{UserId: "user-1", Filter: &orderv1.OrderFilter{
+			MinTotal: &money.Money{CurrencyCode: "USD", Units: 20},
+			MaxTotal: &money.Money{CurrencyCode: "USD", Units: 10},
+		}}},
+		{"mixed currencies", &orderv1.ListOrdersRequest{UserId: "user-1", Filter: &orderv1.OrderFilter{
+			MinTotal: &money.Money{CurrencyCode: "USD", Units: 1},
+			MaxTotal: &money.Money{CurrencyCode: "EUR", Units: 10},
+		}}},
+		{"too precise", &orderv1.ListOrdersRequest{UserId: "user-1", Filter: &orderv1.OrderFilter{
+			MinTotal: &money.Money{CurrencyCode: "USD", Nanos: 1_000_000},
+		}}},
+		{"unknown order_by", &orderv1.ListOrdersRequest{UserId: "user-1", OrderBy: orderv1.OrderBy(9)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.ListOrders(context.Background(), tt.req)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/servicetoken"
+)
+
+const testServiceToken = "00112233445566778899aabbccddeeff"
+
+func TestServiceTokenRejectsShortSecrets(t *testing.T) {
+	_, err := servicetoken.New("too-short")
+	require.Error(t, err)
+}
+
+func TestServiceTokenAuthenticatesCalls(t *testing.T) {
+	token, err := servicetoken.New(testServiceToken)
+	require.NoError(t, err)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(token.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(token.StreamServerInterceptor()),
+	)
+	userv1.RegisterUserServiceServer(server, fakeUserService{})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	dial := func(opts ...grpc.DialOption) userv1.UserServiceClient {
+		opts = append(opts,
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		conn, err := grpc.Dial("bufnet", opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return userv1.NewUserServiceClient(conn)
+	}
+	req := &userv1.GetUserRequest{Id: "user-1"}
+
+	_, err = dial(token.DialOption()).GetUser(context.Background(), req)
+	require.NoError(t, err)
+
+	// Neither a service credential nor forwarded identity gets in
+	anonymous := dial()
+	_, err = anonymous.GetUser(context.Background(), req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Forwarded identity alone is not trusted either
+	forged := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "admin-1", "x-user-roles", "admin")
+	_, err = anonymous.GetUser(forged, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	wrong, err := servicetoken.New("ffeeddccbbaa99887766554433221100")
+	require.NoError(t, err)
+	_, err = dial(wrong.DialOption()).GetUser(context.Background(), req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
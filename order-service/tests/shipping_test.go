@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	"github.com/zabilal/microservices/order-service/shipping"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func TestShippingTransitions(t *testing.T) {
+	require.True(t, shipping.CanTransition(orderv1.ShippingStatus_SHIPPING_STATUS_PENDING, orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED))
+	require.True(t, shipping.CanTransition(orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED, orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED))
+	require.True(t, shipping.CanTransition(orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED, orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED))
+	require.False(t, shipping.CanTransition(orderv1.ShippingStatus_SHIPPING_STATUS_PENDING, orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED))
+	require.False(t, shipping.CanTransition(orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED, orderv1.ShippingStatus_SHIPPING_STATUS_CANCELLED))
+}
+
+func TestShipmentLifecycle(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+	order := authorizedOrder(t, h)
+
+	// Only admins ship
+	_, err := h.MarkShipped(asUser("user-1", ""), &orderv1.MarkShippedRequest{OrderId: order.Id, Carrier: "UPS", TrackingNumber: "1Z999"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = h.MarkShipped(admin, &orderv1.MarkShippedRequest{OrderId: order.Id, Carrier: "UPS"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	shipped, err := h.MarkShipped(admin, &orderv1.MarkShippedRequest{OrderId: order.Id, Carrier: "UPS", TrackingNumber: "1Z999"})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED, shipped.Order.ShippingInfo.Status)
+	require.Equal(t, "UPS", shipped.Order.ShippingInfo.Carrier)
+	require.Equal(t, "1Z999", shipped.Order.ShippingInfo.TrackingNumber)
+	require.NotNil(t, shipped.Order.ShippingInfo.ShippedAt)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, shipped.Order.Status)
+	require.Equal(t, order.Version+1, shipped.Order.Version)
+
+	_, err = h.CancelOrder(context.Background(), &orderv1.CancelOrderRequest{OrderId: order.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	delivered, err := h.MarkDelivered(admin, &orderv1.MarkDeliveredRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_DELIVERED, delivered.Order.ShippingInfo.Status)
+	require.NotNil(t, delivered.Order.ShippingInfo.DeliveredAt)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_COMPLETED, delivered.Order.Status)
+
+	// A parcel only counts as returned once the customer asked for it
+	_, err = h.RecordReturn(admin, &orderv1.RecordReturnRequest{OrderId: order.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	require.NoError(t, repo.UpdateOrderStatus(context.Background(), order.Id, handler.Transition{To: orderv1.OrderStatus_ORDER_STATUS_RETURN_REQUESTED}))
+	returned, err := h.RecordReturn(admin, &orderv1.RecordReturnRequest{OrderId: order.Id, Reason: "damaged"})
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_RETURNED, returned.Order.ShippingInfo.Status)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_RETURNED, returned.Order.Status)
+	require.Equal(t, "1Z999", returned.Order.ShippingInfo.TrackingNumber)
+}
+
+func TestShipmentPreconditions(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+
+	// Unpaid orders stay in the warehouse
+	pending := placeOrder(t, h)
+	_, err := h.MarkShipped(admin, &orderv1.MarkShippedRequest{OrderId: pending.Id, Carrier: "UPS", TrackingNumber: "1Z999"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	paid := authorizedOrder(t, h)
+	_, err = h.MarkDelivered(admin, &orderv1.MarkDeliveredRequest{OrderId: paid.Id})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = h.MarkShipped(admin, &orderv1.MarkShippedRequest{OrderId: paid.Id, ExpectedVersion: paid.Version - 1, Carrier: "UPS", TrackingNumber: "1Z999"})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	stored, err := repo.GetOrder(context.Background(), paid.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_PENDING, stored.ShippingInfo.Status)
+}
@@ -0,0 +1,46 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+func TestUpdateOrderStatusExpectedVersion(t *testing.T) {
+	repo := stockedRepo(t)
+	h := newTestOrderHandler(t, repo, testCatalog())
+	admin := asUser("admin-1", "admin")
+	order := placeOrder(t, h)
+
+	resp, err := h.UpdateOrderStatus(admin, &orderv1.UpdateOrderStatusRequest{
+		OrderId:         order.Id,
+		Status:          orderv1.OrderStatus_ORDER_STATUS_PROCESSING,
+		ExpectedVersion: order.Version,
+	})
+	require.NoError(t, err)
+	require.Equal(t, order.Version+1, resp.Order.Version)
+
+	// A writer still holding the old version loses
+	_, err = h.UpdateOrderStatus(admin, &orderv1.UpdateOrderStatusRequest{
+		OrderId:         order.Id,
+		Status:          orderv1.OrderStatus_ORDER_STATUS_FAILED,
+		ExpectedVersion: order.Version,
+	})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	stored, err := repo.GetOrder(context.Background(), order.Id)
+	require.NoError(t, err)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, stored.Status)
+
+	// Leaving it unset skips the check
+	_, err = h.UpdateOrderStatus(admin, &orderv1.UpdateOrderStatusRequest{
+		OrderId: order.Id,
+		Status:  orderv1.OrderStatus_ORDER_STATUS_COMPLETED,
+	})
+	require.NoError(t, err)
+}
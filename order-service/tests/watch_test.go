@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zabilal/microservices/order-service/handler"
+	orderv1 "github.com/zabilal/microservices/pkg/genproto/order/v1"
+)
+
+// watchStream collects the orders WatchOrder sends
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	orders chan *orderv1.Order
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *watchStream) Send(resp *orderv1.WatchOrderResponse) error {
+	s.orders <- resp.Order
+	return nil
+}
+
+// watch runs WatchOrder in the background; its result is sent on the
+// returned channel
+func watch(ctx context.Context, h *handler.OrderHandler, req *orderv1.WatchOrderRequest) (*watchStream, <-chan error) {
+	stream := &watchStream{ctx: ctx, orders: make(chan *orderv1.Order, 10)}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.WatchOrder(req, stream)
+	}()
+	return stream, done
+}
+
+func nextOrder(t *testing.T, stream *watchStream) *orderv1.Order {
+	select {
+	case order := <-stream.orders:
+		return order
+	case <-time.After(time.Second):
+		t.Fatal("no order sent")
+		return nil
+	}
+}
+
+func watchResult(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("watch did not end")
+		return nil
+	}
+}
+
+func TestWatchOrder(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := placeOrder(t, h)
+
+	ctx, cancel := context.WithCancel(asUser("user-1", ""))
+	defer cancel()
+	stream, done := watch(ctx, h, &orderv1.WatchOrderRequest{OrderId: order.Id})
+
+	current := nextOrder(t, stream)
+	require.Equal(t, order.Version, current.Version)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PENDING, current.Status)
+
+	_, err := h.AuthorizePayment(context.Background(), &orderv1.AuthorizePaymentRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	processing := nextOrder(t, stream)
+	require.Equal(t, orderv1.OrderStatus_ORDER_STATUS_PROCESSING, processing.Status)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_AUTHORIZED, processing.PaymentInfo.Status)
+
+	// A payment change alone is a new version too
+	_, err = h.CapturePayment(asUser("admin-1", "admin"), &orderv1.CapturePaymentRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	captured := nextOrder(t, stream)
+	require.Equal(t, orderv1.PaymentStatus_PAYMENT_STATUS_COMPLETED, captured.PaymentInfo.Status)
+	require.Equal(t, processing.Version+1, captured.Version)
+
+	_, err = h.MarkShipped(asUser("admin-1", "admin"), &orderv1.MarkShippedRequest{OrderId: order.Id, Carrier: "UPS", TrackingNumber: "1Z999"})
+	require.NoError(t, err)
+	shipped := nextOrder(t, stream)
+	require.Equal(t, orderv1.ShippingStatus_SHIPPING_STATUS_SHIPPED, shipped.ShippingInfo.Status)
+
+	// The client going away ends the stream
+	cancel()
+	require.Equal(t, codes.Canceled, status.Code(watchResult(t, done)))
+}
+
+func TestWatchOrderResume(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := authorizedOrder(t, h)
+
+	ctx, cancel := context.WithCancel(asUser("user-1", ""))
+	defer cancel()
+	stream, _ := watch(ctx, h, &orderv1.WatchOrderRequest{OrderId: order.Id, SinceVersion: order.Version})
+
+	// The client already has the current version
+	select {
+	case <-stream.orders:
+		t.Fatal("current version sent again")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err := h.CapturePayment(asUser("admin-1", "admin"), &orderv1.CapturePaymentRequest{OrderId: order.Id})
+	require.NoError(t, err)
+	require.Equal(t, order.Version+1, nextOrder(t, stream).Version)
+}
+
+func TestWatchOrderAccess(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := placeOrder(t, h)
+
+	_, done := watch(asUser("user-2", ""), h, &orderv1.WatchOrderRequest{OrderId: order.Id})
+	require.Equal(t, codes.NotFound, status.Code(watchResult(t, done)))
+
+	_, done = watch(asUser("user-1", ""), h, &orderv1.WatchOrderRequest{OrderId: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(watchResult(t, done)))
+
+	// Admins watch any order
+	stream, _ := watch(asUser("admin-1", "admin"), h, &orderv1.WatchOrderRequest{OrderId: order.Id})
+	require.Equal(t, order.Id, nextOrder(t, stream).Id)
+	h.StopWatches()
+}
+
+func TestStopWatches(t *testing.T) {
+	h := newTestOrderHandler(t, stockedRepo(t), testCatalog())
+	order := placeOrder(t, h)
+
+	stream, done := watch(asUser("user-1", ""), h, &orderv1.WatchOrderRequest{OrderId: order.Id})
+	nextOrder(t, stream)
+
+	h.StopWatches()
+	require.Equal(t, codes.Unavailable, status.Code(watchResult(t, done)))
+}
@@ -0,0 +1,248 @@
+// Package money implements exact currency amounts stored as an integer
+// number of minor units, such as cents.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidCurrency  = errors.New("invalid currency code")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrInvalidAmount    = errors.New("invalid amount")
+	// ErrPrecision is returned for amounts finer than the currency's minor
+	// unit, such as 0.001 USD
+	ErrPrecision = errors.New("amount has more decimal places than the currency allows")
+	ErrOverflow  = errors.New("amount out of range")
+)
+
+// exponents lists ISO 4217 currencies whose minor unit is not 1/100
+var exponents = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"UGX": 0,
+	"VND": 0,
+}
+
+// Exponent returns the number of decimal places of the currency's minor unit
+func Exponent(currency string) int {
+	if exp, ok := exponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Money is an amount in minor units of an ISO 4217 currency
+type Money struct {
+	Currency string
+	Minor    int64
+}
+
+// New validates the currency code and returns the amount
+func New(currency string, minor int64) (Money, error) {
+	if !validCurrency(currency) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+	return Money{Currency: currency, Minor: minor}, nil
+}
+
+// Zero returns a zero amount in currency
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse reads a decimal string such as "12.34" or "-0.5". Digits beyond the
+// currency's minor unit must be zero, so "12.3400" is accepted for USD but
+// "12.345" is not.
+func Parse(currency, s string) (Money, error) {
+	if !validCurrency(currency) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || !allDigits(whole) || !allDigits(frac) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	exp := Exponent(currency)
+	if len(frac) > exp {
+		if strings.Trim(frac[exp:], "0") != "" {
+			return Money{}, ErrPrecision
+		}
+		frac = frac[:exp]
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	digits := whole + frac
+	if digits == "" {
+		digits = "0"
+	}
+	minor, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, ErrOverflow
+	}
+	if neg {
+		minor = -minor
+	}
+
+	return Money{Currency: currency, Minor: minor}, nil
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount as a plain decimal, e.g. "12.34", suitable for
+// DECIMAL columns
+func (m Money) String() string {
+	exp := Exponent(m.Currency)
+
+	sign := ""
+	minor := new(big.Int).SetInt64(m.Minor)
+	if minor.Sign() < 0 {
+		sign = "-"
+		minor.Neg(minor)
+	}
+
+	digits := minor.String()
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Minor < 0
+}
+
+// Add returns m + o. Both amounts must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	sum := m.Minor + o.Minor
+	if (sum > m.Minor) != (o.Minor > 0) {
+		return Money{}, ErrOverflow
+	}
+	return Money{Currency: m.Currency, Minor: sum}, nil
+}
+
+// Sub returns m - o. Both amounts must be in the same currency.
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Minor == math.MinInt64 {
+		return Money{}, ErrOverflow
+	}
+	return m.Add(Money{Currency: o.Currency, Minor: -o.Minor})
+}
+
+// Mul returns m * n, for example a unit price times a quantity
+func (m Money) Mul(n int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(m.Minor), big.NewInt(n))
+	if !product.IsInt64() {
+		return Money{}, ErrOverflow
+	}
+	return Money{Currency: m.Currency, Minor: product.Int64()}, nil
+}
+
+// MulRat returns m * num / den rounded to the nearest minor unit, with ties
+// going to the even unit (banker's rounding)
+func (m Money) MulRat(num, den int64) (Money, error) {
+	if den == 0 {
+		return Money{}, ErrInvalidAmount
+	}
+
+	r := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(m.Minor), big.NewInt(num)),
+		big.NewInt(den),
+	)
+	rounded := roundHalfEven(r)
+	if !rounded.IsInt64() {
+		return Money{}, ErrOverflow
+	}
+	return Money{Currency: m.Currency, Minor: rounded.Int64()}, nil
+}
+
+func roundHalfEven(r *big.Rat) *big.Int {
+	num, den := r.Num(), r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+
+	// Compare 2*|rem| with den to decide the direction
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(den)
+
+	if cmp > 0 || cmp == 0 && quo.Bit(0) == 1 {
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return quo
+}
+
+// Cmp compares two amounts in the same currency and returns -1, 0 or 1
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	switch {
+	case m.Minor < o.Minor:
+		return -1, nil
+	case m.Minor > o.Minor:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Sum adds amounts that must all be in currency
+func Sum(currency string, amounts ...Money) (Money, error) {
+	total := Zero(currency)
+	for _, a := range amounts {
+		var err error
+		if total, err = total.Add(a); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
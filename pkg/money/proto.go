@@ -0,0 +1,50 @@
+package money
+
+import (
+	"fmt"
+	"math"
+
+	moneypb "google.golang.org/genproto/googleapis/type/money"
+)
+
+const nanosPerUnit = 1_000_000_000
+
+// FromProto converts a google.type.Money. The amount must not be finer than
+// the currency's minor unit.
+func FromProto(p *moneypb.Money) (Money, error) {
+	if p == nil {
+		return Money{}, fmt.Errorf("%w: missing amount", ErrInvalidAmount)
+	}
+	if !validCurrency(p.GetCurrencyCode()) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidCurrency, p.GetCurrencyCode())
+	}
+
+	units, nanos := p.GetUnits(), int64(p.GetNanos())
+	if nanos <= -nanosPerUnit || nanos >= nanosPerUnit || units > 0 && nanos < 0 || units < 0 && nanos > 0 {
+		return Money{}, fmt.Errorf("%w: units and nanos must have the same sign", ErrInvalidAmount)
+	}
+
+	exp := Exponent(p.GetCurrencyCode())
+	step := int64(math.Pow10(9 - exp))
+	if nanos%step != 0 {
+		return Money{}, ErrPrecision
+	}
+
+	m, err := Money{Currency: p.GetCurrencyCode(), Minor: units}.Mul(int64(math.Pow10(exp)))
+	if err != nil {
+		return Money{}, err
+	}
+	return m.Add(Money{Currency: m.Currency, Minor: nanos / step})
+}
+
+// ToProto converts the amount to a google.type.Money
+func ToProto(m Money) *moneypb.Money {
+	scale := int64(math.Pow10(Exponent(m.Currency)))
+	step := int64(math.Pow10(9 - Exponent(m.Currency)))
+
+	return &moneypb.Money{
+		CurrencyCode: m.Currency,
+		Units:        m.Minor / scale,
+		Nanos:        int32(m.Minor % scale * step),
+	}
+}
@@ -0,0 +1,203 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+	// MinSecretLength is the shortest accepted signing secret, so that
+	// placeholder values cannot be used to forge page tokens
+	MinSecretLength = 32
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid page token")
+	ErrExpiredToken = errors.New("page token expired")
+)
+
+// Cursor marks the last row of a page in (created_at, id) keyset order, or
+// in (group, key, id) order for pages sorted by another column
+type Cursor struct {
+	CreatedAt time.Time `json:"c"`
+	// Group and Key are the sort values of the last row when the page is not
+	// ordered by creation time. Group partitions rows whose keys cannot be
+	// compared with each other, such as amounts in different currencies.
+	Group string `json:"g,omitempty"`
+	Key   string `json:"k,omitempty"`
+	ID    string `json:"i"`
+	Desc  bool   `json:"d"`
+	// Filter fingerprints the query the token was issued for so it cannot be
+	// replayed against a different one
+	Filter   string    `json:"f"`
+	IssuedAt time.Time `json:"t"`
+}
+
+// Page is a request for one page of results
+type Page struct {
+	Size  int32
+	Desc  bool
+	After *Cursor
+}
+
+// Codec signs and verifies opaque page tokens
+type Codec struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewCodec(secret string, ttl time.Duration) (*Codec, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("pagination secret must be at least %d bytes", MinSecretLength)
+	}
+	return &Codec{secret: []byte(secret), ttl: ttl}, nil
+}
+
+// Page validates the request parameters and decodes token, which is empty
+// for the first page
+func (c *Codec) Page(size int32, token string, desc bool, filter string) (Page, error) {
+	page := Page{Size: size, Desc: desc}
+	if page.Size <= 0 {
+		page.Size = DefaultPageSize
+	}
+	if page.Size > MaxPageSize {
+		page.Size = MaxPageSize
+	}
+
+	if token == "" {
+		return page, nil
+	}
+
+	cursor, err := c.decode(token)
+	if err != nil {
+		return Page{}, err
+	}
+	if cursor.Filter != filter || cursor.Desc != desc {
+		return Page{}, fmt.Errorf("%w: token was issued for a different query", ErrInvalidToken)
+	}
+
+	page.After = cursor
+	return page, nil
+}
+
+// NextToken returns the token for the page following the row (createdAt, id)
+func (c *Codec) NextToken(page Page, createdAt time.Time, id string, filter string) (string, error) {
+	return c.encode(&Cursor{
+		CreatedAt: createdAt,
+		ID:        id,
+		Desc:      page.Desc,
+		Filter:    filter,
+		IssuedAt:  time.Now(),
+	})
+}
+
+// NextKeyToken returns the token for the page following the row
+// (group, key, id) of a page sorted by a column other than the creation time
+func (c *Codec) NextKeyToken(page Page, group, key, id string, filter string) (string, error) {
+	return c.encode(&Cursor{
+		Group:    group,
+		Key:      key,
+		ID:       id,
+		Desc:     page.Desc,
+		Filter:   filter,
+		IssuedAt: time.Now(),
+	})
+}
+
+func (c *Codec) encode(cursor *Cursor) (string, error) {
+	payload, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + c.sign(body), nil
+}
+
+func (c *Codec) decode(token string) (*Cursor, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(c.sign(body))) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	cursor := &Cursor{}
+	if err := json.Unmarshal(payload, cursor); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if c.ttl > 0 && time.Since(cursor.IssuedAt) > c.ttl {
+		return nil, ErrExpiredToken
+	}
+
+	return cursor, nil
+}
+
+func (c *Codec) sign(body string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Filter builds a query fingerprint from the filter values
+func Filter(values ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(values, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// Keyset returns the WHERE condition selecting rows after the cursor and its
+// arguments. It returns an empty condition for the first page.
+func (p Page) Keyset(createdAtColumn, idColumn string) (string, []interface{}) {
+	if p.After == nil {
+		return "", nil
+	}
+
+	op := ">"
+	if p.Desc {
+		op = "<"
+	}
+
+	cond := fmt.Sprintf("(%[1]s %[3]s ? OR (%[1]s = ? AND %[2]s %[3]s ?))", createdAtColumn, idColumn, op)
+	return cond, []interface{}{p.After.CreatedAt, p.After.CreatedAt, p.After.ID}
+}
+
+// KeyKeyset is Keyset for pages sorted by (groupColumn, keyColumn),
+// continuing after the cursor's Group and Key
+func (p Page) KeyKeyset(groupColumn, keyColumn, idColumn string) (string, []interface{}) {
+	if p.After == nil {
+		return "", nil
+	}
+	op := ">"
+	if p.Desc {
+		op = "<"
+	}
+	cond := fmt.Sprintf("(%[1]s %[4]s ? OR (%[1]s = ? AND (%[2]s %[4]s ? OR (%[2]s = ? AND %[3]s %[4]s ?))))", groupColumn, keyColumn, idColumn, op)
+	return cond, []interface{}{p.After.Group, p.After.Group, p.After.Key, p.After.Key, p.After.ID}
+}
+
+// OrderBy returns the ORDER BY expression matching Keyset, or KeyKeyset when
+// given its columns
+func (p Page) OrderBy(columns ...string) string {
+	dir := " ASC"
+	if p.Desc {
+		dir = " DESC"
+	}
+	return strings.Join(columns, dir+", ") + dir
+}
+
+// Limit is the number of rows to fetch; one extra row tells whether another
+// page exists
+func (p Page) Limit() int32 {
+	return p.Size + 1
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys set by the api-gateway from a verified access token
+const (
+	metadataUserID    = "x-user-id"
+	metadataUserRoles = "x-user-roles"
+)
+
+const roleAdmin = "admin"
+
+// canAccessUser reports whether the end user forwarded by the gateway may
+// read the profile of userID. Every call has passed the service token
+// interceptor, so calls without identity metadata come from other services
+// inside the cluster and are allowed.
+func canAccessUser(ctx context.Context, userID string) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return true
+	}
+
+	ids := md.Get(metadataUserID)
+	if len(ids) == 0 || ids[0] == "" {
+		return true
+	}
+	if ids[0] == userID {
+		return true
+	}
+
+	for _, v := range md.Get(metadataUserRoles) {
+		for _, role := range strings.Split(v, ",") {
+			if strings.TrimSpace(role) == roleAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
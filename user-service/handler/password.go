@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores everything after the first 72 bytes of input
+const maxPasswordBytes = 72
+
+// PasswordConfig holds the bcrypt cost and the password strength policy
+type PasswordConfig struct {
+	Cost          int
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+type PasswordHasher struct {
+	config PasswordConfig
+	// dummyHash is compared against when a login names an unknown user so
+	// that response times do not reveal which emails are registered
+	dummyHash []byte
+}
+
+func NewPasswordHasher(config PasswordConfig) (*PasswordHasher, error) {
+	if config.Cost == 0 {
+		config.Cost = bcrypt.DefaultCost
+	}
+	if config.Cost < bcrypt.MinCost || config.Cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if config.MinLength > maxPasswordBytes {
+		return nil, fmt.Errorf("minimum password length cannot exceed %d", maxPasswordBytes)
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy-password"), config.Cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordHasher{config: config, dummyHash: dummyHash}, nil
+}
+
+// Validate checks the password against the configured strength policy
+func (p *PasswordHasher) Validate(password string) error {
+	var problems []string
+
+	if len(password) < p.config.MinLength {
+		problems = append(problems, fmt.Sprintf("at least %d characters", p.config.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("at most %d bytes", maxPasswordBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if p.config.RequireUpper && !upper {
+		problems = append(problems, "an uppercase letter")
+	}
+	if p.config.RequireLower && !lower {
+		problems = append(problems, "a lowercase letter")
+	}
+	if p.config.RequireDigit && !digit {
+		problems = append(problems, "a digit")
+	}
+	if p.config.RequireSymbol && !symbol {
+		problems = append(problems, "a symbol")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("password must contain " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func (p *PasswordHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), p.config.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify reports whether password matches hash, and whether the hash was
+// produced with a different cost than the one currently configured
+func (p *PasswordHasher) Verify(hash, password string) (ok bool, needsRehash bool) {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost != p.config.Cost
+}
+
+// VerifyUnknown burns the same amount of time as Verify for a missing user
+func (p *PasswordHasher) VerifyUnknown(password string) {
+	_ = bcrypt.CompareHashAndPassword(p.dummyHash, []byte(password))
+}
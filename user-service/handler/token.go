@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+
+	"github.com/zabilal/microservices/user-service/repository"
+)
+
+// TokenConfig holds the settings used to sign access tokens. When
+// PrivateKeyFile is set tokens are signed with RS256 or ES256 depending on the
+// key type, otherwise SigningKey is used as an HS256 secret.
+type TokenConfig struct {
+	Issuer          string
+	Audience        string
+	KeyID           string
+	SigningKey      string
+	PrivateKeyFile  string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+// AccessClaims mirrors the claims verified by the api-gateway
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// MinSigningKeyLength is the shortest accepted HS256 signing key, matching
+// the check the api-gateway applies to the same secret
+const MinSigningKeyLength = 32
+
+type TokenIssuer struct {
+	config TokenConfig
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+func NewTokenIssuer(config TokenConfig) (*TokenIssuer, error) {
+	if config.AccessTokenTTL <= 0 || config.RefreshTokenTTL <= 0 {
+		return nil, errors.New("token TTLs must be positive")
+	}
+
+	if config.PrivateKeyFile == "" {
+		if config.SigningKey == "" {
+			return nil, errors.New("either a signing key or a private key file is required")
+		}
+		if len(config.SigningKey) < MinSigningKeyLength {
+			return nil, fmt.Errorf("signing key must be at least %d bytes", MinSigningKeyLength)
+		}
+		return &TokenIssuer{
+			config: config,
+			method: jwt.SigningMethodHS256,
+			key:    []byte(config.SigningKey),
+		}, nil
+	}
+
+	data, err := os.ReadFile(config.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &TokenIssuer{config: config, method: jwt.SigningMethodRS256, key: key}, nil
+	}
+
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+	return &TokenIssuer{config: config, method: jwt.SigningMethodES256, key: key}, nil
+}
+
+// IssueAccessToken signs a short lived access token for the user
+func (t *TokenIssuer) IssueAccessToken(user *repository.User) (string, error) {
+	now := time.Now()
+	claims := &AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   user.ID,
+			Issuer:    t.config.Issuer,
+			Audience:  jwt.ClaimStrings{t.config.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(t.config.AccessTokenTTL)),
+		},
+		Roles: []string{user.Role},
+	}
+
+	token := jwt.NewWithClaims(t.method, claims)
+	if t.config.KeyID != "" {
+		token.Header["kid"] = t.config.KeyID
+	}
+
+	return token.SignedString(t.key)
+}
+
+// NewRefreshToken returns an opaque refresh token and its persisted record.
+// A new family is started when familyID is empty.
+func (t *TokenIssuer) NewRefreshToken(userID, familyID string) (string, *repository.RefreshToken, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	raw := base64.RawURLEncoding.EncodeToString(buf)
+
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+
+	now := time.Now()
+	return raw, &repository.RefreshToken{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: HashRefreshToken(raw),
+		ExpiresAt: now.Add(t.config.RefreshTokenTTL),
+		CreatedAt: now,
+	}, nil
+}
+
+// AccessTokenTTL is reported to clients as expires_in
+func (t *TokenIssuer) AccessTokenTTL() time.Duration {
+	return t.config.AccessTokenTTL
+}
+
+// HashRefreshToken returns the lookup hash stored for a refresh token
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,6 +12,7 @@ import (
 	"google.golang.org/grpc/status"
 
 	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/pagination"
 	"github.com/zabilal/microservices/user-service/repository"
 )
 
@@ -58,32 +60,58 @@ type DatabaseConfig struct {
 	DBName   string
 }
 
+// DefaultRole is assigned to self registered users
+const DefaultRole = "customer"
+
+// maxBatchGetUsers caps the ids of a BatchGetUsers call
+const maxBatchGetUsers = 100
+
 type UserHandler struct {
 	userv1.UnimplementedUserServiceServer
-	repo repository.UserRepository
-	log  *zap.Logger
+	repo      repository.UserRepository
+	tokens    *TokenIssuer
+	passwords *PasswordHasher
+	cursors   *pagination.Codec
+	log       *zap.Logger
 }
 
-func NewUserHandler(repo repository.UserRepository, log *zap.Logger) *UserHandler {
+func NewUserHandler(repo repository.UserRepository, tokens *TokenIssuer, passwords *PasswordHasher, cursors *pagination.Codec, log *zap.Logger) *UserHandler {
 	return &UserHandler{
-		repo: repo,
-		log:  log,
+		repo:      repo,
+		tokens:    tokens,
+		passwords: passwords,
+		cursors:   cursors,
+		log:       log,
 	}
 }
 
 func (h *UserHandler) CreateUser(ctx context.Context, req *userv1.CreateUserRequest) (*userv1.CreateUserResponse, error) {
+	if err := h.passwords.Validate(req.GetPassword()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	passwordHash, err := h.passwords.Hash(req.GetPassword())
+	if err != nil {
+		h.log.Error("failed to hash password", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to create user")
+	}
+
 	user := &repository.User{
-		ID:        uuid.New().String(),
-		Email:     req.GetEmail(),
-		FirstName: req.GetFirstName(),
-		LastName:  req.GetLastName(),
-		Password:  req.GetPassword(), // Note: In production, hash the password
-		Status:    userv1.UserStatus_USER_STATUS_ACTIVE,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:           uuid.New().String(),
+		Email:        req.GetEmail(),
+		FirstName:    req.GetFirstName(),
+		LastName:     req.GetLastName(),
+		PasswordHash: passwordHash,
+		Role:         DefaultRole,
+		Status:       userv1.UserStatus_USER_STATUS_ACTIVE,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
 	}
 
 	if err := h.repo.CreateUser(ctx, user); err != nil {
+		if errors.Is(err, repository.ErrEmailTaken) {
+			return nil, status.Error(codes.AlreadyExists, "email already registered")
+		}
 		h.log.Error("failed to create user", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to create user")
 	}
@@ -94,6 +122,10 @@ func (h *UserHandler) CreateUser(ctx context.Context, req *userv1.CreateUserRequ
 }
 
 func (h *UserHandler) GetUser(ctx context.Context, req *userv1.GetUserRequest) (*userv1.GetUserResponse, error) {
+	if !canAccessUser(ctx, req.GetId()) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+
 	user, err := h.repo.GetUser(ctx, req.GetId())
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -112,29 +144,95 @@ func (h *UserHandler) GetUser(ctx context.Context, req *userv1.GetUserRequest) (
 			Status:    user.Status,
 			CreatedAt: user.CreatedAt.Unix(),
 			UpdatedAt: user.UpdatedAt.Unix(),
+			Version:   user.Version,
 		},
 	}, nil
 }
 
+func (h *UserHandler) BatchGetUsers(ctx context.Context, req *userv1.BatchGetUsersRequest) (*userv1.BatchGetUsersResponse, error) {
+	if len(req.GetIds()) > maxBatchGetUsers {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d ids per request", maxBatchGetUsers)
+	}
+
+	seen := make(map[string]bool, len(req.GetIds()))
+	var ids []string
+	for _, id := range req.GetIds() {
+		if id == "" || seen[id] || !canAccessUser(ctx, id) {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	users, err := h.repo.GetUsers(ctx, ids)
+	if err != nil {
+		h.log.Error("failed to get users", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get users")
+	}
+
+	protoUsers := make([]*userv1.User, len(users))
+	for i, user := range users {
+		protoUsers[i] = &userv1.User{
+			Id:        user.ID,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Status:    user.Status,
+			CreatedAt: user.CreatedAt.Unix(),
+			UpdatedAt: user.UpdatedAt.Unix(),
+			Version:   user.Version,
+		}
+	}
+
+	return &userv1.BatchGetUsersResponse{Users: protoUsers}, nil
+}
+
 func (h *UserHandler) UpdateUser(ctx context.Context, req *userv1.UpdateUserRequest) (*userv1.UpdateUserResponse, error) {
+	if !canAccessUser(ctx, req.GetId()) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+
 	user := &repository.User{
 		ID:        req.GetId(),
 		Email:     req.GetEmail(),
 		FirstName: req.GetFirstName(),
 		LastName:  req.GetLastName(),
-		Status:    req.GetStatus(),
 		UpdatedAt: time.Now(),
+		Version:   req.GetExpectedVersion(),
 	}
 
 	if err := h.repo.UpdateUser(ctx, user); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, status.Error(codes.NotFound, "user not found")
 		}
+		if errors.Is(err, repository.ErrVersionMismatch) {
+			return nil, status.Error(codes.Aborted, "user was modified, reload it and retry")
+		}
+		if errors.Is(err, repository.ErrEmailTaken) {
+			return nil, status.Error(codes.AlreadyExists, "email already registered")
+		}
 		h.log.Error("failed to update user", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to update user")
 	}
 
-	return &userv1.UpdateUserResponse{}, nil
+	updated, err := h.repo.GetUser(ctx, req.GetId())
+	if err != nil {
+		h.log.Error("failed to get user", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to get user")
+	}
+
+	return &userv1.UpdateUserResponse{
+		User: &userv1.User{
+			Id:        updated.ID,
+			Email:     updated.Email,
+			FirstName: updated.FirstName,
+			LastName:  updated.LastName,
+			Status:    updated.Status,
+			CreatedAt: updated.CreatedAt.Unix(),
+			UpdatedAt: updated.UpdatedAt.Unix(),
+			Version:   updated.Version,
+		},
+	}, nil
 }
 
 func (h *UserHandler) DeleteUser(ctx context.Context, req *userv1.DeleteUserRequest) (*userv1.DeleteUserResponse, error) {
@@ -150,12 +248,30 @@ func (h *UserHandler) DeleteUser(ctx context.Context, req *userv1.DeleteUserRequ
 }
 
 func (h *UserHandler) ListUsers(ctx context.Context, req *userv1.ListUsersRequest) (*userv1.ListUsersResponse, error) {
-	users, nextPageToken, err := h.repo.ListUsers(ctx, req.GetPageSize(), req.GetPageToken())
+	desc := req.GetSortOrder() != userv1.SortOrder_SORT_ORDER_ASC
+	filter := pagination.Filter("users")
+
+	page, err := h.cursors.Page(req.GetPageSize(), req.GetPageToken(), desc, filter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	users, hasMore, err := h.repo.ListUsers(ctx, page)
 	if err != nil {
 		h.log.Error("failed to list users", zap.Error(err))
 		return nil, status.Error(codes.Internal, "failed to list users")
 	}
 
+	var nextPageToken string
+	if hasMore {
+		last := users[len(users)-1]
+		nextPageToken, err = h.cursors.NextToken(page, last.CreatedAt, last.ID, filter)
+		if err != nil {
+			h.log.Error("failed to encode page token", zap.Error(err))
+			return nil, status.Error(codes.Internal, "failed to list users")
+		}
+	}
+
 	var protoUsers []*userv1.User
 	for _, user := range users {
 		protoUsers = append(protoUsers, &userv1.User{
@@ -166,6 +282,7 @@ func (h *UserHandler) ListUsers(ctx context.Context, req *userv1.ListUsersReques
 			Status:    user.Status,
 			CreatedAt: user.CreatedAt.Unix(),
 			UpdatedAt: user.UpdatedAt.Unix(),
+			Version:   user.Version,
 		})
 	}
 
@@ -175,9 +292,182 @@ func (h *UserHandler) ListUsers(ctx context.Context, req *userv1.ListUsersReques
 	}, nil
 }
 
+func (h *UserHandler) Login(ctx context.Context, req *userv1.LoginRequest) (*userv1.LoginResponse, error) {
+	if req.GetEmail() == "" || req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "email and password are required")
+	}
+
+	user, err := h.repo.GetUserByEmail(ctx, req.GetEmail())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			h.passwords.VerifyUnknown(req.GetPassword())
+			return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+		}
+		h.log.Error("failed to get user", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to login")
+	}
+
+	ok, needsRehash := h.passwords.Verify(user.PasswordHash, req.GetPassword())
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+
+	// Upgrade hashes created with an outdated cost while we have the plaintext
+	if needsRehash {
+		h.rehashPassword(ctx, user.ID, req.GetPassword())
+	}
+
+	if user.Status != userv1.UserStatus_USER_STATUS_ACTIVE {
+		return nil, status.Error(codes.PermissionDenied, "user is not active")
+	}
+
+	accessToken, err := h.tokens.IssueAccessToken(user)
+	if err != nil {
+		h.log.Error("failed to issue access token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to login")
+	}
+
+	refreshToken, record, err := h.tokens.NewRefreshToken(user.ID, "")
+	if err != nil {
+		h.log.Error("failed to issue refresh token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to login")
+	}
+
+	if err := h.repo.CreateRefreshToken(ctx, record); err != nil {
+		h.log.Error("failed to store refresh token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to login")
+	}
+
+	return &userv1.LoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(h.tokens.AccessTokenTTL().Seconds()),
+		User: &userv1.User{
+			Id:        user.ID,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Status:    user.Status,
+			CreatedAt: user.CreatedAt.Unix(),
+			UpdatedAt: user.UpdatedAt.Unix(),
+			Version:   user.Version,
+		},
+	}, nil
+}
+
+func (h *UserHandler) RefreshToken(ctx context.Context, req *userv1.RefreshTokenRequest) (*userv1.RefreshTokenResponse, error) {
+	if req.GetRefreshToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	current, err := h.repo.GetRefreshToken(ctx, HashRefreshToken(req.GetRefreshToken()))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		h.log.Error("failed to get refresh token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+
+	// A rotated token being presented again means it leaked, so end the session
+	if current.RevokedAt.Valid {
+		h.revokeFamily(ctx, current.FamilyID)
+		return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+	}
+
+	if time.Now().After(current.ExpiresAt) {
+		return nil, status.Error(codes.Unauthenticated, "refresh token expired")
+	}
+
+	user, err := h.repo.GetUser(ctx, current.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		h.log.Error("failed to get user", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+
+	if user.Status != userv1.UserStatus_USER_STATUS_ACTIVE {
+		h.revokeFamily(ctx, current.FamilyID)
+		return nil, status.Error(codes.PermissionDenied, "user is not active")
+	}
+
+	refreshToken, next, err := h.tokens.NewRefreshToken(user.ID, current.FamilyID)
+	if err != nil {
+		h.log.Error("failed to issue refresh token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+
+	if err := h.repo.RotateRefreshToken(ctx, current.ID, next); err != nil {
+		if err == sql.ErrNoRows {
+			// Lost a race with another refresh of the same token
+			h.revokeFamily(ctx, current.FamilyID)
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+		h.log.Error("failed to rotate refresh token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+
+	accessToken, err := h.tokens.IssueAccessToken(user)
+	if err != nil {
+		h.log.Error("failed to issue access token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to refresh token")
+	}
+
+	return &userv1.RefreshTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(h.tokens.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+func (h *UserHandler) Logout(ctx context.Context, req *userv1.LogoutRequest) (*userv1.LogoutResponse, error) {
+	if req.GetRefreshToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	current, err := h.repo.GetRefreshToken(ctx, HashRefreshToken(req.GetRefreshToken()))
+	if err != nil {
+		// Logging out with an unknown token is a no-op
+		if err == sql.ErrNoRows {
+			return &userv1.LogoutResponse{}, nil
+		}
+		h.log.Error("failed to get refresh token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to logout")
+	}
+
+	if err := h.repo.RevokeRefreshTokenFamily(ctx, current.FamilyID); err != nil {
+		h.log.Error("failed to revoke refresh tokens", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to logout")
+	}
+
+	return &userv1.LogoutResponse{}, nil
+}
+
+func (h *UserHandler) revokeFamily(ctx context.Context, familyID string) {
+	if err := h.repo.RevokeRefreshTokenFamily(ctx, familyID); err != nil {
+		h.log.Error("failed to revoke refresh tokens", zap.Error(err), zap.String("family_id", familyID))
+	}
+}
+
+func (h *UserHandler) rehashPassword(ctx context.Context, userID, password string) {
+	passwordHash, err := h.passwords.Hash(password)
+	if err != nil {
+		h.log.Error("failed to rehash password", zap.Error(err), zap.String("user_id", userID))
+		return
+	}
+
+	if err := h.repo.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+		h.log.Error("failed to store rehashed password", zap.Error(err), zap.String("user_id", userID))
+	}
+}
+
 func (r *userRepository) CreateUser(ctx context.Context, user *repository.User) error {
 	query := `
-		INSERT INTO users (id, email, first_name, last_name, password, status, created_at, updated_at)
+		INSERT INTO users (id, email, first_name, last_name, password_hash, status, created_at, updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	
@@ -186,7 +476,7 @@ func (r *userRepository) CreateUser(ctx context.Context, user *repository.User)
 		user.Email,
 		user.FirstName,
 		user.LastName,
-		user.Password,
+		user.PasswordHash,
 		user.Status,
 		user.CreatedAt,
 		user.UpdatedAt,
@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -15,6 +17,8 @@ import (
 	"github.com/zabilal/microservices/monitoring/logger"
 	"github.com/zabilal/microservices/monitoring/metrics"
 	"github.com/zabilal/microservices/monitoring/tracing"
+	"github.com/zabilal/microservices/pkg/pagination"
+	"github.com/zabilal/microservices/pkg/servicetoken"
 	"github.com/zabilal/microservices/user-service/handler"
 )
 
@@ -24,6 +28,11 @@ type Config struct {
 	Environment    string
 	JaegerEndpoint string
 	DatabaseConfig DatabaseConfig
+	TokenConfig    handler.TokenConfig
+	PasswordConfig handler.PasswordConfig
+	PageSecret     string
+	PageTokenTTL   time.Duration
+	ServiceToken   string
 }
 
 type DatabaseConfig struct {
@@ -66,14 +75,42 @@ func main() {
 	// Initialize repository
 	repo := handler.NewUserRepository(cfg.DatabaseConfig)
 
+	// Initialize token issuer
+	tokens, err := handler.NewTokenIssuer(cfg.TokenConfig)
+	if err != nil {
+		log.Fatal("Failed to initialize token issuer", zap.Error(err))
+	}
+
+	// Initialize password hasher
+	passwords, err := handler.NewPasswordHasher(cfg.PasswordConfig)
+	if err != nil {
+		log.Fatal("Failed to initialize password hasher", zap.Error(err))
+	}
+
+	// Initialize page token codec
+	cursors, err := pagination.NewCodec(cfg.PageSecret, cfg.PageTokenTTL)
+	if err != nil {
+		log.Fatal("Failed to initialize page token codec", zap.Error(err))
+	}
+
+	// Calls from other services and the api-gateway carry the shared
+	// service token
+	serviceToken, err := servicetoken.New(cfg.ServiceToken)
+	if err != nil {
+		log.Fatal("Failed to initialize service token", zap.Error(err))
+	}
+
 	// Initialize gRPC server
 	lis, err := net.Listen("tcp", cfg.ServerAddress)
 	if err != nil {
 		log.Fatal("Failed to listen", zap.Error(err))
 	}
 
-	server := grpc.NewServer()
-	userHandler := handler.NewUserHandler(repo, log)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(serviceToken.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(serviceToken.StreamServerInterceptor()),
+	)
+	userHandler := handler.NewUserHandler(repo, tokens, passwords, cursors, log)
 	handler.RegisterUserServiceServer(server, userHandler)
 
 	// Start server
@@ -102,6 +139,9 @@ func loadConfig() *Config {
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
 	viper.AddConfigPath("/etc/microservices")
+	// Secrets come from the environment, e.g. AUTH_SIGNING_KEY
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
 	
 	if err := viper.ReadInConfig(); err != nil {
 		panic(fmt.Errorf("fatal error loading config file: %w", err))
@@ -119,5 +159,25 @@ func loadConfig() *Config {
 			Password: viper.GetString("database.password"),
 			DBName:   viper.GetString("database.dbname"),
 		},
+		TokenConfig: handler.TokenConfig{
+			Issuer:          viper.GetString("auth.issuer"),
+			Audience:        viper.GetString("auth.audience"),
+			KeyID:           viper.GetString("auth.key_id"),
+			SigningKey:      viper.GetString("auth.signing_key"),
+			PrivateKeyFile:  viper.GetString("auth.private_key_file"),
+			AccessTokenTTL:  viper.GetDuration("auth.access_token_ttl"),
+			RefreshTokenTTL: viper.GetDuration("auth.refresh_token_ttl"),
+		},
+		PasswordConfig: handler.PasswordConfig{
+			Cost:          viper.GetInt("password.cost"),
+			MinLength:     viper.GetInt("password.min_length"),
+			RequireUpper:  viper.GetBool("password.require_upper"),
+			RequireLower:  viper.GetBool("password.require_lower"),
+			RequireDigit:  viper.GetBool("password.require_digit"),
+			RequireSymbol: viper.GetBool("password.require_symbol"),
+		},
+		PageSecret:   viper.GetString("pagination.secret"),
+		PageTokenTTL: viper.GetDuration("pagination.token_ttl"),
+		ServiceToken: viper.GetString("service_token"),
 	}
 }
@@ -3,30 +3,77 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/go-sql-driver/mysql"
+
 	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/pagination"
 )
 
+// ErrVersionMismatch is returned by UpdateUser when the stored version differs
+// from the expected one
+var ErrVersionMismatch = errors.New("user version mismatch")
+
+// ErrEmailTaken is returned by CreateUser and UpdateUser when another user
+// already has the email address
+var ErrEmailTaken = errors.New("email already registered")
+
+const mysqlDuplicateEntry = 1062
+
+// isDuplicateEntry reports whether err is a unique key violation
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUser(ctx context.Context, id string) (*User, error)
+	// GetUsers returns the users with the given ids that exist, in no
+	// particular order
+	GetUsers(ctx context.Context, ids []string) ([]*User, error)
 	UpdateUser(ctx context.Context, user *User) error
 	DeleteUser(ctx context.Context, id string) error
-	ListUsers(ctx context.Context, pageSize int32, pageToken string) ([]*User, string, error)
+	ListUsers(ctx context.Context, page pagination.Page) ([]*User, bool, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	UpdatePasswordHash(ctx context.Context, id string, passwordHash string) error
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, oldID string, next *RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
 }
 
 type User struct {
-	ID        string
-	Email     string
-	FirstName string
-	LastName  string
-	Password  string
-	Status    userv1.UserStatus
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID           string
+	Email        string
+	FirstName    string
+	LastName     string
+	PasswordHash string
+	Role         string
+	Status       userv1.UserStatus
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	// Version is incremented on every update. On UpdateUser a non-zero
+	// Version is the version the caller expects to overwrite.
+	Version int64
+}
+
+// RefreshToken is a persisted refresh token. Only the SHA-256 hash of the
+// token is stored; tokens issued from one login share a FamilyID so reuse of
+// a rotated token can revoke the whole session.
+type RefreshToken struct {
+	ID         string
+	UserID     string
+	FamilyID   string
+	TokenHash  string
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+	ReplacedBy sql.NullString
+	CreatedAt  time.Time
 }
 
 type DatabaseConfig struct {
@@ -65,8 +112,8 @@ func NewUserRepository(config DatabaseConfig) (UserRepository, error) {
 
 func (r *userRepository) CreateUser(ctx context.Context, user *User) error {
 	query := `
-		INSERT INTO users (id, email, first_name, last_name, password, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO users (id, email, first_name, last_name, password_hash, role, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	
 	_, err := r.db.ExecContext(ctx, query,
@@ -74,13 +121,17 @@ func (r *userRepository) CreateUser(ctx context.Context, user *User) error {
 		user.Email,
 		user.FirstName,
 		user.LastName,
-		user.Password,
+		user.PasswordHash,
+		user.Role,
 		user.Status,
 		user.CreatedAt,
 		user.UpdatedAt,
 	)
 	
 	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrEmailTaken
+		}
 		return fmt.Errorf("failed to create user: %w", err)
 	}
 
@@ -89,7 +140,7 @@ func (r *userRepository) CreateUser(ctx context.Context, user *User) error {
 
 func (r *userRepository) GetUser(ctx context.Context, id string) (*User, error) {
 	query := `
-		SELECT id, email, first_name, last_name, password, status, created_at, updated_at
+		SELECT id, email, first_name, last_name, role, status, created_at, updated_at, version
 		FROM users
 		WHERE id = ?
 	`
@@ -100,10 +151,11 @@ func (r *userRepository) GetUser(ctx context.Context, id string) (*User, error)
 		&user.Email,
 		&user.FirstName,
 		&user.LastName,
-		&user.Password,
+		&user.Role,
 		&user.Status,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 	
 	if err != nil {
@@ -116,23 +168,76 @@ func (r *userRepository) GetUser(ctx context.Context, id string) (*User, error)
 	return user, nil
 }
 
+func (r *userRepository) GetUsers(ctx context.Context, ids []string) ([]*User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	query := `
+		SELECT id, email, first_name, last_name, role, status, created_at, updated_at, version
+		FROM users
+		WHERE id IN (` + strings.Repeat("?, ", len(ids)-1) + `?)
+	`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Role,
+			&user.Status,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	return users, nil
+}
+
 func (r *userRepository) UpdateUser(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET email = ?, first_name = ?, last_name = ?, status = ?, updated_at = ?
-		WHERE id = ?
+		SET email = ?, first_name = ?, last_name = ?, updated_at = ?, version = version + 1
+		WHERE id = ? AND (? = 0 OR version = ?)
 	`
-	
+
 	result, err := r.db.ExecContext(ctx, query,
 		user.Email,
 		user.FirstName,
 		user.LastName,
-		user.Status,
 		time.Now(),
 		user.ID,
+		user.Version,
+		user.Version,
 	)
-	
+
 	if err != nil {
+		if isDuplicateEntry(err) {
+			return ErrEmailTaken
+		}
 		return fmt.Errorf("failed to update user: %w", err)
 	}
 
@@ -142,7 +247,13 @@ func (r *userRepository) UpdateUser(ctx context.Context, user *User) error {
 	}
 
 	if rows == 0 {
-		return sql.ErrNoRows
+		// Tell a missing user apart from a stale version
+		var version int64
+		err := r.db.QueryRowContext(ctx, "SELECT version FROM users WHERE id = ?", user.ID).Scan(&version)
+		if err != nil {
+			return err
+		}
+		return ErrVersionMismatch
 	}
 
 	return nil
@@ -171,22 +282,25 @@ func (r *userRepository) DeleteUser(ctx context.Context, id string) error {
 	return nil
 }
 
-func (r *userRepository) ListUsers(ctx context.Context, pageSize int32, pageToken string) ([]*User, string, error) {
+// ListUsers returns up to page.Size users after the page cursor in
+// (created_at, id) order, and whether more users follow
+func (r *userRepository) ListUsers(ctx context.Context, page pagination.Page) ([]*User, bool, error) {
 	query := `
-		SELECT id, email, first_name, last_name, password, status, created_at, updated_at
+		SELECT id, email, first_name, last_name, role, status, created_at, updated_at, version
 		FROM users
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
 	`
-	
-	offset := int32(0)
-	if pageToken != "" {
-		offset = pageSize * int32(len(pageToken))
+
+	var args []interface{}
+	if cond, condArgs := page.Keyset("created_at", "id"); cond != "" {
+		query += " WHERE " + cond
+		args = append(args, condArgs...)
 	}
+	query += " ORDER BY " + page.OrderBy("created_at", "id") + " LIMIT ?"
+	args = append(args, page.Limit())
 
-	rows, err := r.db.QueryContext(ctx, query, pageSize, offset)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to list users: %w", err)
+		return nil, false, fmt.Errorf("failed to list users: %w", err)
 	}
 	defer rows.Close()
 
@@ -198,21 +312,193 @@ func (r *userRepository) ListUsers(ctx context.Context, pageSize int32, pageToke
 			&user.Email,
 			&user.FirstName,
 			&user.LastName,
-			&user.Password,
+			&user.Role,
 			&user.Status,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.Version,
 		)
 		if err != nil {
-			return nil, "", fmt.Errorf("failed to scan user: %w", err)
+			return nil, false, fmt.Errorf("failed to scan user: %w", err)
 		}
 		users = append(users, user)
 	}
 
-	var nextPageToken string
-	if len(users) == int(pageSize) {
-		nextPageToken = uuid.New().String()
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	hasMore := len(users) > int(page.Size)
+	if hasMore {
+		users = users[:page.Size]
+	}
+
+	return users, hasMore, nil
+}
+
+func (r *userRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	query := `
+		SELECT id, email, first_name, last_name, password_hash, role, status, created_at, updated_at, version
+		FROM users
+		WHERE email = ?
+	`
+
+	user := &User{}
+	err := r.db.QueryRowContext(ctx, query, email).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.PasswordHash,
+		&user.Role,
+		&user.Status,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Version,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *userRepository) UpdatePasswordHash(ctx context.Context, id string, passwordHash string) error {
+	query := `
+		UPDATE users
+		SET password_hash = ?
+		WHERE id = ?
+	`
+
+	result, err := r.db.ExecContext(ctx, query, passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r *userRepository) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	if err := insertRefreshToken(ctx, r.db, token); err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+	return nil
+}
+
+func (r *userRepository) GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, revoked_at, replaced_by, created_at
+		FROM refresh_tokens
+		WHERE token_hash = ?
+	`
+
+	token := &RefreshToken{}
+	err := r.db.QueryRowContext(ctx, query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.TokenHash,
+		&token.ExpiresAt,
+		&token.RevokedAt,
+		&token.ReplacedBy,
+		&token.CreatedAt,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
 	}
 
-	return users, nextPageToken, nil
+	return token, nil
+}
+
+// RotateRefreshToken revokes oldID and stores next in its place. It returns
+// sql.ErrNoRows if oldID was already revoked, e.g. by a concurrent refresh.
+func (r *userRepository) RotateRefreshToken(ctx context.Context, oldID string, next *RefreshToken) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = ?, replaced_by = ?
+		WHERE id = ? AND revoked_at IS NULL
+	`
+
+	result, err := tx.ExecContext(ctx, query, time.Now(), next.ID, oldID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := insertRefreshToken(ctx, tx, next); err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *userRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = ?
+		WHERE family_id = ? AND revoked_at IS NULL
+	`
+
+	if _, err := r.db.ExecContext(ctx, query, time.Now(), familyID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertRefreshToken(ctx context.Context, db execer, token *RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := db.ExecContext(ctx, query,
+		token.ID,
+		token.UserID,
+		token.FamilyID,
+		token.TokenHash,
+		token.ExpiresAt,
+		token.CreatedAt,
+	)
+
+	return err
 }
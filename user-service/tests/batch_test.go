@@ -0,0 +1,57 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+func TestBatchGetUsers(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	ada := createTestUser(t, h, "ada@example.com", testPassword)
+	grace := createTestUser(t, h, "grace@example.com", testPassword)
+
+	resp, err := h.BatchGetUsers(context.Background(), &userv1.BatchGetUsersRequest{
+		Ids: []string{ada, "missing", grace, ada},
+	})
+	require.NoError(t, err)
+
+	var ids []string
+	for _, user := range resp.Users {
+		ids = append(ids, user.Id)
+	}
+	require.ElementsMatch(t, []string{ada, grace}, ids)
+}
+
+func TestBatchGetUsersAccess(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	ada := createTestUser(t, h, "ada@example.com", testPassword)
+	grace := createTestUser(t, h, "grace@example.com", testPassword)
+
+	// An end user only sees their own profile
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-user-id", ada))
+	resp, err := h.BatchGetUsers(ctx, &userv1.BatchGetUsersRequest{Ids: []string{ada, grace}})
+	require.NoError(t, err)
+	require.Len(t, resp.Users, 1)
+	require.Equal(t, ada, resp.Users[0].Id)
+}
+
+func TestBatchGetUsersLimit(t *testing.T) {
+	h := newTestUserHandler(t, newMemoryUserRepo())
+
+	ids := make([]string, 101)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("user-%d", i)
+	}
+	_, err := h.BatchGetUsers(context.Background(), &userv1.BatchGetUsersRequest{Ids: ids})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
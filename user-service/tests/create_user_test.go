@@ -0,0 +1,35 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+func TestCreateUserDuplicateEmail(t *testing.T) {
+	h := newTestUserHandler(t, newMemoryUserRepo())
+	createTestUser(t, h, "ada@example.com", testPassword)
+
+	_, err := h.CreateUser(context.Background(), &userv1.CreateUserRequest{
+		Email:    "ada@example.com",
+		Password: testPassword,
+	})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestUpdateUserDuplicateEmail(t *testing.T) {
+	h := newTestUserHandler(t, newMemoryUserRepo())
+	createTestUser(t, h, "ada@example.com", testPassword)
+	userID := createTestUser(t, h, "grace@example.com", testPassword)
+
+	_, err := h.UpdateUser(context.Background(), &userv1.UpdateUserRequest{
+		Id:    userID,
+		Email: "ada@example.com",
+	})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+}
@@ -0,0 +1,228 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/pkg/pagination"
+	"github.com/zabilal/microservices/user-service/handler"
+	"github.com/zabilal/microservices/user-service/repository"
+)
+
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+// memoryUserRepo keeps users and refresh tokens in memory. Only the methods
+// the handler tests need are implemented.
+type memoryUserRepo struct {
+	mu     sync.Mutex
+	users  map[string]*repository.User
+	tokens map[string]*repository.RefreshToken
+}
+
+func newMemoryUserRepo() *memoryUserRepo {
+	return &memoryUserRepo{
+		users:  make(map[string]*repository.User),
+		tokens: make(map[string]*repository.RefreshToken),
+	}
+}
+
+func (r *memoryUserRepo) CreateUser(ctx context.Context, user *repository.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emailTaken(user.Email, user.ID) {
+		return repository.ErrEmailTaken
+	}
+	stored := *user
+	// The column defaults to 1
+	stored.Version = 1
+	r.users[user.ID] = &stored
+	return nil
+}
+
+func (r *memoryUserRepo) GetUser(ctx context.Context, id string) (*repository.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	stored := *user
+	return &stored, nil
+}
+
+func (r *memoryUserRepo) GetUsers(ctx context.Context, ids []string) ([]*repository.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var users []*repository.User
+	for _, id := range ids {
+		if user, ok := r.users[id]; ok {
+			stored := *user
+			users = append(users, &stored)
+		}
+	}
+	return users, nil
+}
+
+func (r *memoryUserRepo) UpdateUser(ctx context.Context, user *repository.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if user.Version != 0 && stored.Version != user.Version {
+		return repository.ErrVersionMismatch
+	}
+	if r.emailTaken(user.Email, user.ID) {
+		return repository.ErrEmailTaken
+	}
+	stored.Email = user.Email
+	stored.FirstName = user.FirstName
+	stored.LastName = user.LastName
+	stored.UpdatedAt = user.UpdatedAt
+	stored.Version++
+	return nil
+}
+
+// emailTaken reports whether a user other than id has the email, as the
+// unique key on users.email would
+func (r *memoryUserRepo) emailTaken(email, id string) bool {
+	for _, user := range r.users {
+		if user.Email == email && user.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryUserRepo) DeleteUser(ctx context.Context, id string) error {
+	panic("not implemented")
+}
+
+func (r *memoryUserRepo) ListUsers(ctx context.Context, page pagination.Page) ([]*repository.User, bool, error) {
+	panic("not implemented")
+}
+
+func (r *memoryUserRepo) GetUserByEmail(ctx context.Context, email string) (*repository.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Email == email {
+			stored := *user
+			return &stored, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *memoryUserRepo) UpdatePasswordHash(ctx context.Context, id string, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+func (r *memoryUserRepo) CreateRefreshToken(ctx context.Context, token *repository.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *token
+	r.tokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (r *memoryUserRepo) GetRefreshToken(ctx context.Context, tokenHash string) (*repository.RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.tokens[tokenHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	stored := *token
+	return &stored, nil
+}
+
+func (r *memoryUserRepo) RotateRefreshToken(ctx context.Context, oldID string, next *repository.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, token := range r.tokens {
+		if token.ID != oldID {
+			continue
+		}
+		if token.RevokedAt.Valid {
+			return sql.ErrNoRows
+		}
+		token.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		token.ReplacedBy = sql.NullString{String: next.ID, Valid: true}
+		stored := *next
+		r.tokens[next.TokenHash] = &stored
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+func (r *memoryUserRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, token := range r.tokens {
+		if token.FamilyID == familyID && !token.RevokedAt.Valid {
+			token.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return nil
+}
+
+// revoked reports whether every token of the family was revoked
+func (r *memoryUserRepo) revoked(familyID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, token := range r.tokens {
+		if token.FamilyID == familyID && !token.RevokedAt.Valid {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestUserHandler(t *testing.T, repo repository.UserRepository) *handler.UserHandler {
+	tokens, err := handler.NewTokenIssuer(handler.TokenConfig{
+		Issuer:          "user-service",
+		Audience:        "microservices",
+		SigningKey:      testSigningKey,
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+	require.NoError(t, err)
+
+	passwords, err := handler.NewPasswordHasher(handler.PasswordConfig{
+		Cost:      bcrypt.MinCost,
+		MinLength: 10,
+	})
+	require.NoError(t, err)
+
+	cursors, err := pagination.NewCodec(testSigningKey, time.Hour)
+	require.NoError(t, err)
+
+	return handler.NewUserHandler(repo, tokens, passwords, cursors, zap.NewNop())
+}
+
+// createTestUser registers an active user and returns its id
+func createTestUser(t *testing.T, h *handler.UserHandler, email, password string) string {
+	resp, err := h.CreateUser(context.Background(), &userv1.CreateUserRequest{
+		Email:    email,
+		Password: password,
+	})
+	require.NoError(t, err)
+	return resp.Id
+}
@@ -0,0 +1,67 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/zabilal/microservices/user-service/handler"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	hasher, err := handler.NewPasswordHasher(handler.PasswordConfig{
+		Cost:         bcrypt.MinCost,
+		MinLength:    10,
+		RequireUpper: true,
+		RequireDigit: true,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		password    string
+		expectError bool
+	}{
+		{name: "strong password", password: "Correct1Horse"},
+		{name: "too short", password: "Short1A", expectError: true},
+		{name: "missing digit", password: "NoDigitsHere", expectError: true},
+		{name: "missing uppercase", password: "nouppercase1", expectError: true},
+		{name: "longer than bcrypt accepts", password: "A1" + string(make([]byte, 80)), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hasher.Validate(tt.password)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPasswordVerifyAndRehash(t *testing.T) {
+	oldHasher, err := handler.NewPasswordHasher(handler.PasswordConfig{Cost: bcrypt.MinCost})
+	require.NoError(t, err)
+
+	hash, err := oldHasher.Hash("Correct1Horse")
+	require.NoError(t, err)
+	require.NotEqual(t, "Correct1Horse", hash)
+
+	ok, needsRehash := oldHasher.Verify(hash, "Correct1Horse")
+	require.True(t, ok)
+	require.False(t, needsRehash)
+
+	ok, _ = oldHasher.Verify(hash, "wrong")
+	require.False(t, ok)
+
+	// Raising the configured cost flags existing hashes for upgrade
+	newHasher, err := handler.NewPasswordHasher(handler.PasswordConfig{Cost: bcrypt.MinCost + 1})
+	require.NoError(t, err)
+
+	ok, needsRehash = newHasher.Verify(hash, "Correct1Horse")
+	require.True(t, ok)
+	require.True(t, needsRehash)
+}
@@ -0,0 +1,142 @@
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+	"github.com/zabilal/microservices/user-service/handler"
+)
+
+const testPassword = "correct-horse-battery"
+
+func login(t *testing.T, h *handler.UserHandler, email string) *userv1.LoginResponse {
+	resp, err := h.Login(context.Background(), &userv1.LoginRequest{Email: email, Password: testPassword})
+	require.NoError(t, err)
+	return resp
+}
+
+func TestLogin(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	userID := createTestUser(t, h, "ada@example.com", testPassword)
+
+	resp := login(t, h, "ada@example.com")
+	require.NotEmpty(t, resp.AccessToken)
+	require.NotEmpty(t, resp.RefreshToken)
+	require.Equal(t, "Bearer", resp.TokenType)
+	require.Equal(t, int64(60), resp.ExpiresIn)
+	require.Equal(t, userID, resp.User.Id)
+
+	_, err := h.Login(context.Background(), &userv1.LoginRequest{Email: "ada@example.com", Password: "wrong-password"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Unknown emails fail exactly like a wrong password
+	_, err = h.Login(context.Background(), &userv1.LoginRequest{Email: "bob@example.com", Password: testPassword})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	repo.users[userID].Status = userv1.UserStatus_USER_STATUS_INACTIVE
+	_, err = h.Login(context.Background(), &userv1.LoginRequest{Email: "ada@example.com", Password: testPassword})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	createTestUser(t, h, "ada@example.com", testPassword)
+	first := login(t, h, "ada@example.com").RefreshToken
+
+	refreshed, err := h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: first})
+	require.NoError(t, err)
+	require.NotEmpty(t, refreshed.AccessToken)
+	require.NotEqual(t, first, refreshed.RefreshToken)
+
+	// The replacement works until it is rotated in turn
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: refreshed.RefreshToken})
+	require.NoError(t, err)
+
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: "unknown"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	createTestUser(t, h, "ada@example.com", testPassword)
+	first := login(t, h, "ada@example.com").RefreshToken
+
+	refreshed, err := h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: first})
+	require.NoError(t, err)
+
+	// Presenting the rotated token again means it leaked
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: first})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stored, err := repo.GetRefreshToken(context.Background(), handler.HashRefreshToken(first))
+	require.NoError(t, err)
+	require.True(t, repo.revoked(stored.FamilyID))
+
+	// So the token that replaced it no longer works either
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: refreshed.RefreshToken})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestRefreshTokenInactiveUser(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	userID := createTestUser(t, h, "ada@example.com", testPassword)
+	token := login(t, h, "ada@example.com").RefreshToken
+
+	repo.users[userID].Status = userv1.UserStatus_USER_STATUS_INACTIVE
+	_, err := h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: token})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stored, err := repo.GetRefreshToken(context.Background(), handler.HashRefreshToken(token))
+	require.NoError(t, err)
+	require.True(t, repo.revoked(stored.FamilyID))
+}
+
+func TestLogout(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	createTestUser(t, h, "ada@example.com", testPassword)
+	first := login(t, h, "ada@example.com").RefreshToken
+
+	refreshed, err := h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: first})
+	require.NoError(t, err)
+
+	// Logging out with any token of the session ends all of it
+	_, err = h.Logout(context.Background(), &userv1.LogoutRequest{RefreshToken: first})
+	require.NoError(t, err)
+
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: refreshed.RefreshToken})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Other sessions of the same user are untouched
+	other := login(t, h, "ada@example.com").RefreshToken
+	_, err = h.RefreshToken(context.Background(), &userv1.RefreshTokenRequest{RefreshToken: other})
+	require.NoError(t, err)
+
+	_, err = h.Logout(context.Background(), &userv1.LogoutRequest{RefreshToken: "unknown"})
+	require.NoError(t, err)
+
+	_, err = h.Logout(context.Background(), &userv1.LogoutRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestRejectShortSigningKey(t *testing.T) {
+	_, err := handler.NewTokenIssuer(handler.TokenConfig{
+		SigningKey:      "change-me",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	userv1 "github.com/zabilal/microservices/pkg/genproto/user/v1"
+)
+
+func TestUpdateUserExpectedVersion(t *testing.T) {
+	repo := newMemoryUserRepo()
+	h := newTestUserHandler(t, repo)
+	userID := createTestUser(t, h, "ada@example.com", testPassword)
+	version := repo.users[userID].Version
+
+	resp, err := h.UpdateUser(context.Background(), &userv1.UpdateUserRequest{
+		Id:              userID,
+		Email:           "ada@example.com",
+		FirstName:       "Ada",
+		ExpectedVersion: version,
+	})
+	require.NoError(t, err)
+	require.Equal(t, version+1, resp.User.Version)
+	require.Equal(t, "Ada", resp.User.FirstName)
+
+	// Updating the profile leaves the account status alone
+	require.Equal(t, userv1.UserStatus_USER_STATUS_ACTIVE, resp.User.Status)
+
+	_, err = h.UpdateUser(context.Background(), &userv1.UpdateUserRequest{
+		Id:              userID,
+		Email:           "ada@example.com",
+		FirstName:       "Grace",
+		ExpectedVersion: version,
+	})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	stored, err := repo.GetUser(context.Background(), userID)
+	require.NoError(t, err)
+	require.Equal(t, "Ada", stored.FirstName)
+}